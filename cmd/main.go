@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -21,6 +22,44 @@ func main() {
 		DataDir:     "./data",
 		MaxFileSize: 10 * 1024 * 1024, // 10MB
 	}
+	if durability := os.Getenv("DURABILITY"); durability != "" {
+		config.Durability = entity.DurabilityMode(durability)
+		if _, err := config.DurabilityOrDefault(); err != nil {
+			log.Fatal("Unsupported DURABILITY: ", durability)
+		}
+	}
+	if maxAge := os.Getenv("RETENTION_MAX_AGE"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			log.Fatal("Invalid RETENTION_MAX_AGE:", err)
+		}
+		config.Retention.MaxAge = d
+	}
+	if maxBytes := os.Getenv("RETENTION_MAX_BYTES"); maxBytes != "" {
+		n, err := strconv.ParseUint(maxBytes, 10, 64)
+		if err != nil {
+			log.Fatal("Invalid RETENTION_MAX_BYTES:", err)
+		}
+		config.Retention.MaxBytes = n
+	}
+	if compression := os.Getenv("COMPRESSION"); compression != "" {
+		switch entity.Compression(compression) {
+		case entity.CompressionNone, entity.CompressionGzip, entity.CompressionSnappy, entity.CompressionZstd:
+			config.Compression = entity.Compression(compression)
+		default:
+			log.Fatal("Unsupported COMPRESSION: ", compression)
+		}
+	}
+	if keyFile := os.Getenv("KEY_FILE"); keyFile != "" {
+		config.KeyFile = keyFile
+	}
+	if encryption := os.Getenv("ENCRYPTION"); encryption != "" {
+		enabled, err := strconv.ParseBool(encryption)
+		if err != nil {
+			log.Fatal("Invalid ENCRYPTION:", err)
+		}
+		config.Encryption = enabled
+	}
 
 	// Cluster configuration
 	clusterConfig := cluster.DefaultConfig()
@@ -42,17 +81,23 @@ func main() {
 	if port := os.Getenv("CLUSTER_PORT"); port != "" {
 		clusterConfig.ClusterPort = port
 	}
+	if httpPort := os.Getenv("HTTP_PORT"); httpPort != "" {
+		clusterConfig.HTTPPort = httpPort
+	}
 	if dataDir := os.Getenv("DATA_DIR"); dataDir != "" {
 		clusterConfig.DataDir = dataDir
 	}
 
 	// Initialize layers
-	repo := repository.NewFileStorageRepository(config)
+	repo, err := repository.OpenFileStorageRepository(config)
+	if err != nil {
+		log.Fatal("Invalid encryption configuration: ", err)
+	}
 	uc := usecase.NewStorageUsecase(repo)
 	connector := handler.NewGoPubSubConnector()
 	storageHandler := handler.NewStorageHandler(uc, connector)
 	httpHandler := handler.NewHTTPHandler(uc)
-	server := httpHandler.StartServer(":8080")
+	server := httpHandler.StartServer(":" + clusterConfig.HTTPPort)
 
 	// Initialize cluster manager
 	clusterManager, err := cluster.NewManager(clusterConfig, []string{}, uc)
@@ -60,6 +105,7 @@ func main() {
 		log.Fatal("Failed to create cluster manager:", err)
 	}
 	uc.SetReplicator(clusterManager) // Set cluster manager as replicator
+	httpHandler.SetClusterNode(clusterManager)
 	if err := clusterManager.Start(); err != nil {
 		log.Fatal("Failed to start cluster:", err)
 	}
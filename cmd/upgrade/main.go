@@ -0,0 +1,42 @@
+// Command upgrade rewrites headerless segments in a data directory into the
+// current segment format. Stop the server before running it.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"gostorelog/internal/repository"
+)
+
+func main() {
+	dataDir := flag.String("data-dir", "./data", "Directory containing partition data")
+	flag.Parse()
+	if envDir := os.Getenv("DATA_DIR"); envDir != "" && !isFlagSet("data-dir") {
+		*dataDir = envDir
+	}
+
+	log.Printf("Upgrading segments in %s", *dataDir)
+	summary, err := repository.UpgradeDataDir(*dataDir)
+	if err != nil {
+		log.Fatalf("Upgrade failed after %d segments: %v", summary.Upgraded, err)
+	}
+	if len(summary.Skipped) > 0 {
+		log.Fatalf("Upgrade incomplete: %d segments rewritten, %d directories skipped: %s",
+			summary.Upgraded, len(summary.Skipped), strings.Join(summary.Skipped, ", "))
+	}
+	log.Printf("Upgrade complete: %d segments rewritten", summary.Upgraded)
+}
+
+// isFlagSet reports whether a flag was passed on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
@@ -69,6 +75,61 @@ func TestEndToEnd_PublishAndRead(t *testing.T) {
 	t.Logf("TestEndToEnd_PublishAndRead passed: published and read record successfully")
 }
 
+func TestEndToEnd_PublishWithKeyAndHeaders(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	headers := map[string][]byte{"trace-id": []byte("abc123")}
+	err := c.PublishWithKey("payload", int(entity.DataTypeString), "test-partition", "user-7", headers)
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	record, err := c.Read("test-partition", 0)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if record.Key != "user-7" {
+		t.Errorf("Expected key 'user-7', got %q", record.Key)
+	}
+	if string(record.Headers["trace-id"]) != "abc123" {
+		t.Errorf("Expected trace-id header 'abc123', got %q", record.Headers["trace-id"])
+	}
+	if record.Timestamp.IsZero() {
+		t.Errorf("Expected append timestamp to be set")
+	}
+	t.Logf("TestEndToEnd_PublishWithKeyAndHeaders passed: key, headers and timestamp returned")
+}
+
+func TestEndToEnd_PublishBatch(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	if err := c.Publish("before", int(entity.DataTypeString), "test-partition"); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	records := []client.BatchRecord{
+		{Data: map[string]int{"id": 1}, DataType: int(entity.DataTypeJSON)},
+		{Data: "two", DataType: int(entity.DataTypeString), Key: "k2"},
+		{Data: "three", DataType: int(entity.DataTypeString)},
+	}
+	firstOffset, lastOffset, err := c.PublishBatch("test-partition", records)
+	if err != nil {
+		t.Fatalf("PublishBatch failed: %v", err)
+	}
+	if firstOffset != 1 || lastOffset != 3 {
+		t.Errorf("Expected offsets 1-3, got %d-%d", firstOffset, lastOffset)
+	}
+	record, err := c.Read("test-partition", 2)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if data, _ := record.GetData(); data != "two" || record.Key != "k2" {
+		t.Errorf("Expected 'two' with key k2, got %v key %q", data, record.Key)
+	}
+	t.Logf("TestEndToEnd_PublishBatch passed: batch published with offsets %d-%d", firstOffset, lastOffset)
+}
+
 func TestEndToEnd_SequentialOffsets(t *testing.T) {
 	_, c, cleanup := setupServer(t, false)
 	defer cleanup()
@@ -94,6 +155,342 @@ func TestEndToEnd_SequentialOffsets(t *testing.T) {
 	t.Logf("TestEndToEnd_SequentialOffsets passed: offsets are sequential")
 }
 
+func TestEndToEnd_ReadRange(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	for i := 0; i < 10; i++ {
+		if err := c.Publish(map[string]int{"id": i}, int(entity.DataTypeJSON), "test-partition"); err != nil {
+			t.Fatalf("Publish %d failed: %v", i, err)
+		}
+	}
+
+	// Page through the partition four records at a time
+	offset := uint64(0)
+	seen := 0
+	for {
+		records, nextOffset, err := c.ReadRange("test-partition", offset, 4, 0)
+		if err != nil {
+			t.Fatalf("ReadRange failed: %v", err)
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			if record.Offset != uint64(seen) {
+				t.Errorf("Expected offset %d, got %d", seen, record.Offset)
+			}
+			seen++
+		}
+		offset = nextOffset
+	}
+	if seen != 10 {
+		t.Errorf("Expected 10 records, got %d", seen)
+	}
+	t.Logf("TestEndToEnd_ReadRange passed: paged through %d records", seen)
+}
+
+func TestEndToEnd_LongPollAndSubscribe(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	// Long-poll times out with no record
+	record, err := c.ReadWait("test-partition", 0, 50*time.Millisecond)
+	if err != nil || record != nil {
+		t.Fatalf("Expected empty long-poll, got %v, %v", record, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := c.Subscribe(ctx, "test-partition", 0)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Long-poll returns as soon as the record is published
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			c.Publish(fmt.Sprintf("event-%d", i), int(entity.DataTypeString), "test-partition")
+		}
+	}()
+	record, err = c.ReadWait("test-partition", 0, 5*time.Second)
+	if err != nil || record == nil {
+		t.Fatalf("Expected long-poll to return the record, got %v, %v", record, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case record := <-sub.Records():
+			if record.Offset != uint64(i) {
+				t.Errorf("Expected offset %d, got %d", i, record.Offset)
+			}
+			if data, _ := record.GetData(); data != fmt.Sprintf("event-%d", i) {
+				t.Errorf("Expected event-%d, got %v", i, data)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for record %d", i)
+		}
+	}
+	cancel()
+	t.Logf("TestEndToEnd_LongPollAndSubscribe passed: long-poll and subscription delivered records")
+}
+
+func TestEndToEnd_OffsetForTime(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	for i := 0; i < 6; i++ {
+		if i == 3 {
+			time.Sleep(20 * time.Millisecond) // Leave a gap in append times
+		}
+		if err := c.Publish(fmt.Sprintf("event-%d", i), int(entity.DataTypeString), "test-partition"); err != nil {
+			t.Fatalf("Publish %d failed: %v", i, err)
+		}
+	}
+	third, err := c.Read("test-partition", 3)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	cases := []struct {
+		at     time.Time
+		offset uint64
+	}{
+		{third.Timestamp.Add(-time.Hour), 0},
+		{third.Timestamp.Add(-10 * time.Millisecond), 3},
+		{third.Timestamp, 3},
+		{third.Timestamp.Add(time.Hour), 6},
+	}
+	for _, tc := range cases {
+		offset, err := c.OffsetForTime("test-partition", tc.at)
+		if err != nil {
+			t.Fatalf("OffsetForTime failed: %v", err)
+		}
+		if offset != tc.offset {
+			t.Errorf("OffsetForTime(%v) = %d, expected %d", tc.at, offset, tc.offset)
+		}
+	}
+	t.Logf("TestEndToEnd_OffsetForTime passed: offsets resolved by append time")
+}
+
+func TestEndToEnd_PartitionAdmin(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		if err := c.Publish(fmt.Sprintf("event-%d", i), int(entity.DataTypeString), "test-partition"); err != nil {
+			t.Fatalf("Publish %d failed: %v", i, err)
+		}
+	}
+	partitions, err := c.ListPartitions()
+	if err != nil {
+		t.Fatalf("ListPartitions failed: %v", err)
+	}
+	if len(partitions) != 1 || partitions[0].Key != "test-partition" || partitions[0].NextOffset != 5 || partitions[0].LatestOffset == nil || *partitions[0].LatestOffset != 4 {
+		t.Fatalf("Unexpected partitions: %+v", partitions)
+	}
+
+	if err := c.TruncatePartition("test-partition", 2); err != nil {
+		t.Fatalf("TruncatePartition failed: %v", err)
+	}
+	info, err := c.DescribePartition("test-partition")
+	if err != nil {
+		t.Fatalf("DescribePartition failed: %v", err)
+	}
+	if info.NextOffset != 3 || len(info.Segments) != 1 || info.Segments[0].NextOffset != 3 {
+		t.Errorf("Expected one segment ending at offset 3, got %+v", info)
+	}
+	if _, err := c.Read("test-partition", 3); err == nil {
+		t.Errorf("Expected offset 3 to be truncated")
+	}
+
+	if err := c.DeletePartition("test-partition"); err != nil {
+		t.Fatalf("DeletePartition failed: %v", err)
+	}
+	if partitions, err = c.ListPartitions(); err != nil || len(partitions) != 0 {
+		t.Errorf("Expected no partitions after delete, got %+v (%v)", partitions, err)
+	}
+	if err := c.DeletePartition("test-partition"); err == nil {
+		t.Errorf("Expected deleting a missing partition to fail")
+	}
+	t.Logf("TestEndToEnd_PartitionAdmin passed: partitions listed, described, truncated and deleted over HTTP")
+}
+
+func TestEndToEnd_PartitionKeys(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	key := "orders/eu?region=1&x"
+	if err := c.Publish("shipped", int(entity.DataTypeString), key); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	record, err := c.Read(key, 0)
+	if err != nil || string(record.Data) != "shipped" || record.PartitionKey != key {
+		t.Fatalf("Read returned %v (%v)", record, err)
+	}
+	if err := c.Publish("x", int(entity.DataTypeString), "bad\x00key"); err == nil {
+		t.Errorf("Expected an invalid partition key to be rejected")
+	}
+	t.Logf("TestEndToEnd_PartitionKeys passed: keys with reserved characters round-trip over HTTP")
+}
+
+func TestEndToEnd_BinaryData(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	payload := []byte{0x00, 0xff, 0x10, '"', '\\', 0x80, 0x7f}
+	if err := c.PublishRaw("blobs", int(entity.DataTypeBytes), "blob/1", payload); err != nil {
+		t.Fatalf("PublishRaw failed: %v", err)
+	}
+	// The JSON API takes bytes as base64, which is how []byte is marshaled
+	if err := c.PublishWithKey(payload, int(entity.DataTypeBytes), "blobs", "blob-2", nil); err != nil {
+		t.Fatalf("Publish of bytes over JSON failed: %v", err)
+	}
+	for offset, key := range []string{"blob/1", "blob-2"} {
+		raw, err := c.ReadRaw("blobs", uint64(offset))
+		if err != nil {
+			t.Fatalf("ReadRaw failed: %v", err)
+		}
+		if !bytes.Equal(raw.Data, payload) || raw.DataType != entity.DataTypeBytes || raw.Key != key || raw.Timestamp.IsZero() {
+			t.Errorf("ReadRaw %d returned %+v", offset, raw)
+		}
+		record, err := c.Read("blobs", uint64(offset))
+		if err != nil || !bytes.Equal(record.Data, payload) {
+			t.Errorf("Read %d returned %v (%v)", offset, record, err)
+		}
+	}
+
+	// Raw strings and JSON are stored with their type
+	if err := c.PublishRaw("blobs", int(entity.DataTypeString), "", []byte("plain text")); err != nil {
+		t.Fatalf("PublishRaw of a string failed: %v", err)
+	}
+	if err := c.PublishRaw("blobs", int(entity.DataTypeJSON), "", []byte(`{"id": 7}`)); err != nil {
+		t.Fatalf("PublishRaw of JSON failed: %v", err)
+	}
+	if err := c.PublishRaw("blobs", int(entity.DataTypeJSON), "", []byte("{broken")); err == nil {
+		t.Errorf("Expected invalid JSON to be rejected")
+	}
+	if text, err := c.ReadRaw("blobs", 2); err != nil || string(text.Data) != "plain text" || text.DataType != entity.DataTypeString {
+		t.Errorf("ReadRaw of a string returned %v (%v)", text, err)
+	}
+	if doc, err := c.ReadRaw("blobs", 3); err != nil || string(doc.Data) != `{"id":7}` || doc.DataType != entity.DataTypeJSON {
+		t.Errorf("ReadRaw of JSON returned %v (%v)", doc, err)
+	}
+	t.Logf("TestEndToEnd_BinaryData passed: bytes published and read raw and as base64 JSON")
+}
+
+func TestEndToEnd_ErrorStatuses(t *testing.T) {
+	server, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	if err := c.Publish("x", int(entity.DataTypeString), "orders"); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	cases := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/read?partition=missing&offset=0", http.StatusNotFound, "not_found"},
+		{"/read?partition=orders&offset=7", http.StatusNotFound, "not_found"},
+		{"/read?partition=orders&offset=abc", http.StatusBadRequest, "invalid_input"},
+		{"/read?partition=&offset=0", http.StatusBadRequest, "invalid_input"},
+		{"/admin/partitions/truncate", http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+	for _, tc := range cases {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || body.Code != tc.code || body.Error == "" {
+			t.Errorf("GET %s: got %d %+v, expected %d %s", tc.path, resp.StatusCode, body, tc.status, tc.code)
+		}
+	}
+
+	_, err := c.Read("missing", 0)
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || !errors.Is(err, entity.ErrNotFound) {
+		t.Errorf("Expected the client to return a not found APIError, got %v", err)
+	}
+	if err := c.Publish("x", int(entity.DataTypeString), "bad\x00key"); !errors.Is(err, entity.ErrInvalidInput) {
+		t.Errorf("Expected the client to return invalid input, got %v", err)
+	}
+	if err := c.TruncatePartition("missing", 0); !errors.Is(err, entity.ErrNotFound) {
+		t.Errorf("Expected truncating a missing partition to be not found, got %v", err)
+	}
+	t.Logf("TestEndToEnd_ErrorStatuses passed: errors map to HTTP statuses and back to client errors")
+}
+
+// leaderNode is a ClusterNode that is always the leader, with one follower
+// behind on orders
+type leaderNode struct{}
+
+func (leaderNode) NodeID() string { return "node-a" }
+func (leaderNode) IsLeader() bool { return true }
+func (leaderNode) Gaps(node string, partition string) []entity.Gap {
+	gap := entity.Gap{Node: "node-b", Partition: "orders", LeaderOffset: 5, FollowerOffset: 2, Lag: 3}
+	if (node != "" && node != gap.Node) || (partition != "" && partition != gap.Partition) {
+		return []entity.Gap{}
+	}
+	return []entity.Gap{gap}
+}
+
+func TestEndToEnd_Status(t *testing.T) {
+	_, c, cleanup := setupServer(t, false)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		if err := c.Publish(fmt.Sprintf("record %d", i), int(entity.DataTypeString), "orders"); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	status, err := c.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.Role != entity.NodeRoleStandalone || len(status.Partitions) != 1 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	orders := status.Partitions[0]
+	if orders.Key != "orders" || orders.EarliestOffset != 0 || orders.NextOffset != 3 || orders.SegmentCount == 0 || orders.Size == 0 {
+		t.Errorf("Unexpected partition status %+v", orders)
+	}
+
+	dir, err := ioutil.TempDir("", "e2e_status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	defer repo.Close()
+	httpHandler := handler.NewHTTPHandler(usecase.NewStorageUsecase(repo))
+	httpHandler.SetClusterNode(leaderNode{})
+	server := httptest.NewServer(httpHandler.GetMux())
+	defer server.Close()
+	status, err = client.NewClient(server.URL).Status()
+	if err != nil || status.NodeID != "node-a" || status.Role != entity.NodeRoleLeader || len(status.Partitions) != 0 {
+		t.Errorf("Expected an empty leader status, got %+v (%v)", status, err)
+	}
+	gaps, err := client.NewClient(server.URL).Gaps("node-b", "orders")
+	if err != nil || len(gaps) != 1 || gaps[0].Lag != 3 {
+		t.Errorf("Expected the orders gap of node-b, got %+v (%v)", gaps, err)
+	}
+	if gaps, err := client.NewClient(server.URL).Gaps("", "payments"); err != nil || len(gaps) != 0 {
+		t.Errorf("Expected no payments gaps, got %+v (%v)", gaps, err)
+	}
+	if gaps, err := c.Gaps("", ""); err != nil || len(gaps) != 0 {
+		t.Errorf("Expected no gaps without a cluster, got %+v (%v)", gaps, err)
+	}
+	t.Logf("TestEndToEnd_Status passed: status and gaps report role, partition offsets and lag")
+}
+
 func TestEndToEnd_RestartAndRecovery(t *testing.T) {
 	dir, err := ioutil.TempDir("", "e2e_restart_test")
 	if err != nil {
@@ -0,0 +1,212 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"gostorelog/internal/entity"
+)
+
+// Limits of one batch of records sent to a follower catching up
+const (
+	catchUpBatchCount = 100
+	catchUpBatchBytes = 1024 * 1024
+)
+
+// nodeClient makes the leader's requests to followers
+var nodeClient = &http.Client{Timeout: 10 * time.Second}
+
+// remoteError is an error answered by another node. It matches the entity
+// sentinel its code names.
+type remoteError struct {
+	message  string
+	sentinel error
+}
+
+func (e *remoteError) Error() string {
+	return e.message
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.sentinel
+}
+
+// responseError reads the error response in resp
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	var decoded struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil || decoded.Error == "" {
+		return errors.New(strings.TrimSpace(string(body)))
+	}
+	return &remoteError{message: decoded.Error, sentinel: entity.ErrorForCode(decoded.Code)}
+}
+
+// sendRecords sends records of a partition to a follower, which stores them
+// at their offsets, and returns the follower's next offset. The leader holds
+// no other records from offset since on. With reset, the follower may drop
+// every record it holds to store the batch, see
+// FileStorageRepository.AppendReplicated.
+func (m *Manager) sendRecords(node *memberlist.Node, partitionKey string, records []*entity.Record, since uint64, reset bool) (uint64, error) {
+	var result struct {
+		NextOffset uint64 `json:"next_offset"`
+	}
+	err := m.postToNode(node, "/replicate/batch", map[string]interface{}{
+		"partition_key": partitionKey,
+		"records":       records,
+		"since":         since,
+		"reset":         reset,
+	}, &result)
+	if err != nil {
+		return 0, fmt.Errorf("replication failed: %w", err)
+	}
+	return result.NextOffset, nil
+}
+
+// postToNode posts payload as JSON to a path of a node's HTTP API and
+// decodes the response into result
+func (m *Manager) postToNode(node *memberlist.Node, path string, payload interface{}, result interface{}) error {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := nodeClient.Post(m.nodeURL(node, path), "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// trimFollower removes the records a follower holds past the leader's next
+// offset of a partition, which the leader dropped, e.g. by truncating the
+// partition, and then checks the records before
+func (m *Manager) trimFollower(node *memberlist.Node, partitionKey string, followerOffset uint64) {
+	// The leader may have appended since the follower's offset was read
+	info, err := m.usecase.DescribePartition(partitionKey)
+	if err != nil || info.Error != "" || info.NextOffset >= followerOffset {
+		return
+	}
+	log.Printf("%s holds offsets %d-%d of partition %s that the leader does not, removing them", node.Name, info.NextOffset, followerOffset-1, partitionKey)
+	if info.NextOffset == 0 {
+		err = m.postToNode(node, "/admin/partitions/delete", map[string]interface{}{"partition_key": partitionKey}, nil)
+	} else {
+		err = m.postToNode(node, "/admin/partitions/truncate", map[string]interface{}{"partition_key": partitionKey, "after_offset": info.NextOffset - 1}, nil)
+	}
+	if err != nil {
+		log.Printf("Failed to trim partition %s on %s: %v", partitionKey, node.Name, err)
+		return
+	}
+	m.startCatchUp(node, partitionKey, info.NextOffset)
+}
+
+// followerJoined checks a follower as soon as it joins, so one that
+// restarted catches up without waiting for the next gap check
+func (m *Manager) followerJoined(node *memberlist.Node) {
+	if !m.isLeader.Load() || node.Name == m.config.NodeID {
+		return
+	}
+	if err := m.checkFollower(node, nil); err != nil {
+		log.Printf("Failed to check gaps with joining node %s: %v", node.Name, err)
+	}
+}
+
+// startCatchUp starts sending a follower the records of a partition from
+// offset on, unless that is already running
+func (m *Manager) startCatchUp(node *memberlist.Node, partitionKey string, offset uint64) {
+	id := node.Name + "/" + partitionKey
+	m.catchUpMu.Lock()
+	defer m.catchUpMu.Unlock()
+	if m.catchUps[id] {
+		return
+	}
+	if m.catchUps == nil {
+		m.catchUps = make(map[string]bool)
+	}
+	m.catchUps[id] = true
+	go func() {
+		m.catchUp(node, partitionKey, offset)
+		m.catchUpMu.Lock()
+		delete(m.catchUps, id)
+		m.catchUpMu.Unlock()
+	}()
+}
+
+// catchUp sends a follower the records of a partition in order, from its
+// next offset until it holds every record the leader has. Each batch
+// overlaps a record the follower holds, so the follower checks that its
+// records match the leader's and replaces them from the first that differs.
+// When the first record of a batch differs, the next starts twice as far
+// back. Offsets compaction removed are skipped, and the follower stores the
+// surviving records around them. When retention removed offsets the follower
+// lacks, the follower starts the partition over at the leader's earliest
+// offset. It stops at the first failure; the next gap check resumes from the
+// follower's next offset then.
+func (m *Manager) catchUp(node *memberlist.Node, partitionKey string, offset uint64) {
+	log.Printf("Catching up %s on partition %s from offset %d", node.Name, partitionKey, offset)
+	from := offset - min(1, offset)
+	back := uint64(1)
+	earliest := uint64(0) // at most the leader's earliest offset
+	for m.isLeader.Load() {
+		from = max(from, earliest)
+		records, err := m.usecase.RetrieveRange(partitionKey, from, catchUpBatchCount, catchUpBatchBytes)
+		if errors.Is(err, entity.ErrOutOfRange) {
+			// Retention removed the offsets the batch starts at
+			if info, infoErr := m.usecase.DescribePartition(partitionKey); infoErr == nil && info.EarliestOffset > from {
+				earliest, from = info.EarliestOffset, info.EarliestOffset
+				records, err = m.usecase.RetrieveRange(partitionKey, from, catchUpBatchCount, catchUpBatchBytes)
+			}
+		}
+		if err != nil {
+			log.Printf("Catch-up of %s on partition %s stopped at offset %d: %v", node.Name, partitionKey, offset, err)
+			return
+		}
+		if len(records) == 0 {
+			log.Printf("Caught up %s on partition %s at offset %d", node.Name, partitionKey, offset)
+			return
+		}
+		// The leader holds nothing from before its earliest offset, which
+		// the follower lacks; offsets the batch skips after from were
+		// compacted away and the follower keeps the records around them
+		reset := offset < earliest
+		if reset {
+			log.Printf("Leader no longer holds offsets %d-%d of partition %s, %s starts over at offset %d", offset, earliest-1, partitionKey, node.Name, records[0].Offset)
+		}
+		next, err := m.sendRecords(node, partitionKey, records, from, reset)
+		if errors.Is(err, entity.ErrConflict) {
+			back *= 2
+			from = records[0].Offset - min(back, records[0].Offset)
+			log.Printf("%s holds a different record %d of partition %s, checking from offset %d", node.Name, records[0].Offset, partitionKey, from)
+			continue
+		}
+		if err != nil {
+			log.Printf("Catch-up of %s on partition %s stopped at offset %d: %v", node.Name, partitionKey, offset, err)
+			return
+		}
+		if next != offset {
+			offset, back = next, 1
+		}
+		// Records the follower holds past the batch are checked next
+		last := records[len(records)-1].Offset
+		from = last
+		if last+1 >= offset || last == records[0].Offset {
+			from = last + 1
+		}
+	}
+}
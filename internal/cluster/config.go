@@ -10,6 +10,7 @@ type Config struct {
 	RedisAddr      string        `json:"redis_addr"`
 	ServiceName    string        `json:"service_name"`
 	ClusterPort    string        `json:"cluster_port"`
+	HTTPPort       string        `json:"http_port"` // Port every node serves its HTTP API on
 	DataDir        string        `json:"data_dir"`
 	WatchInterval  time.Duration `json:"watch_interval"`
 	LeaderKey      string        `json:"leader_key"`
@@ -25,6 +26,7 @@ func DefaultConfig() *Config {
 		RedisAddr:      "localhost:6379",
 		ServiceName:    "gostorelog-cluster",
 		ClusterPort:    "7946",
+		HTTPPort:       "8080",
 		DataDir:        "./data",
 		WatchInterval:  30 * time.Second,
 		LeaderKey:      "gostorelog:leader",
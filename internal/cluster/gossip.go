@@ -49,6 +49,11 @@ func (g *Gossip) Join(knownNodes []string) error {
 	return err
 }
 
+// OnJoin sets a function called with every node that joins
+func (g *Gossip) OnJoin(fn func(node *memberlist.Node)) {
+	g.events.onJoin = fn
+}
+
 // Members returns the list of known members
 func (g *Gossip) Members() []*memberlist.Node {
 	return g.list.Members()
@@ -63,11 +68,15 @@ func (g *Gossip) Shutdown() error {
 // eventDelegate handles memberlist events
 type eventDelegate struct {
 	gossip *Gossip
+	onJoin func(node *memberlist.Node)
 }
 
 func (e *eventDelegate) NotifyJoin(node *memberlist.Node) {
 	log.Printf("Node joined: %s", node.Name)
 	e.gossip.nodes[node.Name] = node
+	if e.onJoin != nil {
+		e.onJoin(node)
+	}
 }
 
 func (e *eventDelegate) NotifyLeave(node *memberlist.Node) {
@@ -1,12 +1,15 @@
 package cluster
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -21,7 +24,11 @@ type Manager struct {
 	gossip         *Gossip
 	dnsResolver    *DNSResolver
 	usecase        usecase.StorageUsecase
-	isLeader       bool
+	isLeader       atomic.Bool // read by the gap checker and catch-ups
+	gapsMu         sync.RWMutex
+	gaps           map[string]map[string]entity.Gap // Latest lag by follower and partition
+	catchUpMu      sync.Mutex
+	catchUps       map[string]bool // Catch-ups running, by follower and partition
 }
 
 // NewManager creates a new cluster manager
@@ -37,13 +44,17 @@ func NewManager(config *Config, peers []string, uc usecase.StorageUsecase) (*Man
 	dns := NewDNSResolver(config)
 
 	log.Printf("Creating cluster manager for node %s", config.NodeID)
-	return &Manager{
+	m := &Manager{
 		config:         config,
 		leaderElection: le,
 		gossip:         gossip,
 		dnsResolver:    dns,
 		usecase:        uc,
-	}, nil
+	}
+	gossip.OnJoin(func(node *memberlist.Node) {
+		go m.followerJoined(node)
+	})
+	return m, nil
 }
 
 // Start starts the cluster manager
@@ -51,17 +62,8 @@ func (m *Manager) Start() error {
 	log.Printf("Starting cluster manager for node %s", m.config.NodeID)
 	// Try to become leader
 	if m.leaderElection.TryBecomeLeader() {
-		m.isLeader = true
 		log.Printf("Node %s started as leader", m.config.NodeID)
-		// As leader, start DNS watching to discover nodes
-		go m.dnsResolver.WatchNodes(m.config.WatchInterval, func(nodes []string) {
-			log.Printf("Leader %s discovered nodes via DNS: %v", m.config.NodeID, nodes)
-			// Join the gossip cluster
-			err := m.gossip.Join(nodes)
-			if err != nil {
-				log.Printf("Leader %s failed to join gossip: %v", m.config.NodeID, err)
-			}
-		})
+		m.becomeLeader()
 	} else {
 		log.Printf("Node %s started as follower", m.config.NodeID)
 		// As follower, periodically try to become leader
@@ -78,17 +80,31 @@ func (m *Manager) Start() error {
 			}
 		}
 	}
-
-	// Start periodic gap checking if leader
-	if m.isLeader {
-		go m.startGapChecking()
-	}
 	return nil
 }
 
+// becomeLeader starts the leader's work: watching DNS for nodes to join and
+// checking followers for gaps
+func (m *Manager) becomeLeader() {
+	m.isLeader.Store(true)
+	go m.dnsResolver.WatchNodes(m.config.WatchInterval, func(nodes []string) {
+		log.Printf("Leader %s discovered nodes via DNS: %v", m.config.NodeID, nodes)
+		// Join the gossip cluster
+		if err := m.gossip.Join(nodes); err != nil {
+			log.Printf("Leader %s failed to join gossip: %v", m.config.NodeID, err)
+		}
+	})
+	go m.startGapChecking()
+}
+
+// NodeID returns this node's ID
+func (m *Manager) NodeID() string {
+	return m.config.NodeID
+}
+
 // IsLeader returns if this node is the leader
 func (m *Manager) IsLeader() bool {
-	return m.isLeader
+	return m.isLeader.Load()
 }
 
 // Members returns the list of cluster members
@@ -103,13 +119,8 @@ func (m *Manager) tryBecomeLeaderPeriodically() {
 	log.Printf("Follower %s starting periodic leader election attempts", m.config.NodeID)
 	for range ticker.C {
 		if m.leaderElection.TryBecomeLeader() {
-			m.isLeader = true
 			log.Printf("Follower %s promoted to leader", m.config.NodeID)
-			// Start DNS watching
-			go m.dnsResolver.WatchNodes(m.config.WatchInterval, func(nodes []string) {
-				log.Printf("New leader %s discovered nodes: %v", m.config.NodeID, nodes)
-				m.gossip.Join(nodes)
-			})
+			m.becomeLeader()
 			return
 		}
 	}
@@ -121,16 +132,16 @@ func (m *Manager) startGapChecking() {
 	defer ticker.Stop()
 	log.Printf("Leader %s starting gap checking", m.config.NodeID)
 	for range ticker.C {
-		if !m.isLeader {
+		if !m.isLeader.Load() {
 			return
 		}
 		m.checkFollowerGaps()
 	}
 }
 
-// Replicate sends the data to all followers
-func (m *Manager) Replicate(data interface{}, dataType entity.DataType, partitionKey string) error {
-	if !m.isLeader {
+// Replicate sends the record to all followers
+func (m *Manager) Replicate(record *entity.Record) error {
+	if !m.isLeader.Load() {
 		return nil // Only leader replicates
 	}
 
@@ -139,8 +150,10 @@ func (m *Manager) Replicate(data interface{}, dataType entity.DataType, partitio
 
 	for _, node := range followers {
 		go func(n *memberlist.Node) {
-			err := m.sendDataToFollower(n, data, dataType, partitionKey)
-			if err != nil {
+			err := m.sendDataToFollower(n, record)
+			if errors.Is(err, entity.ErrOutOfRange) {
+				log.Printf("Follower %s is behind on partition %s, leaving offset %d to catch-up", n.Name, record.PartitionKey, record.Offset)
+			} else if err != nil {
 				log.Printf("Failed to replicate to %s: %v", n.Name, err)
 			}
 		}(node)
@@ -159,105 +172,179 @@ func (m *Manager) getFollowers() []*memberlist.Node {
 	return followers
 }
 
-// sendDataToFollower sends data to a follower via HTTP
-func (m *Manager) sendDataToFollower(node *memberlist.Node, data interface{}, dataType entity.DataType, partitionKey string) error {
-	url := fmt.Sprintf("http://%s/replicate", node.Addr.String())
-	payload := map[string]interface{}{
-		"data":          data,
-		"data_type":     dataType,
-		"partition_key": partitionKey,
-	}
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
+// nodeURL returns the URL of a path on a node's HTTP API
+func (m *Manager) nodeURL(node *memberlist.Node, path string) string {
+	return "http://" + net.JoinHostPort(node.Addr.String(), m.config.HTTPPort) + path
+}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
+// sendDataToFollower sends a record to a follower via HTTP, to be stored
+// at the same offset
+func (m *Manager) sendDataToFollower(node *memberlist.Node, record *entity.Record) error {
+	if _, err := m.sendRecords(node, record.PartitionKey, []*entity.Record{record}, record.Offset, false); err != nil {
+		if errors.Is(err, entity.ErrConflict) {
+			// The follower diverged, e.g. after the partition was truncated
+			m.startCatchUp(node, record.PartitionKey, record.Offset)
+		}
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("replication failed: %s", string(body))
-	}
-
 	log.Printf("Successfully replicated data to %s", node.Name)
 	return nil
 }
 
-// checkFollowerGaps checks gaps with followers and stores them
+// gapsPartition holds the history of detected gaps. It is written by the
+// gap checker itself, so its own lag is not tracked.
+const gapsPartition = "gaps"
+
+// checkFollowerGaps compares every follower's partition offsets with the
+// leader's, updating the lag table and recording changes in the gaps partition
 func (m *Manager) checkFollowerGaps() {
-	if !m.isLeader {
+	if !m.isLeader.Load() {
+		return
+	}
+	leader, err := m.usecase.ListPartitions()
+	if err != nil {
+		log.Printf("Leader %s failed to list partitions for gap checking: %v", m.config.NodeID, err)
 		return
 	}
 
 	followers := m.getFollowers()
 	log.Printf("Leader %s checking gaps with %d followers", m.config.NodeID, len(followers))
 
+	present := make(map[string]bool, len(followers))
 	for _, node := range followers {
-		gap, err := m.getGapWithFollower(node)
-		if err != nil {
-			log.Printf("Failed to get gap with %s: %v", node.Name, err)
-			continue
+		present[node.Name] = true
+		if err := m.checkFollower(node, leader); err != nil {
+			log.Printf("Failed to check gaps with %s: %v", node.Name, err)
 		}
-		if gap > 0 {
-			m.storeGap(node.Name, gap)
-			log.Printf("Stored gap of %d for node %s", gap, node.Name)
+	}
+	m.gapsMu.Lock()
+	for name := range m.gaps {
+		if !present[name] {
+			delete(m.gaps, name)
 		}
 	}
+	m.gapsMu.Unlock()
 }
 
-// getGapWithFollower gets the gap with a follower
-func (m *Manager) getGapWithFollower(node *memberlist.Node) (int, error) {
-	url := fmt.Sprintf("http://%s/status", node.Addr.String())
-	resp, err := http.Get(url)
+// checkFollower updates a follower's row of the lag table and starts
+// catching it up on every partition it is behind on. Without leader
+// partitions it lists them itself.
+func (m *Manager) checkFollower(node *memberlist.Node, leader []entity.PartitionInfo) error {
+	if leader == nil {
+		var err error
+		if leader, err = m.usecase.ListPartitions(); err != nil {
+			return err
+		}
+	}
+	status, err := m.followerStatus(m.nodeURL(node, "/status"))
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer resp.Body.Close()
+	m.recordGaps(node.Name, leader, status, time.Now())
+	for _, gap := range m.Gaps(node.Name, "") {
+		switch {
+		case gap.Lag > 0:
+			m.startCatchUp(node, gap.Partition, gap.FollowerOffset)
+		case gap.FollowerOffset > gap.LeaderOffset:
+			m.trimFollower(node, gap.Partition, gap.FollowerOffset)
+		}
+	}
+	return nil
+}
 
-	var status map[string]interface{}
+// followerStatus fetches a node's status
+func (m *Manager) followerStatus(url string) (*entity.NodeStatus, error) {
+	resp, err := nodeClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status failed: %w", responseError(resp))
+	}
+	var status entity.NodeStatus
 	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	// For now, assume leader has offset 10, follower has less
-	leaderOffset := 10 // placeholder
-	followerOffset := 5 // placeholder from status
-	gap := leaderOffset - followerOffset
-	return gap, nil
+	return &status, nil
 }
 
-// storeGap stores the gap information
-func (m *Manager) storeGap(nodeName string, gap int) {
-	gapData := map[string]interface{}{
-		"node": nodeName,
-		"gap":  gap,
-		"time": time.Now().Unix(),
+// recordGaps replaces a follower's row of the lag table. Each change of a
+// lag, including back to zero, is stored in the gaps partition keyed by node
+// and partition.
+func (m *Manager) recordGaps(nodeName string, leader []entity.PartitionInfo, status *entity.NodeStatus, now time.Time) {
+	followerOffsets := make(map[string]uint64, len(status.Partitions))
+	for _, partition := range status.Partitions {
+		followerOffsets[partition.Key] = partition.NextOffset
 	}
-	// Store as a record
-	if m.usecase != nil {
-		err := m.usecase.StoreRecord(gapData, entity.DataTypeJSON, "gaps")
-		if err != nil {
-			log.Printf("Failed to store gap: %v", err)
+	row := make(map[string]entity.Gap, len(leader))
+	for _, partition := range leader {
+		if partition.Key == gapsPartition || partition.Error != "" {
+			continue
+		}
+		gap := entity.Gap{
+			Node:           nodeName,
+			Partition:      partition.Key,
+			LeaderOffset:   partition.NextOffset,
+			FollowerOffset: followerOffsets[partition.Key],
+			CheckedAt:      now,
+		}
+		if gap.LeaderOffset > gap.FollowerOffset {
+			gap.Lag = gap.LeaderOffset - gap.FollowerOffset
+		}
+		row[partition.Key] = gap
+	}
+
+	m.gapsMu.Lock()
+	if m.gaps == nil {
+		m.gaps = make(map[string]map[string]entity.Gap)
+	}
+	previous := m.gaps[nodeName]
+	m.gaps[nodeName] = row
+	m.gapsMu.Unlock()
+
+	for key, gap := range row {
+		if gap.Lag == previous[key].Lag {
+			continue
+		}
+		if err := m.usecase.StoreRecordWithKey(gap, entity.DataTypeJSON, gapsPartition, nodeName+"/"+key, nil); err != nil {
+			log.Printf("Failed to store gap of %s on partition %s: %v", nodeName, key, err)
+		}
+		if gap.Lag > 0 {
+			log.Printf("Follower %s is %d record(s) behind on partition %s", nodeName, gap.Lag, key)
 		}
 	}
 }
 
-// GetGaps returns the stored gaps
-func (m *Manager) GetGaps() ([]map[string]interface{}, error) {
-	// For simplicity, return a placeholder; in real impl, query the storage
-	return []map[string]interface{}{
-		{"node": "follower1", "gap": 5},
-	}, nil
+// Gaps returns the lag table from the latest check, sorted by node and
+// partition. Empty filters match every node or partition.
+func (m *Manager) Gaps(node string, partition string) []entity.Gap {
+	m.gapsMu.RLock()
+	defer m.gapsMu.RUnlock()
+	gaps := []entity.Gap{}
+	for name, row := range m.gaps {
+		if node != "" && name != node {
+			continue
+		}
+		for key, gap := range row {
+			if partition == "" || key == partition {
+				gaps = append(gaps, gap)
+			}
+		}
+	}
+	sort.Slice(gaps, func(i, j int) bool {
+		if gaps[i].Node != gaps[j].Node {
+			return gaps[i].Node < gaps[j].Node
+		}
+		return gaps[i].Partition < gaps[j].Partition
+	})
+	return gaps
 }
 
 // Shutdown shuts down the cluster manager
 func (m *Manager) Shutdown() {
 	log.Printf("Shutting down cluster manager for node %s", m.config.NodeID)
-	if m.isLeader {
+	if m.isLeader.Load() {
 		m.leaderElection.Resign()
 	}
 	m.gossip.Shutdown()
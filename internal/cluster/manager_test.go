@@ -1,10 +1,19 @@
 package cluster
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"gostorelog/internal/entity"
+	"gostorelog/internal/handler"
 	"gostorelog/internal/repository"
 	"gostorelog/internal/usecase"
 )
@@ -70,4 +79,438 @@ func TestManager_IsLeader(t *testing.T) {
 	isLeader := manager.IsLeader()
 	t.Logf("Output: IsLeader returned %v", isLeader)
 	t.Logf("Result: Node is %s", map[bool]string{true: "leader", false: "follower"}[isLeader])
-}
\ No newline at end of file
+}
+
+func TestManager_RecordGaps(t *testing.T) {
+	dir := t.TempDir()
+	repo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	defer repo.Close()
+	uc := usecase.NewStorageUsecase(repo)
+	manager := &Manager{config: DefaultConfig(), usecase: uc}
+
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(entity.NodeStatus{NodeID: "node-b", Role: entity.NodeRoleFollower, Partitions: []entity.PartitionInfo{
+			{Key: "orders", NextOffset: 7},
+			{Key: "payments", NextOffset: 3},
+		}})
+	}))
+	defer follower.Close()
+	status, err := manager.followerStatus(follower.URL + "/status")
+	if err != nil {
+		t.Fatalf("followerStatus failed: %v", err)
+	}
+
+	leader := []entity.PartitionInfo{
+		{Key: "orders", NextOffset: 10},
+		{Key: "payments", NextOffset: 3},
+		{Key: "audit", NextOffset: 2},
+		{Key: gapsPartition, NextOffset: 50},
+	}
+	manager.recordGaps("node-b", leader, status, time.Now())
+	gaps := manager.Gaps("", "")
+	if len(gaps) != 3 {
+		t.Fatalf("Expected 3 partitions in the lag table, got %+v", gaps)
+	}
+	expected := map[string]uint64{"audit": 2, "orders": 3, "payments": 0}
+	for _, gap := range gaps {
+		if gap.Node != "node-b" || gap.Lag != expected[gap.Partition] {
+			t.Errorf("Unexpected gap %+v", gap)
+		}
+	}
+	if gaps := manager.Gaps("node-b", "orders"); len(gaps) != 1 || gaps[0].FollowerOffset != 7 {
+		t.Errorf("Expected the filtered orders gap, got %+v", gaps)
+	}
+	if gaps := manager.Gaps("node-c", ""); len(gaps) != 0 {
+		t.Errorf("Expected no gaps for an unknown node, got %+v", gaps)
+	}
+
+	// Only lags that changed are added to the history
+	records, err := uc.RetrieveRange(gapsPartition, 0, 100, 0)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 gap records, got %d (%v)", len(records), err)
+	}
+	status.Partitions[0].NextOffset = 10
+	manager.recordGaps("node-b", leader, status, time.Now())
+	manager.recordGaps("node-b", leader, status, time.Now())
+	records, _ = uc.RetrieveRange(gapsPartition, 0, 100, 0)
+	if len(records) != 3 || records[2].Key != "node-b/orders" {
+		t.Fatalf("Expected the orders catch-up to be recorded once, got %d records", len(records))
+	}
+	if gaps := manager.Gaps("", "orders"); gaps[0].Lag != 0 {
+		t.Errorf("Expected orders to have caught up, got %+v", gaps[0])
+	}
+	t.Logf("TestManager_RecordGaps passed: per-partition lag computed from follower status")
+}
+
+func TestManager_CatchUp(t *testing.T) {
+	dir := t.TempDir()
+	leaderRepo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir + "/leader", MaxFileSize: 4096})
+	defer leaderRepo.Close()
+	followerRepo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir + "/follower", MaxFileSize: 4096})
+	defer followerRepo.Close()
+	leaderUC := usecase.NewStorageUsecase(leaderRepo)
+	followerUC := usecase.NewStorageUsecase(followerRepo)
+
+	for i := 0; i < 250; i++ {
+		if err := leaderUC.StoreRecordWithKey(fmt.Sprintf("record %d", i), entity.DataTypeString, "orders", fmt.Sprintf("k%d", i), nil); err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+	}
+	// The follower got the first 40 records before falling behind
+	records, _ := leaderUC.RetrieveRange("orders", 0, 40, 0)
+	if _, err := followerUC.ReplicateRecords("orders", records, 0, false); err != nil {
+		t.Fatalf("ReplicateRecords failed: %v", err)
+	}
+
+	// The follower drops the connection on its second batch
+	batches := 0
+	var batchesMu sync.Mutex
+	mux := handler.NewHTTPHandler(followerUC).GetMux()
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/replicate/batch" {
+			batchesMu.Lock()
+			batches++
+			failed := batches == 2
+			batchesMu.Unlock()
+			if failed {
+				http.Error(w, "connection reset", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer follower.Close()
+	followerURL, _ := url.Parse(follower.URL)
+	config := DefaultConfig()
+	config.HTTPPort = followerURL.Port()
+	manager := &Manager{config: config, usecase: leaderUC}
+	manager.isLeader.Store(true)
+	node := &memberlist.Node{Name: "node-b", Addr: net.ParseIP("127.0.0.1")}
+
+	waitForCatchUp := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			manager.catchUpMu.Lock()
+			running := len(manager.catchUps)
+			manager.catchUpMu.Unlock()
+			if running == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Catch-up did not finish")
+	}
+	nextOffset := func() uint64 {
+		info, err := followerUC.DescribePartition("orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.NextOffset
+	}
+
+	if err := manager.checkFollower(node, nil); err != nil {
+		t.Fatalf("checkFollower failed: %v", err)
+	}
+	waitForCatchUp()
+	// The first batch starts at the follower's last record, to check it
+	if next := nextOffset(); next != 139 {
+		t.Fatalf("Expected the interrupted catch-up to stop at offset 139, got %d", next)
+	}
+	if gaps := manager.Gaps("node-b", "orders"); len(gaps) != 1 || gaps[0].Lag != 210 {
+		t.Errorf("Expected a lag of 210 before catching up, got %+v", gaps)
+	}
+
+	// The next check resumes where the follower stopped
+	if err := manager.checkFollower(node, nil); err != nil {
+		t.Fatalf("checkFollower failed: %v", err)
+	}
+	waitForCatchUp()
+	if next := nextOffset(); next != 250 {
+		t.Fatalf("Expected the follower to catch up to offset 250, got %d", next)
+	}
+	for _, offset := range []uint64{0, 39, 40, 138, 139, 249} {
+		leaderRecord, _ := leaderUC.RetrieveRecord("orders", offset)
+		followerRecord, err := followerUC.RetrieveRecord("orders", offset)
+		if err != nil || string(followerRecord.Data) != string(leaderRecord.Data) || followerRecord.Key != leaderRecord.Key || !followerRecord.Timestamp.Equal(leaderRecord.Timestamp) {
+			t.Errorf("Offset %d differs: leader %+v, follower %+v (%v)", offset, leaderRecord, followerRecord, err)
+		}
+	}
+	if err := manager.checkFollower(node, nil); err != nil {
+		t.Fatalf("checkFollower failed: %v", err)
+	}
+	if gaps := manager.Gaps("node-b", "orders"); len(gaps) != 1 || gaps[0].Lag != 0 {
+		t.Errorf("Expected no lag after catching up, got %+v", gaps)
+	}
+	t.Logf("TestManager_CatchUp passed: follower caught up across an interruption")
+}
+
+func TestManager_CatchUpAfterRetention(t *testing.T) {
+	dir := t.TempDir()
+	leaderRepo := repository.NewFileStorageRepository(&entity.Config{
+		DataDir:                dir + "/leader",
+		MaxFileSize:            1024,
+		PartitionRetention:     map[string]entity.RetentionPolicy{"events": {MaxBytes: 2048}},
+		RetentionCheckInterval: 10 * time.Millisecond,
+	})
+	defer leaderRepo.Close()
+	followerRepo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir + "/follower", MaxFileSize: 1024})
+	defer followerRepo.Close()
+	leaderUC := usecase.NewStorageUsecase(leaderRepo)
+	followerUC := usecase.NewStorageUsecase(followerRepo)
+
+	store := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := leaderUC.StoreRecord(fmt.Sprintf("event %d", i), entity.DataTypeString, "events"); err != nil {
+				t.Fatalf("Store failed: %v", err)
+			}
+		}
+	}
+	// The follower got the first 10 records, then retention removed the
+	// records it is missing from the leader
+	store(0, 10)
+	records, _ := leaderUC.RetrieveRange("events", 0, 10, 0)
+	if _, err := followerUC.ReplicateRecords("events", records, 0, false); err != nil {
+		t.Fatalf("ReplicateRecords failed: %v", err)
+	}
+	store(10, 100)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, _ := leaderUC.DescribePartition("events")
+		if info != nil && info.EarliestOffset > 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Retention did not remove the old records: %+v", info)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	follower := httptest.NewServer(handler.NewHTTPHandler(followerUC).GetMux())
+	defer follower.Close()
+	followerURL, _ := url.Parse(follower.URL)
+	config := DefaultConfig()
+	config.HTTPPort = followerURL.Port()
+	manager := &Manager{config: config, usecase: leaderUC}
+	manager.isLeader.Store(true)
+	node := &memberlist.Node{Name: "node-b", Addr: net.ParseIP("127.0.0.1")}
+
+	if err := manager.checkFollower(node, nil); err != nil {
+		t.Fatalf("checkFollower failed: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		manager.catchUpMu.Lock()
+		running := len(manager.catchUps)
+		manager.catchUpMu.Unlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Catch-up did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	leaderInfo, _ := leaderUC.DescribePartition("events")
+	followerInfo, err := followerUC.DescribePartition("events")
+	if err != nil || followerInfo.NextOffset != 100 || followerInfo.EarliestOffset > leaderInfo.EarliestOffset {
+		t.Fatalf("Expected the follower to hold the leader's offsets %d-99, got %+v (%v)", leaderInfo.EarliestOffset, followerInfo, err)
+	}
+	if err := manager.checkFollower(node, nil); err != nil {
+		t.Fatalf("checkFollower failed: %v", err)
+	}
+	if gaps := manager.Gaps("node-b", "events"); len(gaps) != 1 || gaps[0].Lag != 0 {
+		t.Errorf("Expected no lag after catching up, got %+v", gaps)
+	}
+	t.Logf("TestManager_CatchUpAfterRetention passed: follower started over at the leader's earliest offset")
+}
+
+func TestManager_CatchUpAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	leaderConfig := &entity.Config{DataDir: dir + "/leader", MaxFileSize: 512}
+	leaderRepo := repository.NewFileStorageRepository(leaderConfig)
+	followerRepo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir + "/follower", MaxFileSize: 512})
+	defer followerRepo.Close()
+	followerUC := usecase.NewStorageUsecase(followerRepo)
+
+	// The follower got the first 10 records before the leader compacted the
+	// records it is missing
+	leaderUC := usecase.NewStorageUsecase(leaderRepo)
+	for i := 0; i < 200; i++ {
+		if err := leaderUC.StoreRecordWithKey(fmt.Sprintf("event %d", i), entity.DataTypeString, "events", fmt.Sprintf("k%d", i%5), nil); err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+	}
+	records, _ := leaderUC.RetrieveRange("events", 0, 10, 0)
+	if _, err := followerUC.ReplicateRecords("events", records, 0, false); err != nil {
+		t.Fatalf("ReplicateRecords failed: %v", err)
+	}
+	leaderRepo.Close()
+	leaderRepo = repository.NewFileStorageRepository(&entity.Config{
+		DataDir:                leaderConfig.DataDir,
+		MaxFileSize:            leaderConfig.MaxFileSize,
+		PartitionRetention:     map[string]entity.RetentionPolicy{"events": {Compact: true}},
+		RetentionCheckInterval: 10 * time.Millisecond,
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for compacted := false; !compacted; {
+		info, _ := leaderRepo.DescribePartition("events")
+		for _, seg := range info.Segments {
+			compacted = compacted || seg.Compacted
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Compaction did not remove the old records: %+v", info)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Closing waits for the compaction to finish
+	leaderRepo.Close()
+	leaderRepo = repository.NewFileStorageRepository(leaderConfig)
+	defer leaderRepo.Close()
+	leaderUC = usecase.NewStorageUsecase(leaderRepo)
+	kept, _ := leaderUC.RetrieveRange("events", 0, 0, 0)
+	if len(kept) == 200 {
+		t.Fatalf("Expected compaction to remove records")
+	}
+
+	follower := httptest.NewServer(handler.NewHTTPHandler(followerUC).GetMux())
+	defer follower.Close()
+	followerURL, _ := url.Parse(follower.URL)
+	config := DefaultConfig()
+	config.HTTPPort = followerURL.Port()
+	manager := &Manager{config: config, usecase: leaderUC}
+	manager.isLeader.Store(true)
+	node := &memberlist.Node{Name: "node-b", Addr: net.ParseIP("127.0.0.1")}
+
+	if err := manager.checkFollower(node, nil); err != nil {
+		t.Fatalf("checkFollower failed: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		manager.catchUpMu.Lock()
+		running := len(manager.catchUps)
+		manager.catchUpMu.Unlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Catch-up did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	followerInfo, err := followerUC.DescribePartition("events")
+	if err != nil || followerInfo.NextOffset != 200 || followerInfo.EarliestOffset != 0 {
+		t.Fatalf("Expected the follower to hold offsets 0-199, got %+v (%v)", followerInfo, err)
+	}
+	// The follower keeps its own records and holds every surviving one after
+	held, _ := followerUC.RetrieveRange("events", 0, 0, 0)
+	for i := 0; i < 10; i++ {
+		if held[i].Offset != uint64(i) {
+			t.Fatalf("Expected the follower to keep offsets 0-9, got offset %d", held[i].Offset)
+		}
+	}
+	missing := []uint64{}
+	for i := 0; i < len(kept); i++ {
+		if kept[i].Offset < 10 {
+			continue
+		}
+		if record, err := followerUC.RetrieveRecord("events", kept[i].Offset); err != nil || string(record.Data) != string(kept[i].Data) {
+			missing = append(missing, kept[i].Offset)
+		}
+	}
+	if len(missing) > 0 || len(held) != 10+len(kept)-countBelow(kept, 10) {
+		t.Errorf("Expected the follower to hold the leader's %d surviving records after offset 9, missing %v of %d held", len(kept)-countBelow(kept, 10), missing, len(held)-10)
+	}
+	t.Logf("TestManager_CatchUpAfterCompaction passed: follower kept its records and skipped %d compacted offsets", 200-len(kept))
+}
+
+// countBelow returns how many records have an offset below offset
+func countBelow(records []*entity.Record, offset uint64) int {
+	count := 0
+	for _, record := range records {
+		if record.Offset < offset {
+			count++
+		}
+	}
+	return count
+}
+
+func TestManager_CatchUpAfterTruncate(t *testing.T) {
+	dir := t.TempDir()
+	leaderRepo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir + "/leader", MaxFileSize: 4096})
+	defer leaderRepo.Close()
+	followerRepo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir + "/follower", MaxFileSize: 4096})
+	defer followerRepo.Close()
+	leaderUC := usecase.NewStorageUsecase(leaderRepo)
+	followerUC := usecase.NewStorageUsecase(followerRepo)
+
+	store := func(prefix string, count int) {
+		for i := 0; i < count; i++ {
+			if err := leaderUC.StoreRecord(fmt.Sprintf("%s %d", prefix, i), entity.DataTypeString, "orders"); err != nil {
+				t.Fatalf("Store failed: %v", err)
+			}
+		}
+	}
+	// The follower holds all 100 records before the leader truncates the
+	// partition after offset 49 and appends 60 different ones
+	store("old", 100)
+	records, _ := leaderUC.RetrieveRange("orders", 0, 0, 0)
+	if _, err := followerUC.ReplicateRecords("orders", records, 0, false); err != nil {
+		t.Fatalf("ReplicateRecords failed: %v", err)
+	}
+	if err := leaderUC.TruncatePartition("orders", 49); err != nil {
+		t.Fatalf("TruncatePartition failed: %v", err)
+	}
+	store("new", 60)
+
+	follower := httptest.NewServer(handler.NewHTTPHandler(followerUC).GetMux())
+	defer follower.Close()
+	followerURL, _ := url.Parse(follower.URL)
+	config := DefaultConfig()
+	config.HTTPPort = followerURL.Port()
+	manager := &Manager{config: config, usecase: leaderUC}
+	manager.isLeader.Store(true)
+	node := &memberlist.Node{Name: "node-b", Addr: net.ParseIP("127.0.0.1")}
+
+	check := func() {
+		if err := manager.checkFollower(node, nil); err != nil {
+			t.Fatalf("checkFollower failed: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			manager.catchUpMu.Lock()
+			running := len(manager.catchUps)
+			manager.catchUpMu.Unlock()
+			if running == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Catch-up did not finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	matches := func(next uint64) {
+		info, err := followerUC.DescribePartition("orders")
+		if err != nil || info.NextOffset != next {
+			t.Fatalf("Expected the follower's next offset to be %d, got %+v (%v)", next, info, err)
+		}
+		for offset := uint64(0); offset < next; offset++ {
+			leaderRecord, _ := leaderUC.RetrieveRecord("orders", offset)
+			followerRecord, err := followerUC.RetrieveRecord("orders", offset)
+			if err != nil || string(followerRecord.Data) != string(leaderRecord.Data) {
+				t.Fatalf("Offset %d differs: leader %q, follower %v (%v)", offset, leaderRecord.Data, followerRecord, err)
+			}
+		}
+	}
+
+	check()
+	matches(110)
+
+	// A follower left with more records than the leader is trimmed
+	if err := leaderUC.TruncatePartition("orders", 29); err != nil {
+		t.Fatalf("TruncatePartition failed: %v", err)
+	}
+	check()
+	matches(30)
+	t.Logf("TestManager_CatchUpAfterTruncate passed: diverged follower records replaced with the leader's")
+}
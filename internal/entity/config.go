@@ -1,7 +1,137 @@
 package entity
 
+import (
+	"fmt"
+	"time"
+)
+
 // Config holds configuration for the storage engine
 type Config struct {
-	DataDir     string `json:"data_dir"`     // Directory to store data files
-	MaxFileSize uint64 `json:"max_file_size"` // Max size of a segment file in bytes (e.g., 10MB)
-}
\ No newline at end of file
+	DataDir      string `json:"data_dir"`       // Directory to store data files
+	MaxFileSize  uint64 `json:"max_file_size"`  // Max size of a segment file in bytes (e.g., 10MB)
+	MaxOpenFiles int    `json:"max_open_files"` // Max segment files kept open for reads (default 128)
+
+	Durability          DurabilityMode `json:"durability"`            // When appends are fsynced (default DurabilitySync)
+	GroupCommitRecords  int            `json:"group_commit_records"`  // DurabilityGroup: fsync once this many records are pending (0 = time only)
+	GroupCommitInterval time.Duration  `json:"group_commit_interval"` // DurabilityGroup: fsync at most this long after an append (default 5ms)
+
+	ScrubInterval time.Duration `json:"scrub_interval"` // Pause between closed segments verified by the background scrubber (0 = disabled)
+
+	Retention              RetentionPolicy            `json:"retention"`                // Default retention for all partitions
+	PartitionRetention     map[string]RetentionPolicy `json:"partition_retention"`      // Per-partition overrides of Retention
+	RetentionCheckInterval time.Duration              `json:"retention_check_interval"` // How often retention is enforced (default 1 minute)
+
+	Compression          Compression            `json:"compression"`           // Codec for new records (default none)
+	PartitionCompression map[string]Compression `json:"partition_compression"` // Per-partition overrides of Compression
+
+	Encryption          bool            `json:"encryption"`           // Encrypt new records with AES-GCM (default false)
+	PartitionEncryption map[string]bool `json:"partition_encryption"` // Per-partition overrides of Encryption
+	KeyFile             string          `json:"key_file"`             // Local key file, used when KeyProvider is nil
+	KeyProvider         KeyProvider     `json:"-"`                    // Source of encryption keys
+}
+
+// KeyProvider supplies encryption keys by ID. An ID must always name the same
+// key, so records encrypted before a rotation stay readable.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID
+	Key(id string) ([]byte, error)
+}
+
+// EncryptionFor reports whether new records of a partition are encrypted
+func (c *Config) EncryptionFor(partitionKey string) bool {
+	if encrypt, exists := c.PartitionEncryption[partitionKey]; exists {
+		return encrypt
+	}
+	return c.Encryption
+}
+
+// Compression names the codec new records are compressed with. The records
+// of an append batch are compressed together as one block; records keep the
+// codec they were written with, so changing it never rewrites old data.
+type Compression string
+
+const (
+	// CompressionNone stores records as they are
+	CompressionNone Compression = "none"
+	// CompressionGzip trades append speed for the smallest records
+	CompressionGzip Compression = "gzip"
+	// CompressionSnappy is fast with a moderate ratio
+	CompressionSnappy Compression = "snappy"
+	// CompressionZstd compresses close to gzip at a fraction of its cost
+	CompressionZstd Compression = "zstd"
+)
+
+// CompressionFor returns the codec that applies to a partition
+func (c *Config) CompressionFor(partitionKey string) Compression {
+	if compression, exists := c.PartitionCompression[partitionKey]; exists {
+		return compression
+	}
+	if c.Compression == "" {
+		return CompressionNone
+	}
+	return c.Compression
+}
+
+// DurabilityMode selects when appended records are fsynced to disk
+type DurabilityMode string
+
+const (
+	// DurabilitySync fsyncs every append before acknowledging it
+	DurabilitySync DurabilityMode = "sync"
+	// DurabilityGroup acknowledges concurrent appends together after one
+	// shared fsync, issued after GroupCommitRecords records or GroupCommitInterval
+	DurabilityGroup DurabilityMode = "group"
+	// DurabilityOS leaves flushing to the operating system; acknowledged
+	// records can be lost in a crash
+	DurabilityOS DurabilityMode = "os"
+)
+
+// DurabilityOrDefault returns the configured durability mode, or an error
+// for an unknown one
+func (c *Config) DurabilityOrDefault() (DurabilityMode, error) {
+	switch c.Durability {
+	case "":
+		return DurabilitySync, nil
+	case DurabilitySync, DurabilityGroup, DurabilityOS:
+		return c.Durability, nil
+	default:
+		return "", fmt.Errorf("%w: unsupported durability mode %q", ErrInvalidInput, c.Durability)
+	}
+}
+
+// RetentionPolicy limits how much data a partition keeps. Only whole closed
+// segments are deleted or compacted, so a partition may briefly exceed its limits.
+type RetentionPolicy struct {
+	MaxAge             time.Duration `json:"max_age"`             // Delete segments whose newest record is older than this (0 = no limit)
+	MaxBytes           uint64        `json:"max_bytes"`           // Delete oldest segments while the partition is larger than this (0 = no limit)
+	Compact            bool          `json:"compact"`             // Keep only the newest record per key in closed segments
+	TombstoneRetention time.Duration `json:"tombstone_retention"` // How long compaction keeps tombstones (default 24h)
+}
+
+// Enabled reports whether the policy deletes or compacts anything
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxBytes > 0 || p.Compact
+}
+
+// RetentionFor returns the retention policy that applies to a partition
+func (c *Config) RetentionFor(partitionKey string) RetentionPolicy {
+	if policy, exists := c.PartitionRetention[partitionKey]; exists {
+		return policy
+	}
+	return c.Retention
+}
+
+// HasRetention reports whether any retention or compaction is configured
+func (c *Config) HasRetention() bool {
+	if c.Retention.Enabled() {
+		return true
+	}
+	for _, policy := range c.PartitionRetention {
+		if policy.Enabled() {
+			return true
+		}
+	}
+	return false
+}
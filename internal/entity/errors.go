@@ -0,0 +1,85 @@
+package entity
+
+import "errors"
+
+// Sentinel errors classify failures across the layers. Errors returned by
+// the repository and usecase wrap one of them, so callers can test the kind
+// with errors.Is while the message keeps the details.
+var (
+	// ErrInvalidInput is returned for a malformed request, such as a bad
+	// partition key, data type or batch
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrNotFound is returned for a partition or offset that does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrOutOfRange is returned for an offset that retention has removed
+	ErrOutOfRange = errors.New("out of range")
+	// ErrCorrupted is returned for stored data that fails validation
+	ErrCorrupted = errors.New("corrupted")
+	// ErrUnavailable is returned for data that exists but cannot be served
+	// right now, such as a partition that failed to load or a record whose
+	// encryption key is missing
+	ErrUnavailable = errors.New("unavailable")
+	// ErrNotLeader is returned for a write sent to a node that is not the
+	// cluster leader
+	ErrNotLeader = errors.New("not the leader")
+	// ErrReadOnly is returned for a write to storage that only serves reads
+	ErrReadOnly = errors.New("read-only")
+	// ErrQuotaExceeded is returned for a write past a configured limit
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrConflict is returned for replicated records that differ from the
+	// records a node already holds at their offsets
+	ErrConflict = errors.New("conflict")
+)
+
+// errorCodes names the sentinels in API error bodies. The first match
+// wins, so a partition that is unavailable because it is corrupted is
+// reported as unavailable.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrInvalidInput, "invalid_input"},
+	{ErrNotFound, "not_found"},
+	{ErrOutOfRange, "out_of_range"},
+	{ErrNotLeader, "not_leader"},
+	{ErrReadOnly, "read_only"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrConflict, "conflict"},
+	{ErrUnavailable, "unavailable"},
+	{ErrCorrupted, "corrupted"},
+}
+
+// ErrorCodeInternal is the code of errors that wrap no sentinel
+const ErrorCodeInternal = "internal"
+
+// ErrorCode returns the API error code for err
+func ErrorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return ErrorCodeInternal
+}
+
+// ErrorForCode returns the sentinel an API error code names, or nil for an
+// unknown code
+func ErrorForCode(code string) error {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// inputError is a kind of invalid input with a message of its own
+type inputError string
+
+func (e inputError) Error() string {
+	return string(e)
+}
+
+func (e inputError) Is(target error) bool {
+	return target == ErrInvalidInput
+}
@@ -0,0 +1,43 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	cases := []struct {
+		err  error
+		code string
+	}{
+		{fmt.Errorf("partition %w", ErrNotFound), "not_found"},
+		{ValidatePartitionKey(""), "invalid_input"},
+		{fmt.Errorf("read: %w", ErrOutOfRange), "out_of_range"},
+		{fmt.Errorf("append: %w", ErrReadOnly), "read_only"},
+		{fmt.Errorf("append: %w", ErrQuotaExceeded), "quota_exceeded"},
+		{fmt.Errorf("partition is %w: %w", ErrUnavailable, ErrCorrupted), "unavailable"},
+		{errors.New("disk full"), ErrorCodeInternal},
+	}
+	for _, c := range cases {
+		if code := ErrorCode(c.err); code != c.code {
+			t.Errorf("ErrorCode(%v) = %s, expected %s", c.err, code, c.code)
+		}
+		if sentinel := ErrorForCode(c.code); c.code != ErrorCodeInternal && !errors.Is(c.err, sentinel) {
+			t.Errorf("ErrorForCode(%s) = %v, which %v does not match", c.code, sentinel, c.err)
+		}
+	}
+	if ErrorForCode(ErrorCodeInternal) != nil {
+		t.Errorf("Expected no sentinel for the internal code")
+	}
+	if !errors.Is(ErrInvalidPartitionKey, ErrInvalidInput) {
+		t.Errorf("Expected an invalid partition key to be invalid input")
+	}
+	if _, err := NewRecord(1, DataType(9), "p"); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected an unsupported data type to be invalid input, got %v", err)
+	}
+	if _, err := (&Config{Durability: "fast"}).DurabilityOrDefault(); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected an unknown durability mode to be invalid input, got %v", err)
+	}
+	t.Logf("TestErrorCodes passed: sentinels map to API codes and back")
+}
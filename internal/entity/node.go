@@ -0,0 +1,27 @@
+package entity
+
+import "time"
+
+// Node roles reported by the status endpoint
+const (
+	NodeRoleLeader     = "leader"
+	NodeRoleFollower   = "follower"
+	NodeRoleStandalone = "standalone" // Not part of a cluster
+)
+
+// NodeStatus reports a node's role and the offsets of its partitions
+type NodeStatus struct {
+	NodeID     string          `json:"node_id"`
+	Role       string          `json:"role"`
+	Partitions []PartitionInfo `json:"partitions"`
+}
+
+// Gap is how far a follower is behind the leader on one partition
+type Gap struct {
+	Node           string    `json:"node"`
+	Partition      string    `json:"partition"`
+	LeaderOffset   uint64    `json:"leader_offset"`   // Leader's next offset
+	FollowerOffset uint64    `json:"follower_offset"` // Follower's next offset
+	Lag            uint64    `json:"lag"`             // Records the follower is missing
+	CheckedAt      time.Time `json:"checked_at"`
+}
@@ -1,5 +1,109 @@
 package entity
 
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxPartitionKeyLength is the longest partition key in bytes. Keys are valid
+// UTF-8 without control characters; keys that need escaping on disk are
+// limited further by maxPartitionDirNameLength.
+const MaxPartitionKeyLength = 255
+
+// maxPartitionDirNameLength is the longest file name common filesystems accept
+const maxPartitionDirNameLength = 255
+
+// ErrInvalidPartitionKey is returned for a key outside the partition key
+// grammar. It is a kind of ErrInvalidInput.
+var ErrInvalidPartitionKey error = inputError("invalid partition key")
+
+// ValidatePartitionKey checks that a key is non-empty, valid UTF-8 without
+// control characters and short enough to name a directory once encoded
+func ValidatePartitionKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: key is empty", ErrInvalidPartitionKey)
+	case len(key) > MaxPartitionKeyLength:
+		return fmt.Errorf("%w: key is longer than %d bytes", ErrInvalidPartitionKey, MaxPartitionKeyLength)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("%w: key is not valid UTF-8", ErrInvalidPartitionKey)
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: key contains control character %U", ErrInvalidPartitionKey, r)
+		}
+	}
+	if name := PartitionDirName(key); len(name) > maxPartitionDirNameLength {
+		return fmt.Errorf("%w: key is %d bytes once encoded for disk, the limit is %d", ErrInvalidPartitionKey, len(name), maxPartitionDirNameLength)
+	}
+	return nil
+}
+
+// PartitionDirName returns the directory name of a partition. Letters,
+// digits, '-', '_' and '.' are kept, except for a leading '.'; every other
+// byte is percent-encoded as %XX, so the name is safe on any filesystem,
+// never a path of its own and never hidden.
+func PartitionDirName(key string) string {
+	var name strings.Builder
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; isDirNameByte(c) && (i > 0 || c != '.') {
+			name.WriteByte(c)
+		} else {
+			fmt.Fprintf(&name, "%%%02X", c)
+		}
+	}
+	return name.String()
+}
+
+// ParsePartitionDirName returns the partition key a directory name encodes.
+// Names PartitionDirName would not produce for a valid key are rejected.
+func ParsePartitionDirName(name string) (string, error) {
+	var key strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '%' {
+			key.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(name) || !isUpperHex(name[i+1]) || !isUpperHex(name[i+2]) {
+			return "", fmt.Errorf("%w: bad escape in directory name %q", ErrInvalidPartitionKey, name)
+		}
+		key.WriteByte(unhex(name[i+1])<<4 | unhex(name[i+2]))
+		i += 2
+	}
+	if PartitionDirName(key.String()) != name {
+		return "", fmt.Errorf("%w: directory name %q is not a partition key encoding", ErrInvalidPartitionKey, name)
+	}
+	if err := ValidatePartitionKey(key.String()); err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// PartitionDir returns the directory holding a partition's segments
+func PartitionDir(dataDir string, key string) string {
+	return filepath.Join(dataDir, PartitionDirName(key))
+}
+
+func isDirNameByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.'
+}
+
+func isUpperHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	if c <= '9' {
+		return c - '0'
+	}
+	return c - 'A' + 10
+}
+
 // Partition represents a partition containing multiple segments
 type Partition struct {
 	Key           string     `json:"key"`
@@ -9,6 +113,18 @@ type Partition struct {
 	MaxFileSize   uint64     `json:"max_file_size"`
 }
 
+// PartitionInfo summarizes a partition for administration
+type PartitionInfo struct {
+	Key            string        `json:"key"`
+	EarliestOffset uint64        `json:"earliest_offset"`
+	LatestOffset   *uint64       `json:"latest_offset,omitempty"` // Offset of the newest record, nil if there is none
+	NextOffset     uint64        `json:"next_offset"`
+	SegmentCount   int           `json:"segment_count"`
+	Size           uint64        `json:"size"`               // Bytes of store and index files on disk
+	Error          string        `json:"error,omitempty"`    // Why the partition failed to load
+	Segments       []SegmentInfo `json:"segments,omitempty"` // Only set when describing a partition
+}
+
 // NewPartition creates a new partition
 func NewPartition(key string, dataDir string, maxFileSize uint64) *Partition {
 	p := &Partition{
@@ -22,10 +138,47 @@ func NewPartition(key string, dataDir string, maxFileSize uint64) *Partition {
 	return p
 }
 
+// RestorePartition rebuilds a partition from segments loaded from disk. The
+// segments are ordered by base offset and must cover one contiguous offset
+// range; only the highest can stay active for writing. A partition without
+// segments starts at offset 0 like a new one.
+func RestorePartition(key string, dataDir string, maxFileSize uint64, segments []*Segment) (*Partition, error) {
+	if len(segments) == 0 {
+		return NewPartition(key, dataDir, maxFileSize), nil
+	}
+	ordered := make([]*Segment, len(segments))
+	copy(ordered, segments)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].BaseOffset < ordered[j].BaseOffset
+	})
+	for i := 1; i < len(ordered); i++ {
+		prev, seg := ordered[i-1], ordered[i]
+		switch {
+		case prev.NextOffset > seg.BaseOffset:
+			return nil, fmt.Errorf("partition %s: segment %d (offsets %d-%d) overlaps segment %d", key, prev.BaseOffset, prev.BaseOffset, prev.NextOffset-1, seg.BaseOffset)
+		case prev.NextOffset < seg.BaseOffset:
+			return nil, fmt.Errorf("partition %s: offsets %d-%d are missing between segments %d and %d", key, prev.NextOffset, seg.BaseOffset-1, prev.BaseOffset, seg.BaseOffset)
+		}
+	}
+	for _, seg := range ordered[:len(ordered)-1] {
+		seg.IsActive = false
+	}
+	return &Partition{
+		Key:           key,
+		Segments:      ordered,
+		CurrentOffset: ordered[len(ordered)-1].NextOffset,
+		DataDir:       dataDir,
+		MaxFileSize:   maxFileSize,
+	}, nil
+}
+
 // createNewSegment creates a new segment for the partition
 func (p *Partition) createNewSegment() {
 	baseOffset := p.CurrentOffset
 	segment := NewSegment(p.Key, baseOffset, p.MaxFileSize, p.DataDir)
+	if len(p.Segments) > 0 {
+		segment.MaxTimestamp = p.Segments[len(p.Segments)-1].MaxTimestamp
+	}
 	p.Segments = append(p.Segments, segment)
 }
 
@@ -54,4 +207,28 @@ func (p *Partition) AppendRecord(record *Record, recordSize uint64) error {
 	active.AddRecord(recordSize)
 	p.CurrentOffset = active.NextOffset
 	return nil
-}
\ No newline at end of file
+}
+
+// SegmentAt returns the segment whose offset range holds offset, or nil. The
+// segments are ordered by base offset, so this is a binary search.
+func (p *Partition) SegmentAt(offset uint64) *Segment {
+	i := sort.Search(len(p.Segments), func(i int) bool {
+		return p.Segments[i].NextOffset > offset
+	})
+	if i < len(p.Segments) && p.Segments[i].BaseOffset <= offset {
+		return p.Segments[i]
+	}
+	return nil
+}
+
+// EarliestOffset returns the lowest offset still held by the partition, or
+// the next offset if it holds no records
+func (p *Partition) EarliestOffset() uint64 {
+	earliest := p.CurrentOffset
+	for _, seg := range p.Segments {
+		if seg != nil && seg.NextOffset > seg.BaseOffset && seg.BaseOffset < earliest {
+			earliest = seg.BaseOffset
+		}
+	}
+	return earliest
+}
@@ -1,6 +1,8 @@
 package entity
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -58,4 +60,106 @@ func TestAppendRecord(t *testing.T) {
 		t.Errorf("Expected 2 segments, got %d", len(partition.Segments))
 	}
 	t.Logf("TestAppendRecord passed: record appended and rollover works")
-}
\ No newline at end of file
+}
+func TestRestorePartition(t *testing.T) {
+	segment := func(base, next uint64) *Segment {
+		seg := NewSegment("test", base, 100, "/tmp")
+		seg.NextOffset = next
+		return seg
+	}
+	partition, err := RestorePartition("test", "/tmp", 100, []*Segment{segment(1000, 1200), segment(200, 1000), segment(0, 200)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i, base := range []uint64{0, 200, 1000} {
+		if partition.Segments[i].BaseOffset != base {
+			t.Errorf("Expected segment %d to start at %d, got %d", i, base, partition.Segments[i].BaseOffset)
+		}
+	}
+	if partition.Segments[0].IsActive || partition.Segments[1].IsActive || !partition.Segments[2].IsActive {
+		t.Errorf("Expected only the highest segment to be active")
+	}
+	if partition.CurrentOffset != 1200 {
+		t.Errorf("Expected CurrentOffset 1200, got %d", partition.CurrentOffset)
+	}
+
+	if _, err := RestorePartition("test", "/tmp", 100, []*Segment{segment(0, 200), segment(300, 400)}); err == nil {
+		t.Errorf("Expected missing offsets to be rejected")
+	}
+	if _, err := RestorePartition("test", "/tmp", 100, []*Segment{segment(0, 250), segment(200, 400)}); err == nil {
+		t.Errorf("Expected overlapping segments to be rejected")
+	}
+	// Retention may have removed the oldest segments
+	if _, err := RestorePartition("test", "/tmp", 100, []*Segment{segment(200, 300)}); err != nil {
+		t.Errorf("Expected partition starting after 0 to load, got %v", err)
+	}
+	t.Logf("TestRestorePartition passed: segments ordered numerically and gaps rejected")
+}
+
+func TestSegmentAt(t *testing.T) {
+	segment := func(base, next uint64) *Segment {
+		seg := NewSegment("test", base, 100, "/tmp")
+		seg.NextOffset = next
+		return seg
+	}
+	partition, _ := RestorePartition("test", "/tmp", 100, []*Segment{segment(0, 100), segment(100, 250), segment(250, 250)})
+
+	for offset, base := range map[uint64]uint64{0: 0, 99: 0, 100: 100, 249: 100} {
+		if seg := partition.SegmentAt(offset); seg == nil || seg.BaseOffset != base {
+			t.Errorf("Expected offset %d in segment %d, got %+v", offset, base, seg)
+		}
+	}
+	// The empty active segment holds no offsets yet
+	if seg := partition.SegmentAt(250); seg != nil {
+		t.Errorf("Expected no segment for offset 250, got %d", seg.BaseOffset)
+	}
+	t.Logf("TestSegmentAt passed: offsets resolved to their segments")
+}
+
+func TestPartitionKeyEncoding(t *testing.T) {
+	cases := []struct {
+		key string
+		dir string
+	}{
+		{"orders", "orders"},
+		{"Orders-2024_01.v2", "Orders-2024_01.v2"},
+		{"orders/eu", "orders%2Feu"},
+		{"../etc", "%2E.%2Fetc"},
+		{"..", "%2E."},
+		{".deleted-1", "%2Edeleted-1"},
+		{"50%", "50%25"},
+		{"a b", "a%20b"},
+		{"名前", "%E5%90%8D%E5%89%8D"},
+	}
+	for _, c := range cases {
+		if err := ValidatePartitionKey(c.key); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", c.key, err)
+		}
+		dir := PartitionDirName(c.key)
+		if dir != c.dir {
+			t.Errorf("PartitionDirName(%q) = %q, expected %q", c.key, dir, c.dir)
+		}
+		key, err := ParsePartitionDirName(dir)
+		if err != nil || key != c.key {
+			t.Errorf("ParsePartitionDirName(%q) = %q (%v), expected %q", dir, key, err, c.key)
+		}
+	}
+
+	invalid := []string{"", "a\x00b", "line\nbreak", "\xff\xfe", strings.Repeat("k", MaxPartitionKeyLength+1), strings.Repeat("/", 100)}
+	for _, key := range invalid {
+		if err := ValidatePartitionKey(key); !errors.Is(err, ErrInvalidPartitionKey) {
+			t.Errorf("Expected %q to be invalid, got %v", key, err)
+		}
+	}
+	if _, err := NewRecord("data", DataTypeString, "a\x00b"); err == nil {
+		t.Errorf("Expected NewRecord to reject an invalid partition key")
+	}
+
+	// Only names PartitionDirName produces are partition directories
+	for _, name := range []string{"a%2", "a%2f", "%61", ".deleted-1", "..", "a/b", "%00"} {
+		if key, err := ParsePartitionDirName(name); err == nil {
+			t.Errorf("Expected directory name %q to be rejected, got key %q", name, key)
+		}
+	}
+	t.Logf("TestPartitionKeyEncoding passed: keys validated and encoded reversibly")
+}
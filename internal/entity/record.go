@@ -3,6 +3,8 @@ package entity
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 )
 
 // DataType represents the type of data stored in a record
@@ -16,14 +18,21 @@ const (
 
 // Record represents a single entry in the storage engine
 type Record struct {
-	Offset       uint64   `json:"offset"`       // Sequential offset/index
-	Data         []byte   `json:"data"`         // Raw data bytes
-	DataType     DataType `json:"data_type"`    // Type of data
-	PartitionKey string   `json:"partition_key"` // Key for partitioning
+	Offset       uint64            `json:"offset"`              // Sequential offset/index
+	Data         []byte            `json:"data"`                // Raw data bytes
+	DataType     DataType          `json:"data_type"`           // Type of data
+	PartitionKey string            `json:"partition_key"`       // Key for partitioning
+	Timestamp    time.Time         `json:"timestamp"`           // Time the record was appended
+	Key          string            `json:"key,omitempty"`       // Optional message key
+	Headers      map[string][]byte `json:"headers,omitempty"`   // Optional metadata headers
+	Tombstone    bool              `json:"tombstone,omitempty"` // Whether the record deletes Key
 }
 
 // NewRecord creates a new record with the given data and partition key
 func NewRecord(data interface{}, dataType DataType, partitionKey string) (*Record, error) {
+	if err := ValidatePartitionKey(partitionKey); err != nil {
+		return nil, err
+	}
 	var rawData []byte
 	var err error
 
@@ -31,27 +40,27 @@ func NewRecord(data interface{}, dataType DataType, partitionKey string) (*Recor
 	case DataTypeJSON:
 		rawData, err = json.Marshal(data)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
 		}
 		// Validate JSON
 		var temp interface{}
 		if err := json.Unmarshal(rawData, &temp); err != nil {
-			return nil, errors.New("invalid JSON data")
+			return nil, fmt.Errorf("%w: data is not valid JSON", ErrInvalidInput)
 		}
 	case DataTypeBytes:
 		if bytesData, ok := data.([]byte); ok {
 			rawData = bytesData
 		} else {
-			return nil, errors.New("data must be []byte for DataTypeBytes")
+			return nil, fmt.Errorf("%w: data must be []byte for DataTypeBytes", ErrInvalidInput)
 		}
 	case DataTypeString:
 		if strData, ok := data.(string); ok {
 			rawData = []byte(strData)
 		} else {
-			return nil, errors.New("data must be string for DataTypeString")
+			return nil, fmt.Errorf("%w: data must be string for DataTypeString", ErrInvalidInput)
 		}
 	default:
-		return nil, errors.New("unsupported data type")
+		return nil, fmt.Errorf("%w: unsupported data type %d", ErrInvalidInput, dataType)
 	}
 
 	return &Record{
@@ -61,6 +70,29 @@ func NewRecord(data interface{}, dataType DataType, partitionKey string) (*Recor
 	}, nil
 }
 
+// NewTombstone creates a record marking key as deleted. Compaction drops
+// earlier records with the same key and, after a grace period, the tombstone.
+func NewTombstone(key string, partitionKey string) (*Record, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: tombstone requires a key", ErrInvalidInput)
+	}
+	if err := ValidatePartitionKey(partitionKey); err != nil {
+		return nil, err
+	}
+	return &Record{
+		DataType:     DataTypeBytes,
+		PartitionKey: partitionKey,
+		Key:          key,
+		Tombstone:    true,
+	}, nil
+}
+
+// IsTombstone reports whether the record deletes its key. Only records made
+// by NewTombstone do; a keyed record with empty data is an ordinary record.
+func (r *Record) IsTombstone() bool {
+	return r.Tombstone
+}
+
 // GetData returns the data in its original form
 func (r *Record) GetData() (interface{}, error) {
 	switch r.DataType {
@@ -77,4 +109,4 @@ func (r *Record) GetData() (interface{}, error) {
 	default:
 		return nil, errors.New("unsupported data type")
 	}
-}
\ No newline at end of file
+}
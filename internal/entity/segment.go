@@ -3,33 +3,59 @@ package entity
 import (
 	"fmt"
 	"path/filepath"
+	"time"
 )
 
+// SegmentFormatVersion is the on-disk format version written to new segments.
+// Version 1 added file headers, version 2 record timestamps, keys and headers.
+const SegmentFormatVersion uint16 = 2
+
 // Segment represents a segment file containing records
 type Segment struct {
-	PartitionKey string `json:"partition_key"`
-	BaseOffset   uint64 `json:"base_offset"` // Starting offset of this segment
-	NextOffset   uint64 `json:"next_offset"` // Next offset to assign
-	Size         uint64 `json:"size"`        // Current size in bytes
-	MaxSize      uint64 `json:"max_size"`    // Max size before rolling over
-	StorePath    string `json:"store_path"`  // Path to .store file
-	IndexPath    string `json:"index_path"`  // Path to .index file
-	IsActive     bool   `json:"is_active"`   // Whether this segment is active for writing
+	PartitionKey  string `json:"partition_key"`
+	BaseOffset    uint64 `json:"base_offset"`     // Starting offset of this segment
+	NextOffset    uint64 `json:"next_offset"`     // Next offset to assign
+	Size          uint64 `json:"size"`            // Current size in bytes
+	MaxSize       uint64 `json:"max_size"`        // Max size before rolling over
+	StorePath     string `json:"store_path"`      // Path to .store file
+	IndexPath     string `json:"index_path"`      // Path to .index file
+	TimeIndexPath string `json:"time_index_path"` // Path to .timeindex file
+	IsActive      bool   `json:"is_active"`       // Whether this segment is active for writing
+	FormatVersion uint16 `json:"format_version"`  // On-disk format version (0 = headerless legacy files)
+	Compacted     bool   `json:"compacted"`       // Whether compaction removed records, leaving gaps in the offsets
+	// MaxTimestamp is the newest record timestamp in the partition up to the
+	// end of this segment, so it never decreases from one segment to the next
+	MaxTimestamp time.Time `json:"max_timestamp"`
+}
+
+// SegmentInfo describes a segment for administration
+type SegmentInfo struct {
+	BaseOffset    uint64    `json:"base_offset"`
+	NextOffset    uint64    `json:"next_offset"`
+	Size          uint64    `json:"size"` // Bytes of store and index files on disk
+	Active        bool      `json:"active"`
+	Compacted     bool      `json:"compacted"`
+	FormatVersion uint16    `json:"format_version"`
+	MaxTimestamp  time.Time `json:"max_timestamp"`
 }
 
 // NewSegment creates a new segment for a partition
 func NewSegment(partitionKey string, baseOffset uint64, maxSize uint64, dataDir string) *Segment {
-	storePath := filepath.Join(dataDir, partitionKey, fmt.Sprintf("segment_%d.store", baseOffset))
-	indexPath := filepath.Join(dataDir, partitionKey, fmt.Sprintf("segment_%d.index", baseOffset))
+	dir := PartitionDir(dataDir, partitionKey)
+	storePath := filepath.Join(dir, fmt.Sprintf("segment_%d.store", baseOffset))
+	indexPath := filepath.Join(dir, fmt.Sprintf("segment_%d.index", baseOffset))
+	timeIndexPath := filepath.Join(dir, fmt.Sprintf("segment_%d.timeindex", baseOffset))
 	return &Segment{
-		PartitionKey: partitionKey,
-		BaseOffset:   baseOffset,
-		NextOffset:   baseOffset,
-		Size:         0,
-		MaxSize:      maxSize,
-		StorePath:    storePath,
-		IndexPath:    indexPath,
-		IsActive:     true,
+		PartitionKey:  partitionKey,
+		BaseOffset:    baseOffset,
+		NextOffset:    baseOffset,
+		Size:          0,
+		MaxSize:       maxSize,
+		StorePath:     storePath,
+		IndexPath:     indexPath,
+		TimeIndexPath: timeIndexPath,
+		IsActive:      true,
+		FormatVersion: SegmentFormatVersion,
 	}
 }
 
@@ -42,4 +68,4 @@ func (s *Segment) ShouldRollOver(recordSize uint64) bool {
 func (s *Segment) AddRecord(recordSize uint64) {
 	s.Size += recordSize
 	s.NextOffset++
-}
\ No newline at end of file
+}
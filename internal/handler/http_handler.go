@@ -1,10 +1,17 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"gostorelog/internal/entity"
 	"gostorelog/internal/usecase"
@@ -16,16 +23,74 @@ func PanicRecoveryMiddleware(next http.Handler) http.Handler {
 		defer func() {
 			if err := recover(); err != nil {
 				log.Printf("Panic recovered in HTTP handler: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				writeErrorResponse(w, http.StatusInternalServerError, entity.ErrorCodeInternal, "Internal server error")
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
+// errorResponse is the JSON body of every error response
+type errorResponse struct {
+	Error string `json:"error"` // Human-readable message
+	Code  string `json:"code"`  // Error kind, see entity.ErrorCode
+}
+
+// errorStatuses maps the entity sentinel errors to HTTP statuses; errors
+// wrapping none of them are a 500
+var errorStatuses = map[error]int{
+	entity.ErrInvalidInput:  http.StatusBadRequest,
+	entity.ErrNotFound:      http.StatusNotFound,
+	entity.ErrOutOfRange:    http.StatusRequestedRangeNotSatisfiable,
+	entity.ErrNotLeader:     http.StatusConflict,
+	entity.ErrReadOnly:      http.StatusConflict,
+	entity.ErrQuotaExceeded: http.StatusServiceUnavailable,
+	entity.ErrConflict:      http.StatusConflict,
+	entity.ErrUnavailable:   http.StatusServiceUnavailable,
+	entity.ErrCorrupted:     http.StatusInternalServerError,
+}
+
+// writeError answers with the status and code for the kind of err
+func writeError(w http.ResponseWriter, err error) {
+	code := entity.ErrorCode(err)
+	status, known := errorStatuses[entity.ErrorForCode(code)]
+	if !known {
+		status = http.StatusInternalServerError
+	}
+	writeErrorResponse(w, status, code, err.Error())
+}
+
+// badRequest answers 400 for a request the handler cannot parse
+func badRequest(w http.ResponseWriter, message string) {
+	writeErrorResponse(w, http.StatusBadRequest, entity.ErrorCode(entity.ErrInvalidInput), message)
+}
+
+// methodNotAllowed answers 405
+func methodNotAllowed(w http.ResponseWriter) {
+	writeErrorResponse(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
+
+// writeErrorResponse writes an error response with a JSON body
+func writeErrorResponse(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message, Code: code})
+}
+
+// ClusterNode reports this node's place in the cluster
+type ClusterNode interface {
+	NodeID() string
+	IsLeader() bool
+	// Gaps returns the latest lag of followers behind the leader, filtered
+	// by node and partition unless they are empty
+	Gaps(node string, partition string) []entity.Gap
+}
+
 // HTTPHandler handles HTTP requests
 type HTTPHandler struct {
 	usecase usecase.StorageUsecase
+	node    ClusterNode // nil when running standalone
 }
 
 // NewHTTPHandler creates a new HTTP handler
@@ -35,115 +100,593 @@ func NewHTTPHandler(usecase usecase.StorageUsecase) *HTTPHandler {
 	}
 }
 
+// SetClusterNode sets the cluster node reported by GET /status and /gaps
+func (h *HTTPHandler) SetClusterNode(node ClusterNode) {
+	h.node = node
+}
+
 // Publish handles POST /publish
 func (h *HTTPHandler) Publish(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w)
+		return
+	}
+	var req struct {
+		Data         interface{}       `json:"data"`
+		DataType     int               `json:"data_type"`
+		PartitionKey string            `json:"partition_key"`
+		Key          string            `json:"key"`
+		Headers      map[string][]byte `json:"headers"`
+		Tombstone    bool              `json:"tombstone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	var err error
+	if req.Tombstone {
+		if req.Data != nil {
+			badRequest(w, "A tombstone carries no data")
+			return
+		}
+		err = h.usecase.StoreTombstone(req.PartitionKey, req.Key, req.Headers)
+	} else {
+		err = h.usecase.StoreRecordWithKey(req.Data, entity.DataType(req.DataType), req.PartitionKey, req.Key, req.Headers)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// PublishBatch handles POST /publish/batch
+func (h *HTTPHandler) PublishBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
 		return
 	}
 	var req struct {
-		Data         interface{} `json:"data"`
-		DataType     int         `json:"data_type"`
-		PartitionKey string      `json:"partition_key"`
+		PartitionKey string                `json:"partition_key"`
+		Records      []usecase.RecordInput `json:"records"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		badRequest(w, err.Error())
+		return
+	}
+	if len(req.Records) == 0 {
+		badRequest(w, "No records in batch")
+		return
+	}
+	firstOffset, lastOffset, err := h.usecase.StoreRecords(req.PartitionKey, req.Records)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "ok",
+		"first_offset": firstOffset,
+		"last_offset":  lastOffset,
+	})
+}
+
+// contentTypes maps data types to the Content-Type of their raw bodies
+var contentTypes = map[entity.DataType]string{
+	entity.DataTypeJSON:   "application/json",
+	entity.DataTypeBytes:  "application/octet-stream",
+	entity.DataTypeString: "text/plain; charset=utf-8",
+}
+
+// PublishRaw handles POST /publish/raw?partition=<key>[&data_type=<n>][&key=<key>]
+// with the record data as the request body, so bytes need no encoding. The
+// parameters may instead be sent as X-Partition-Key, X-Data-Type and
+// X-Record-Key headers. Without a data type it follows the Content-Type:
+// application/json is JSON, text/* a string and anything else bytes.
+func (h *HTTPHandler) PublishRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	dataType, err := rawDataType(r)
+	if err != nil {
+		badRequest(w, "Invalid data_type")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		badRequest(w, err.Error())
 		return
 	}
-	if err := h.usecase.StoreRecord(req.Data, entity.DataType(req.DataType), req.PartitionKey); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var data interface{}
+	switch dataType {
+	case entity.DataTypeJSON:
+		if !json.Valid(body) {
+			badRequest(w, "Invalid JSON data")
+			return
+		}
+		data = json.RawMessage(body)
+	case entity.DataTypeString:
+		data = string(body)
+	default:
+		data = body
+	}
+	partition := queryOrHeader(r, "partition", "X-Partition-Key")
+	key := queryOrHeader(r, "key", "X-Record-Key")
+	if err := h.usecase.StoreRecordWithKey(data, dataType, partition, key, nil); err != nil {
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// Read handles GET /read?partition=<key>&offset=<offset>
+// rawDataType returns the data type of a raw publish
+func rawDataType(r *http.Request) (entity.DataType, error) {
+	if value := queryOrHeader(r, "data_type", "X-Data-Type"); value != "" {
+		dataType, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, err
+		}
+		if _, known := contentTypes[entity.DataType(dataType)]; !known {
+			return 0, fmt.Errorf("unknown data type %d", dataType)
+		}
+		return entity.DataType(dataType), nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/json":
+		return entity.DataTypeJSON, nil
+	case strings.HasPrefix(mediaType, "text/"):
+		return entity.DataTypeString, nil
+	}
+	return entity.DataTypeBytes, nil
+}
+
+// queryOrHeader returns a query parameter, or the header standing in for it.
+// Header values are percent-decoded so they can carry any key.
+func queryOrHeader(r *http.Request, param string, header string) string {
+	if value := r.URL.Query().Get(param); value != "" {
+		return value
+	}
+	value := r.Header.Get(header)
+	if decoded, err := url.PathUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// maxReadWait caps how long a long-poll read may wait
+const maxReadWait = 60 * time.Second
+
+// Read handles GET /read?partition=<key>&offset=<offset>[&wait=<duration>].
+// With wait set it long-polls and answers 204 if the offset is not written in time.
 func (h *HTTPHandler) Read(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	record, ok := h.readRecord(w, r)
+	if !ok {
 		return
 	}
+	json.NewEncoder(w).Encode(record)
+}
+
+// ReadRaw handles GET /read/raw?partition=<key>&offset=<offset>[&wait=<duration>]
+// like Read, answering with the record data as the body. The data type sets
+// the Content-Type; the offset, data type, percent-encoded key and timestamp
+// are sent as X-Record-* headers.
+func (h *HTTPHandler) ReadRaw(w http.ResponseWriter, r *http.Request) {
+	record, ok := h.readRecord(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", contentTypes[record.DataType])
+	w.Header().Set("X-Record-Offset", strconv.FormatUint(record.Offset, 10))
+	w.Header().Set("X-Record-Data-Type", strconv.Itoa(int(record.DataType)))
+	if record.Key != "" {
+		w.Header().Set("X-Record-Key", url.PathEscape(record.Key))
+	}
+	if !record.Timestamp.IsZero() {
+		w.Header().Set("X-Record-Timestamp", record.Timestamp.UTC().Format(time.RFC3339Nano))
+	}
+	w.Write(record.Data)
+}
+
+// readRecord reads the record a GET /read request names, writing the
+// response itself and returning false if there is none to send
+func (h *HTTPHandler) readRecord(w http.ResponseWriter, r *http.Request) (*entity.Record, bool) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return nil, false
+	}
 	partition := r.URL.Query().Get("partition")
 	offsetStr := r.URL.Query().Get("offset")
 	offset, err := strconv.ParseUint(offsetStr, 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid offset", http.StatusBadRequest)
-		return
+		badRequest(w, "Invalid offset")
+		return nil, false
+	}
+	// Long-poll: wait up to the given duration for the offset to be written
+	if waitStr := r.URL.Query().Get("wait"); waitStr != "" {
+		wait, err := time.ParseDuration(waitStr)
+		if err != nil || wait < 0 {
+			badRequest(w, "Invalid wait")
+			return nil, false
+		}
+		if wait > maxReadWait {
+			wait = maxReadWait
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		err = h.usecase.WaitForOffset(ctx, partition, offset)
+		cancel()
+		if err == context.DeadlineExceeded {
+			w.WriteHeader(http.StatusNoContent)
+			return nil, false
+		}
+		if err != nil && r.Context().Err() == nil {
+			writeError(w, err)
+			return nil, false
+		}
 	}
 	record, err := h.usecase.RetrieveRecord(partition, offset)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return nil, false
+	}
+	return record, true
+}
+
+// Default and maximum limits for GET /read/range
+const (
+	defaultRangeMaxCount = 100
+	maxRangeMaxCount     = 10000
+	defaultRangeMaxBytes = 1024 * 1024
+)
+
+// ReadRange handles GET /read/range?partition=<key>&offset=<offset>&max_count=<n>&max_bytes=<n>
+func (h *HTTPHandler) ReadRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	query := r.URL.Query()
+	partition := query.Get("partition")
+	offset, err := strconv.ParseUint(query.Get("offset"), 10, 64)
+	if err != nil {
+		badRequest(w, "Invalid offset")
 		return
 	}
-	json.NewEncoder(w).Encode(record)
+	maxCount := defaultRangeMaxCount
+	if value := query.Get("max_count"); value != "" {
+		maxCount, err = strconv.Atoi(value)
+		if err != nil || maxCount <= 0 {
+			badRequest(w, "Invalid max_count")
+			return
+		}
+		if maxCount > maxRangeMaxCount {
+			maxCount = maxRangeMaxCount
+		}
+	}
+	maxBytes := uint64(defaultRangeMaxBytes)
+	if value := query.Get("max_bytes"); value != "" {
+		maxBytes, err = strconv.ParseUint(value, 10, 64)
+		if err != nil || maxBytes == 0 {
+			badRequest(w, "Invalid max_bytes")
+			return
+		}
+	}
+	records, err := h.usecase.RetrieveRange(partition, offset, maxCount, maxBytes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	nextOffset := offset
+	if len(records) > 0 {
+		nextOffset = records[len(records)-1].Offset + 1
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"records":     records,
+		"next_offset": nextOffset,
+	})
+}
+
+// OffsetForTime handles GET /offset?partition=<key>&time=<time> and returns
+// the first offset appended at or after the time, given as RFC 3339 or Unix
+// milliseconds
+func (h *HTTPHandler) OffsetForTime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	partition := r.URL.Query().Get("partition")
+	if partition == "" {
+		badRequest(w, "Missing partition")
+		return
+	}
+	t, err := parseTime(r.URL.Query().Get("time"))
+	if err != nil {
+		badRequest(w, "Invalid time")
+		return
+	}
+	offset, err := h.usecase.OffsetForTime(partition, t)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"partition": partition,
+		"offset":    offset,
+	})
+}
+
+// parseTime parses an RFC 3339 time or a count of Unix milliseconds
+func parseTime(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// subscribeKeepAlive is how often an idle subscription sends a comment so
+// dead connections are noticed
+const subscribeKeepAlive = 15 * time.Second
+
+// Subscribe handles GET /subscribe?partition=<key>&offset=<offset> by streaming
+// records from offset onwards as Server-Sent Events, pushing new records as
+// they are appended
+func (h *HTTPHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	partition := r.URL.Query().Get("partition")
+	offset, err := strconv.ParseUint(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		badRequest(w, "Invalid offset")
+		return
+	}
+	if partition == "" {
+		badRequest(w, "Missing partition")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorResponse(w, http.StatusInternalServerError, entity.ErrorCodeInternal, "Streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	for ctx.Err() == nil {
+		waitCtx, cancel := context.WithTimeout(ctx, subscribeKeepAlive)
+		err := h.usecase.WaitForOffset(waitCtx, partition, offset)
+		cancel()
+		if err == context.DeadlineExceeded {
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				writeEvent(w, "error", 0, errorResponse{Error: err.Error(), Code: entity.ErrorCode(err)})
+				flusher.Flush()
+			}
+			return
+		}
+		records, err := h.usecase.RetrieveRange(partition, offset, defaultRangeMaxCount, defaultRangeMaxBytes)
+		if err != nil {
+			writeEvent(w, "error", 0, errorResponse{Error: err.Error(), Code: entity.ErrorCode(err)})
+			flusher.Flush()
+			return
+		}
+		for _, record := range records {
+			writeEvent(w, "record", record.Offset, record)
+			offset = record.Offset + 1
+		}
+		flusher.Flush()
+	}
 }
 
-// Replicate handles POST /replicate for receiving replicated data
-func (h *HTTPHandler) Replicate(w http.ResponseWriter, r *http.Request) {
+// writeEvent writes one Server-Sent Event with a JSON payload
+func writeEvent(w http.ResponseWriter, event string, id uint64, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", event, err)
+		return
+	}
+	if event == "record" {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// ReplicateBatch handles POST /replicate/batch, appending records copied
+// from the leader at their offsets. Body: {"partition_key": <key>, "records":
+// [<record>, ...], "since": <offset>, "reset": <bool>} with increasing
+// offsets. The leader holds no other records from since on, which defaults
+// to the first record's offset, so offsets skipped there were compacted
+// away. Records already held are skipped; an offset past the partition's
+// next offset and not covered by since answers 416 unless reset is set,
+// which makes the partition start over at that offset. Returns the
+// partition's next offset.
+func (h *HTTPHandler) ReplicateBatch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w)
 		return
 	}
 	var req struct {
-		Data         interface{} `json:"data"`
-		DataType     int         `json:"data_type"`
-		PartitionKey string      `json:"partition_key"`
+		PartitionKey string           `json:"partition_key"`
+		Records      []*entity.Record `json:"records"`
+		Since        *uint64          `json:"since"`
+		Reset        bool             `json:"reset"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		badRequest(w, err.Error())
 		return
 	}
-	// For replication, store the data as received, disable replication to avoid loop
-	// Temporarily unset replicator
-	impl := h.usecase.(*usecase.StorageUsecaseImpl)
-	replicator := impl.Replicator
-	impl.Replicator = nil
-	err := h.usecase.StoreRecord(req.Data, entity.DataType(req.DataType), req.PartitionKey)
-	impl.Replicator = replicator
+	since := uint64(0)
+	if req.Since != nil {
+		since = *req.Since
+	} else if len(req.Records) > 0 && req.Records[0] != nil {
+		since = req.Records[0].Offset
+	}
+	nextOffset, err := h.usecase.ReplicateRecords(req.PartitionKey, req.Records, since, req.Reset)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "replicated"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "replicated",
+		"next_offset": nextOffset,
+	})
 }
 
-// Status handles GET /status for reporting node status
+// Status handles GET /status, reporting the node's ID and role and the
+// offsets, segment count and size of every partition
 func (h *HTTPHandler) Status(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w)
 		return
 	}
-	// For now, return a simple status; in future, return last offsets per partition
-	status := map[string]interface{}{
-		"node": "follower", // or leader, but for now assume follower
-		"last_partition": "test-partition", // placeholder
+	partitions, err := h.usecase.ListPartitions()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := entity.NodeStatus{Role: entity.NodeRoleStandalone, Partitions: partitions}
+	if h.node != nil {
+		status.NodeID = h.node.NodeID()
+		status.Role = entity.NodeRoleFollower
+		if h.node.IsLeader() {
+			status.Role = entity.NodeRoleLeader
+		}
 	}
 	json.NewEncoder(w).Encode(status)
 }
 
-// Gaps handles GET /gaps for querying gap information
+// Gaps handles GET /gaps[?node=<id>][&partition=<key>], returning how far
+// each follower is behind on each partition as of the leader's latest check.
+// Only the leader checks, so other nodes return an empty list.
 func (h *HTTPHandler) Gaps(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w)
+		return
+	}
+	gaps := []entity.Gap{}
+	if h.node != nil {
+		gaps = h.node.Gaps(r.URL.Query().Get("node"), r.URL.Query().Get("partition"))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"gaps": gaps,
+	})
+}
+
+// ListPartitions handles GET /admin/partitions
+func (h *HTTPHandler) ListPartitions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	partitions, err := h.usecase.ListPartitions()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"partitions": partitions,
+	})
+}
+
+// DescribePartition handles GET /admin/partitions/describe?partition=<key>
+func (h *HTTPHandler) DescribePartition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
 		return
 	}
-	// For now, return placeholder gaps
-	gaps := []map[string]interface{}{
-		{"node": "follower1", "gap": 5, "partition": "test-partition"},
+	partition := r.URL.Query().Get("partition")
+	if partition == "" {
+		badRequest(w, "Missing partition")
+		return
+	}
+	info, err := h.usecase.DescribePartition(partition)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// TruncatePartition handles POST /admin/partitions/truncate, removing every
+// record after after_offset
+func (h *HTTPHandler) TruncatePartition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	var req struct {
+		PartitionKey string  `json:"partition_key"`
+		AfterOffset  *uint64 `json:"after_offset"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	if req.PartitionKey == "" || req.AfterOffset == nil {
+		badRequest(w, "Missing partition_key or after_offset")
+		return
+	}
+	if err := h.usecase.TruncatePartition(req.PartitionKey, *req.AfterOffset); err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "truncated"})
+}
+
+// DeletePartition handles POST /admin/partitions/delete
+func (h *HTTPHandler) DeletePartition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	var req struct {
+		PartitionKey string `json:"partition_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	if req.PartitionKey == "" {
+		badRequest(w, "Missing partition_key")
+		return
+	}
+	if err := h.usecase.DeletePartition(req.PartitionKey); err != nil {
+		writeError(w, err)
+		return
 	}
-	json.NewEncoder(w).Encode(gaps)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
 }
 
 // GetMux returns the HTTP mux for testing
 func (h *HTTPHandler) GetMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/publish", h.Publish)
+	mux.HandleFunc("/publish/batch", h.PublishBatch)
+	mux.HandleFunc("/publish/raw", h.PublishRaw)
 	mux.HandleFunc("/read", h.Read)
-	mux.HandleFunc("/replicate", h.Replicate)
+	mux.HandleFunc("/read/raw", h.ReadRaw)
+	mux.HandleFunc("/read/range", h.ReadRange)
+	mux.HandleFunc("/offset", h.OffsetForTime)
+	mux.HandleFunc("/subscribe", h.Subscribe)
+	mux.HandleFunc("/replicate/batch", h.ReplicateBatch)
 	mux.HandleFunc("/status", h.Status)
 	mux.HandleFunc("/gaps", h.Gaps)
+	mux.HandleFunc("/admin/partitions", h.ListPartitions)
+	mux.HandleFunc("/admin/partitions/describe", h.DescribePartition)
+	mux.HandleFunc("/admin/partitions/truncate", h.TruncatePartition)
+	mux.HandleFunc("/admin/partitions/delete", h.DeletePartition)
 	return mux
 }
 
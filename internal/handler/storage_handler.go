@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 
 	"gostorelog/internal/entity"
@@ -30,17 +31,35 @@ func (h *StorageHandler) Start(ctx context.Context, topic string) error {
 
 // handleMessage handles incoming messages
 func (h *StorageHandler) handleMessage(msg *Message) error {
-	// Assume message value is JSON with data, type, partitionKey
+	// Assume message value is JSON with data, type, partitionKey and optional key, headers and tombstone flag
 	var payload struct {
-		Data         interface{}     `json:"data"`
-		DataType     entity.DataType `json:"data_type"`
-		PartitionKey string          `json:"partition_key"`
+		Data         interface{}       `json:"data"`
+		DataType     entity.DataType   `json:"data_type"`
+		PartitionKey string            `json:"partition_key"`
+		Key          string            `json:"key"`
+		Headers      map[string][]byte `json:"headers"`
+		Tombstone    bool              `json:"tombstone"`
 	}
 	if err := json.Unmarshal(msg.Value, &payload); err != nil {
 		log.Printf("Failed to unmarshal message: %v", err)
 		return err
 	}
-	if err := h.usecase.StoreRecord(payload.Data, payload.DataType, payload.PartitionKey); err != nil {
+	// Fall back to the message key when the payload has none
+	key := payload.Key
+	if key == "" {
+		key = msg.Key
+	}
+	var err error
+	if payload.Tombstone {
+		if payload.Data != nil {
+			err = fmt.Errorf("%w: a tombstone carries no data", entity.ErrInvalidInput)
+		} else {
+			err = h.usecase.StoreTombstone(payload.PartitionKey, key, payload.Headers)
+		}
+	} else {
+		err = h.usecase.StoreRecordWithKey(payload.Data, payload.DataType, payload.PartitionKey, key, payload.Headers)
+	}
+	if err != nil {
 		log.Printf("Failed to store record: %v", err)
 		return err
 	}
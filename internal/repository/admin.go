@@ -0,0 +1,435 @@
+package repository
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gostorelog/internal/entity"
+)
+
+// deletedPartitionPrefix marks a partition directory moved aside by
+// DeletePartition; such directories are removed instead of loaded. Partition
+// directory names never start with a dot.
+const deletedPartitionPrefix = ".deleted-"
+
+// ListPartitions summarizes every partition, including those that failed
+// to load, sorted by key
+func (r *FileStorageRepository) ListPartitions() ([]entity.PartitionInfo, error) {
+	states := r.partitionStates()
+	r.mu.RLock()
+	failed := make(map[string]error, len(r.failedPartitions))
+	for key, err := range r.failedPartitions {
+		failed[key] = err
+	}
+	r.mu.RUnlock()
+
+	infos := make([]entity.PartitionInfo, 0, len(states)+len(failed))
+	for _, state := range states {
+		info, segments := partitionInfo(state)
+		infos = append(infos, *info)
+		infos[len(infos)-1].Size = segmentsSize(segments)
+	}
+	for key, err := range failed {
+		infos = append(infos, entity.PartitionInfo{Key: key, Error: err.Error()})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Key < infos[j].Key
+	})
+	return infos, nil
+}
+
+// DescribePartition summarizes a partition and each of its segments
+func (r *FileStorageRepository) DescribePartition(partitionKey string) (*entity.PartitionInfo, error) {
+	r.mu.RLock()
+	err, failed := r.failedPartitions[partitionKey]
+	r.mu.RUnlock()
+	if failed {
+		return &entity.PartitionInfo{Key: partitionKey, Error: err.Error()}, nil
+	}
+	state, err := r.lookupPartition(partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	info, segments := partitionInfo(state)
+	info.Segments = make([]entity.SegmentInfo, len(segments))
+	for i := range segments {
+		seg := &segments[i]
+		size := segmentDiskSize(seg)
+		info.Size += size
+		info.Segments[i] = entity.SegmentInfo{
+			BaseOffset:    seg.BaseOffset,
+			NextOffset:    seg.NextOffset,
+			Size:          size,
+			Active:        seg.IsActive,
+			Compacted:     seg.Compacted,
+			FormatVersion: seg.FormatVersion,
+			MaxTimestamp:  seg.MaxTimestamp,
+		}
+	}
+	return info, nil
+}
+
+// partitionInfo returns a partition's offsets and a copy of its non-empty
+// segments, whose sizes are left to the caller so files are not read under
+// the partition lock
+func partitionInfo(state *partitionState) (*entity.PartitionInfo, []entity.Segment) {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	info := &entity.PartitionInfo{
+		Key:            state.Key,
+		EarliestOffset: state.EarliestOffset(),
+		NextOffset:     state.CurrentOffset,
+	}
+	if info.NextOffset > info.EarliestOffset {
+		latest := info.NextOffset - 1
+		info.LatestOffset = &latest
+	}
+	ordered := orderedSegments(state.Partition)
+	segments := make([]entity.Segment, len(ordered))
+	for i, seg := range ordered {
+		segments[i] = *seg
+	}
+	info.SegmentCount = len(segments)
+	return info, segments
+}
+
+// segmentsSize returns the bytes the segments occupy on disk
+func segmentsSize(segments []entity.Segment) uint64 {
+	size := uint64(0)
+	for i := range segments {
+		size += segmentDiskSize(&segments[i])
+	}
+	return size
+}
+
+// TruncatePartition removes every record after afterOffset, so the next
+// append is assigned afterOffset+1, or less if compaction removed the records
+// just before it. Appends wait until it is done; reads only wait while
+// segment files are removed or replaced.
+func (r *FileStorageRepository) TruncatePartition(partitionKey string, afterOffset uint64) error {
+	state, err := r.lookupPartition(partitionKey)
+	if err != nil {
+		return err
+	}
+	state.appendMu.Lock()
+	defer state.appendMu.Unlock()
+	if state.deleted {
+		return errPartitionNotFound
+	}
+	return r.truncatePartition(state, afterOffset)
+}
+
+// truncatePartition is TruncatePartition for callers holding state.appendMu
+func (r *FileStorageRepository) truncatePartition(state *partitionState, afterOffset uint64) error {
+	partitionKey := state.Key
+	if afterOffset+1 >= state.CurrentOffset {
+		return nil
+	}
+	if err := checkEarliest(state.Partition, afterOffset); err != nil {
+		return err
+	}
+	// The active segment's files are about to be replaced or removed
+	if r.commits != nil {
+		r.commits.commit()
+	}
+	if err := closeWriter(state); err != nil {
+		return err
+	}
+
+	// Segments from removeFrom on are deleted, the one holding afterOffset is cut short
+	removeFrom := afterOffset + 1
+	cut := state.SegmentAt(afterOffset)
+	var truncated *truncatedSegment
+	if cut != nil && afterOffset+1 < cut.NextOffset {
+		prepared, err := prepareTruncatedSegment(cut, afterOffset, r.keys)
+		if err != nil {
+			return err
+		}
+		defer prepared.discard()
+		if prepared.empty() {
+			// Compaction left no records up to afterOffset
+			removeFrom = cut.BaseOffset
+		} else {
+			truncated = prepared
+		}
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.compaction = compactionState{}
+	// Newest first, so a crash leaves the remaining offsets contiguous
+	kept := len(state.Segments)
+	var removeErr error
+	for ; kept > 0 && state.Segments[kept-1].BaseOffset >= removeFrom; kept-- {
+		seg := state.Segments[kept-1]
+		r.handles.evict(seg.StorePath)
+		r.handles.evict(seg.IndexPath)
+		r.handles.evict(seg.TimeIndexPath)
+		if removeErr = removeSegmentFiles(seg); removeErr != nil {
+			truncated = nil
+			break
+		}
+	}
+	state.Segments = state.Segments[:kept]
+	if truncated != nil {
+		removeErr = r.replaceTruncatedSegment(cut, truncated)
+	}
+
+	state.CurrentOffset = removeFrom
+	if kept > 0 {
+		last := state.Segments[kept-1]
+		state.CurrentOffset = last.NextOffset
+		last.IsActive = !last.Compacted && last.FormatVersion == entity.SegmentFormatVersion
+		newest := time.Time{}
+		if kept > 1 {
+			newest = state.Segments[kept-2].MaxTimestamp
+		}
+		if err := recoverTimeIndex(last, newest, r.keys); err != nil && removeErr == nil {
+			removeErr = err
+		}
+	}
+	state.GetActiveSegment()
+	if removeErr != nil {
+		return fmt.Errorf("truncate partition %s: %w", partitionKey, removeErr)
+	}
+	log.Printf("Truncated partition %s after offset %d, next offset is %d", partitionKey, afterOffset, state.CurrentOffset)
+	return nil
+}
+
+// truncatedSegment is a shortened copy of a segment's files, written next
+// to them like a compaction so recoverCompaction handles a crash
+type truncatedSegment struct {
+	storeTmp   string
+	indexTmp   string
+	kept       int    // Index entries kept
+	nextOffset uint64 // Offset after the last kept record
+	size       int64  // Store bytes kept
+}
+
+// prepareTruncatedSegment copies the part of a segment up to afterOffset. A
+// batch frame holding records on both sides of afterOffset is rewritten with
+// the records up to it, at the same position, so the kept index entries stay
+// valid.
+func prepareTruncatedSegment(seg *entity.Segment, afterOffset uint64, keys *keyring) (*truncatedSegment, error) {
+	entries, err := readIndexEntries(seg)
+	if err != nil {
+		return nil, err
+	}
+	kept := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Offset > afterOffset
+	})
+	if kept == len(entries) {
+		return nil, fmt.Errorf("segment %s has no index entry after offset %d", seg.StorePath, afterOffset)
+	}
+	truncated := &truncatedSegment{
+		storeTmp:   seg.StorePath + compactSuffix,
+		indexTmp:   seg.IndexPath + compactSuffix,
+		kept:       kept,
+		nextOffset: seg.BaseOffset,
+		size:       int64(entries[kept].Position),
+	}
+	if kept == 0 {
+		return truncated, nil
+	}
+	truncated.nextOffset = entries[kept-1].Offset + 1
+	var rebatched []byte
+	if position := entries[kept].Position; entries[kept-1].Position == position {
+		first := kept - 1
+		for first > 0 && entries[first-1].Position == position {
+			first--
+		}
+		offsets := make([]uint64, 0, kept-first)
+		for _, entry := range entries[first:kept] {
+			offsets = append(offsets, entry.Offset)
+		}
+		if rebatched, err = readRebatchedFrame(seg, int64(position), keys, offsets); err != nil {
+			return nil, err
+		}
+	}
+	if err := copyFilePrefix(seg.StorePath, truncated.storeTmp, truncated.size); err != nil {
+		truncated.discard()
+		return nil, err
+	}
+	if rebatched != nil {
+		if err := appendFileSync(truncated.storeTmp, rebatched); err != nil {
+			truncated.discard()
+			return nil, err
+		}
+		truncated.size += int64(len(rebatched))
+	}
+	if err := copyFilePrefix(seg.IndexPath, truncated.indexTmp, headerSize(seg)+int64(kept)*indexEntrySize); err != nil {
+		truncated.discard()
+		return nil, err
+	}
+	return truncated, nil
+}
+
+// empty reports whether no records are left in the segment
+func (t *truncatedSegment) empty() bool {
+	return t.kept == 0
+}
+
+// discard removes whatever is left of the copies
+func (t *truncatedSegment) discard() {
+	os.Remove(t.storeTmp)
+	os.Remove(t.indexTmp)
+}
+
+// replaceTruncatedSegment renames the shortened copies over a segment's
+// files, store first. Callers must hold both of the partition's locks.
+func (r *FileStorageRepository) replaceTruncatedSegment(seg *entity.Segment, truncated *truncatedSegment) error {
+	// Cached handles may point at the replaced files
+	defer r.handles.evict(seg.IndexPath)
+	defer r.handles.evict(seg.StorePath)
+	if err := os.Rename(truncated.storeTmp, seg.StorePath); err != nil {
+		return err
+	}
+	// Readers stop at NextOffset, so the old index serves until it is replaced
+	seg.NextOffset = truncated.nextOffset
+	seg.Size = uint64(truncated.size)
+	return os.Rename(truncated.indexTmp, seg.IndexPath)
+}
+
+// readRebatchedFrame reads the batch frame at position in a segment's store
+// and returns it, length prefix included, holding only the records at offsets
+func readRebatchedFrame(seg *entity.Segment, position int64, keys *keyring, offsets []uint64) ([]byte, error) {
+	storeFile, err := os.Open(seg.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	defer storeFile.Close()
+	stat, err := storeFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	remaining := stat.Size() - position
+	body, err := readFrame(io.NewSectionReader(storeFile, position, remaining), remaining)
+	if err == nil && !isBatchFrame(body) {
+		err = fmt.Errorf("index entries share a frame that is not a batch")
+	}
+	if err == nil {
+		body, err = rebatchFrame(body, keys, offsets)
+	}
+	if _, unavailable := err.(*KeyUnavailableError); unavailable {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &CorruptRecordError{Path: seg.StorePath, Position: position, Reason: err.Error()}
+	}
+	frame := make([]byte, frameLengthSize, frameLengthSize+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	return append(frame, body...), nil
+}
+
+// appendFileSync appends data to the file at path and syncs it
+func appendFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// copyFilePrefix writes the first size bytes of src to a new file at dst
+func copyFilePrefix(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, in, size); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DeletePartition removes a partition and its files. Reads already holding
+// segment files finish; an append afterwards starts a new, empty partition.
+func (r *FileStorageRepository) DeletePartition(partitionKey string) error {
+	if r.config == nil || partitionKey == "" {
+		return fmt.Errorf("%w: missing config or partition key", entity.ErrInvalidInput)
+	}
+	trash, err := r.detachPartition(partitionKey)
+	if err != nil {
+		return err
+	}
+	// Wake readers waiting for records that will never come
+	r.notifyAppend(partitionKey)
+	if err := os.RemoveAll(trash); err != nil {
+		log.Printf("Failed to remove files of deleted partition %s, retrying on the next start: %v", partitionKey, err)
+	}
+	log.Printf("Deleted partition %s", partitionKey)
+	return nil
+}
+
+// detachPartition stops serving a partition and moves its directory aside,
+// returning the new path. The directory is moved under the map lock, so a
+// partition created by a concurrent append never shares it.
+func (r *FileStorageRepository) detachPartition(partitionKey string) (string, error) {
+	r.mu.RLock()
+	state := r.partitions[partitionKey]
+	_, failed := r.failedPartitions[partitionKey]
+	r.mu.RUnlock()
+	if state == nil && !failed {
+		return "", errPartitionNotFound
+	}
+	if state != nil {
+		state.appendMu.Lock()
+		defer state.appendMu.Unlock()
+		if state.deleted {
+			return "", errPartitionNotFound
+		}
+		if r.commits != nil {
+			r.commits.commit()
+		}
+		if err := closeWriter(state); err != nil {
+			log.Printf("Failed to close writer of partition %s before deleting it: %v", partitionKey, err)
+		}
+	}
+
+	partitionDir := entity.PartitionDir(r.config.DataDir, partitionKey)
+	trash := filepath.Join(r.config.DataDir, fmt.Sprintf("%s%d", deletedPartitionPrefix, time.Now().UnixNano()))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.Rename(partitionDir, trash); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	delete(r.failedPartitions, partitionKey)
+	if state != nil {
+		if r.partitions[partitionKey] == state {
+			delete(r.partitions, partitionKey)
+		}
+		state.mu.Lock()
+		state.deleted = true
+		for _, seg := range state.Segments {
+			r.handles.evict(seg.StorePath)
+			r.handles.evict(seg.IndexPath)
+			r.handles.evict(seg.TimeIndexPath)
+		}
+		state.mu.Unlock()
+	}
+	return trash, nil
+}
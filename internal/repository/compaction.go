@@ -0,0 +1,313 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gostorelog/internal/entity"
+)
+
+const (
+	defaultTombstoneRetention = 24 * time.Hour
+	compactSuffix             = ".compact"
+)
+
+// compactionState remembers what the last compaction of a partition covered
+type compactionState struct {
+	cleanedUpTo     uint64    // Closed segments below this offset have been compacted
+	tombstoneExpiry time.Time // Earliest time a kept tombstone may be dropped
+}
+
+// compactPartition rewrites the closed segments of a partition so that only
+// the newest record per key survives, keeping the original offsets. Records
+// without a key and the last record of every segment are always kept, the
+// latter so each segment's offset range survives a restart. Tombstones are
+// dropped once they are older than the policy's tombstone retention. Callers
+// must hold state.appendMu.
+func (r *FileStorageRepository) compactPartition(state *partitionState, policy entity.RetentionPolicy, now time.Time) (int, error) {
+	segments := orderedSegments(state.Partition)
+	candidates := []*entity.Segment{}
+	for i, seg := range segments {
+		// The newest segment is still being written or about to be
+		if i < len(segments)-1 && !seg.IsActive && seg.FormatVersion == entity.SegmentFormatVersion {
+			candidates = append(candidates, seg)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	boundary := candidates[len(candidates)-1].NextOffset
+	last := state.compaction
+	if last.cleanedUpTo >= boundary && (last.tombstoneExpiry.IsZero() || now.Before(last.tombstoneExpiry)) {
+		return 0, nil
+	}
+
+	// Find the newest offset of every key across the whole partition
+	latest := make(map[string]uint64)
+	for _, seg := range segments {
+		err := forEachIndexedRecord(seg, r.keys, func(entry indexEntry, body []byte, record *entity.Record) error {
+			if record.Key != "" {
+				latest[record.Key] = entry.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	grace := policy.TombstoneRetention
+	if grace <= 0 {
+		grace = defaultTombstoneRetention
+	}
+	next := compactionState{cleanedUpTo: boundary}
+	removed := 0
+	for _, seg := range candidates {
+		entries, err := readIndexEntries(seg)
+		if err != nil {
+			return removed, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		lastOffset := entries[len(entries)-1].Offset
+		keep := func(entry indexEntry, record *entity.Record) bool {
+			if record.Key == "" || entry.Offset == lastOffset {
+				return true
+			}
+			if latest[record.Key] != entry.Offset {
+				return false
+			}
+			if record.IsTombstone() {
+				expiry := record.Timestamp.Add(grace)
+				if !now.Before(expiry) {
+					return false
+				}
+				if next.tombstoneExpiry.IsZero() || expiry.Before(next.tombstoneExpiry) {
+					next.tombstoneExpiry = expiry
+				}
+			}
+			return true
+		}
+		dropped, err := r.rewriteCompactedSegment(state, seg, len(entries), keep)
+		if err != nil {
+			return removed, err
+		}
+		removed += dropped
+	}
+	state.compaction = next
+	return removed, nil
+}
+
+// forEachIndexedRecord calls fn for every record of a segment that has an
+// index entry, in offset order. The records of a batch frame are passed one
+// after another with the same body.
+func forEachIndexedRecord(seg *entity.Segment, keys *keyring, fn func(entry indexEntry, body []byte, record *entity.Record) error) error {
+	entries, err := readIndexEntries(seg)
+	if err != nil {
+		return err
+	}
+	byPosition := make(map[int64][]indexEntry, len(entries))
+	for _, entry := range entries {
+		byPosition[int64(entry.Position)] = append(byPosition[int64(entry.Position)], entry)
+	}
+	var batch batchCache
+	return walkStoreFrames(seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+		for _, entry := range byPosition[position] {
+			var record *entity.Record
+			var err error
+			if batch.cached(position) {
+				record, err = batch.record(entry.Offset, seg.StorePath)
+			} else {
+				record, err = batch.decode(body, entry.Offset, keys, seg.StorePath, position)
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(entry, body, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rewriteCompactedSegment rewrites a segment with only the records keep
+// accepts and returns how many were dropped. Frames are copied unchanged,
+// except that a batch frame losing records is rewritten with the rest.
+// Both files are written next to the originals and renamed store first, so
+// recoverCompaction can finish or discard an interrupted rewrite. Once the
+// store is replaced the new index is the only one that matches it, so a
+// failed index swap keeps it for the next load and fails the partition.
+func (r *FileStorageRepository) rewriteCompactedSegment(state *partitionState, seg *entity.Segment, total int, keep func(entry indexEntry, record *entity.Record) bool) (int, error) {
+	storeTmp := seg.StorePath + compactSuffix
+	indexTmp := seg.IndexPath + compactSuffix
+	storeFile, err := os.Create(storeTmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(storeTmp)
+	defer storeFile.Close()
+	indexFile, err := os.Create(indexTmp)
+	if err != nil {
+		return 0, err
+	}
+	keepIndexTmp := false
+	defer func() {
+		if !keepIndexTmp {
+			os.Remove(indexTmp)
+		}
+	}()
+	defer indexFile.Close()
+
+	storeWriter := bufio.NewWriter(storeFile)
+	indexWriter := bufio.NewWriter(indexFile)
+	writeSegmentHeader(storeWriter, storeMagic, seg.BaseOffset, segmentFlagCompacted)
+	writeSegmentHeader(indexWriter, indexMagic, seg.BaseOffset, segmentFlagCompacted)
+	position := int64(segmentHeaderSize)
+	kept := 0
+	// Records are kept frame by frame, since a batch frame holds several
+	var frame []byte
+	var framePosition uint64
+	var keptOffsets []uint64
+	flush := func() error {
+		if len(keptOffsets) == 0 {
+			return nil
+		}
+		body := frame
+		if isBatchFrame(body) && len(keptOffsets) < frameRecordCount(body) {
+			var err error
+			if body, err = rebatchFrame(frame, r.keys, keptOffsets); err != nil {
+				if _, unavailable := err.(*KeyUnavailableError); !unavailable {
+					err = &CorruptRecordError{Path: seg.StorePath, Position: int64(framePosition), Reason: err.Error()}
+				}
+				return err
+			}
+		}
+		for _, offset := range keptOffsets {
+			binary.Write(indexWriter, binary.BigEndian, offset)
+			binary.Write(indexWriter, binary.BigEndian, uint64(position))
+		}
+		binary.Write(storeWriter, binary.BigEndian, uint32(len(body)))
+		if _, err := storeWriter.Write(body); err != nil {
+			return err
+		}
+		position += frameLengthSize + int64(len(body))
+		kept += len(keptOffsets)
+		keptOffsets = keptOffsets[:0]
+		return nil
+	}
+	err = forEachIndexedRecord(seg, r.keys, func(entry indexEntry, body []byte, record *entity.Record) error {
+		if frame == nil || entry.Position != framePosition {
+			if err := flush(); err != nil {
+				return err
+			}
+			frame, framePosition = body, entry.Position
+		}
+		if keep(entry, record) {
+			keptOffsets = append(keptOffsets, entry.Offset)
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if kept == total {
+		return 0, nil
+	}
+
+	for _, step := range []func() error{storeWriter.Flush, indexWriter.Flush, storeFile.Sync, indexFile.Sync} {
+		if err := step(); err != nil {
+			return 0, err
+		}
+	}
+	if replaced, err := r.swapCompactedSegment(state, seg, storeTmp, indexTmp, uint64(position)); err != nil {
+		if replaced {
+			keepIndexTmp = true
+			err = fmt.Errorf("compacted segment %s has no matching index until it is reloaded: %w", seg.StorePath, err)
+			r.mu.Lock()
+			r.failedPartitions[state.Key] = err
+			r.mu.Unlock()
+		}
+		return 0, err
+	}
+	return total - kept, nil
+}
+
+// swapCompactedSegment renames a compacted segment's files over the
+// originals, store first, and drops its time index for rebuilding. It
+// reports whether the store was replaced when the swap fails.
+func (r *FileStorageRepository) swapCompactedSegment(state *partitionState, seg *entity.Segment, storeTmp, indexTmp string, size uint64) (bool, error) {
+	// Readers open both files under state.mu, so they see either version
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	// Cached handles may point at the replaced files
+	defer r.handles.evict(seg.TimeIndexPath)
+	defer r.handles.evict(seg.IndexPath)
+	defer r.handles.evict(seg.StorePath)
+	if err := os.Rename(storeTmp, seg.StorePath); err != nil {
+		return false, err
+	}
+	seg.Compacted = true
+	seg.Size = size
+	if err := removeIfExists(seg.TimeIndexPath); err != nil {
+		return true, err
+	}
+	if err := os.Rename(indexTmp, seg.IndexPath); err != nil {
+		return true, err
+	}
+	// The old time index pointed at dropped records
+	if err := recoverTimeIndex(seg, newestBefore(state.Partition, seg), r.keys); err != nil {
+		log.Printf("Rebuilding time index of compacted segment %s failed, it is rebuilt on the next load: %v", seg.StorePath, err)
+	}
+	return true, nil
+}
+
+// newestBefore returns the partition's maximum timestamp before a segment
+func newestBefore(partition *entity.Partition, seg *entity.Segment) time.Time {
+	var newest time.Time
+	for _, other := range orderedSegments(partition) {
+		if other == seg {
+			break
+		}
+		newest = other.MaxTimestamp
+	}
+	return newest
+}
+
+// recoverCompaction finishes or discards a compaction interrupted by a crash.
+// A leftover store file means the rewrite never took effect; a leftover index
+// file alone means the store was already replaced.
+func recoverCompaction(seg *entity.Segment) error {
+	storeTmp := seg.StorePath + compactSuffix
+	indexTmp := seg.IndexPath + compactSuffix
+	if _, err := os.Stat(storeTmp); err == nil {
+		log.Printf("Discarding interrupted compaction of segment %s", seg.StorePath)
+		os.Remove(storeTmp)
+		return removeIfExists(indexTmp)
+	}
+	if _, err := os.Stat(indexTmp); err == nil {
+		log.Printf("Completing interrupted compaction of segment %s", seg.StorePath)
+		// The time index still describes the old store and is rebuilt on load
+		if err := removeIfExists(seg.TimeIndexPath); err != nil {
+			return err
+		}
+		return os.Rename(indexTmp, seg.IndexPath)
+	}
+	return nil
+}
+
+// removeIfExists removes a file, ignoring one that does not exist
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"gostorelog/internal/entity"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec IDs, stored in the codec bits of a frame's attrs byte
+const (
+	codecNone   byte = 0
+	codecGzip   byte = 1
+	codecSnappy byte = 2
+	codecZstd   byte = 3
+)
+
+// minCompressSize is the smallest payload worth compressing
+const minCompressSize = 64
+
+// codecFor returns the codec ID for a configured compression
+func codecFor(compression entity.Compression) (byte, error) {
+	switch compression {
+	case "", entity.CompressionNone:
+		return codecNone, nil
+	case entity.CompressionGzip:
+		return codecGzip, nil
+	case entity.CompressionSnappy:
+		return codecSnappy, nil
+	case entity.CompressionZstd:
+		return codecZstd, nil
+	}
+	return 0, fmt.Errorf("compression %q is not supported", compression)
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// Zstd encoders and decoders are safe for concurrent use of EncodeAll and
+// DecodeAll, so one of each is shared
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// compressPayload compresses a frame payload, returning nil if the codec
+// would not make it smaller
+func compressPayload(codec byte, payload []byte) []byte {
+	if codec == codecNone || len(payload) < minCompressSize {
+		return nil
+	}
+	var compressed []byte
+	switch codec {
+	case codecGzip:
+		var buf bytes.Buffer
+		writer := gzipWriters.Get().(*gzip.Writer)
+		writer.Reset(&buf)
+		writer.Write(payload)
+		writer.Close()
+		gzipWriters.Put(writer)
+		compressed = buf.Bytes()
+	case codecSnappy:
+		compressed = snappyEncode(payload)
+	case codecZstd:
+		compressed = zstdEncoder.EncodeAll(payload, make([]byte, 0, len(payload)/2))
+	}
+	if len(compressed) >= len(payload) {
+		return nil
+	}
+	return compressed
+}
+
+// decompressPayload reverses compressPayload
+func decompressPayload(codec byte, payload []byte) ([]byte, error) {
+	switch codec {
+	case codecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(reader)
+	case codecSnappy:
+		return snappyDecode(payload)
+	case codecZstd:
+		return zstdDecoder.DecodeAll(payload, nil)
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", codec)
+}
+
+// Snappy block format, without the stream framing: the uncompressed length
+// as a uvarint, then literals and back-references. Element tags:
+//
+//	00: literal, length-1 in the upper 6 bits or the 1-4 bytes that follow
+//	01: copy of 4-11 bytes at an 11-bit offset
+//	10: copy of 1-64 bytes at a 16-bit offset
+//	11: copy of 1-64 bytes at a 32-bit offset
+//
+// The encoder only emits literals and 16-bit copies.
+const snappyTableBits = 14
+
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+// snappyEncode compresses src with a greedy hash-table matcher
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+8), uint64(len(src)))
+	var table [1 << snappyTableBits]int32 // Position+1 of the last match candidate
+	literalStart := 0
+	for i := 0; i+4 <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 0x1e35a7bd) >> (32 - snappyTableBits)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > 0xffff || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			i++
+			continue
+		}
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendSnappyLiteral(dst, src[literalStart:i])
+		dst = appendSnappyCopy(dst, i-candidate, length)
+		i += length
+		literalStart = i
+	}
+	return appendSnappyLiteral(dst, src[literalStart:])
+}
+
+func appendSnappyLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	n := uint32(len(literal) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// snappyDecode decompresses a snappy block
+func snappyDecode(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	// No element expands its input more than 22 times
+	if n <= 0 || size > uint64(len(src))*32 {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, size)
+	for s := n; s < len(src); {
+		tag := src[s]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for j := 0; j < extra; j++ {
+					length |= int(src[s+j]) << (8 * j)
+				}
+				s += extra
+			}
+			length++
+			if length > len(src)-s || uint64(len(dst)+length) > size {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case 1:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[s+1])
+			s += 2
+		case 2:
+			if s+3 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 3:
+			if s+5 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > size {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap their own output
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
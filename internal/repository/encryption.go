@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"gostorelog/internal/entity"
+)
+
+// Encrypted extended frames carry an envelope after the checksum:
+//
+//	[keyIdLen 1][keyId][nonce 12][AES-GCM ciphertext and tag]
+//
+// The plaintext is the frame payload after any compression. The attrs byte
+// and key ID are authenticated as additional data.
+const (
+	maxKeyIDSize   = 255
+	frameNonceSize = 12
+)
+
+var errNoKeyProvider = errors.New("no encryption key provider configured")
+
+// KeyUnavailableError is returned for a record encrypted with a key the key
+// provider cannot supply
+type KeyUnavailableError struct {
+	KeyID string
+	Err   error
+}
+
+func (e *KeyUnavailableError) Error() string {
+	return fmt.Sprintf("encryption key %s is unavailable: %v", e.KeyID, e.Err)
+}
+
+func (e *KeyUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches entity.ErrUnavailable, since the record is intact
+func (e *KeyUnavailableError) Is(target error) bool {
+	return target == entity.ErrUnavailable
+}
+
+// frameKey is a key new frames are encrypted with
+type frameKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// keyring caches the ciphers of a key provider's keys. A nil keyring has no
+// keys.
+type keyring struct {
+	provider entity.KeyProvider
+	mu       sync.Mutex
+	ciphers  map[string]cipher.AEAD
+}
+
+// newKeyring returns a keyring for the configured key provider, loading the
+// local key file if no provider is set. It returns nil without a provider,
+// and an error if the key file cannot be loaded or encryption is enabled
+// without a provider.
+func newKeyring(config *entity.Config) (*keyring, error) {
+	if config == nil {
+		return nil, nil
+	}
+	provider := config.KeyProvider
+	if provider == nil && config.KeyFile != "" {
+		local, err := NewLocalKeyProvider(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load key file %s: %w", config.KeyFile, err)
+		}
+		provider = local
+	}
+	if provider == nil {
+		if config.Encryption {
+			return nil, errNoKeyProvider
+		}
+		for partitionKey, encrypt := range config.PartitionEncryption {
+			if encrypt {
+				return nil, fmt.Errorf("partition %s is encrypted: %w", partitionKey, errNoKeyProvider)
+			}
+		}
+		return nil, nil
+	}
+	return &keyring{provider: provider, ciphers: make(map[string]cipher.AEAD)}, nil
+}
+
+// current returns the key new frames are encrypted with
+func (k *keyring) current() (*frameKey, error) {
+	if k == nil {
+		return nil, errNoKeyProvider
+	}
+	id, key, err := k.provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := k.cipher(id, key)
+	if err != nil {
+		return nil, err
+	}
+	return &frameKey{id: id, aead: aead}, nil
+}
+
+// cipher returns the cipher for a key ID, fetching the key from the provider
+// unless it is given
+func (k *keyring) cipher(id string, key []byte) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, errNoKeyProvider
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if aead, cached := k.ciphers[id]; cached {
+		return aead, nil
+	}
+	if len(id) == 0 || len(id) > maxKeyIDSize {
+		return nil, fmt.Errorf("key ID %q must be 1-%d bytes", id, maxKeyIDSize)
+	}
+	if key == nil {
+		var err error
+		if key, err = k.provider.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k.ciphers[id] = aead
+	return aead, nil
+}
+
+// sealPayload encrypts a frame payload into an envelope
+func sealPayload(key *frameKey, attrs byte, payload []byte) []byte {
+	envelope := make([]byte, 1+len(key.id)+frameNonceSize, 1+len(key.id)+frameNonceSize+len(payload)+key.aead.Overhead())
+	envelope[0] = byte(len(key.id))
+	copy(envelope[1:], key.id)
+	nonce := envelope[1+len(key.id):]
+	rand.Read(nonce)
+	return key.aead.Seal(envelope, nonce, payload, envelopeAdditionalData(attrs, key.id))
+}
+
+// splitEnvelope returns the key ID, nonce and ciphertext of an envelope
+func splitEnvelope(envelope []byte) (string, []byte, []byte, error) {
+	if len(envelope) == 0 || len(envelope) < 1+int(envelope[0])+frameNonceSize {
+		return "", nil, nil, fmt.Errorf("truncated encryption envelope")
+	}
+	idEnd := 1 + int(envelope[0])
+	return string(envelope[1:idEnd]), envelope[idEnd : idEnd+frameNonceSize], envelope[idEnd+frameNonceSize:], nil
+}
+
+// openPayload decrypts an envelope with the key it names
+func openPayload(keys *keyring, attrs byte, envelope []byte) ([]byte, error) {
+	id, nonce, ciphertext, err := splitEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keys.cipher(id, nil)
+	if err != nil {
+		return nil, &KeyUnavailableError{KeyID: id, Err: err}
+	}
+	return aead.Open(nil, nonce, ciphertext, envelopeAdditionalData(attrs, id))
+}
+
+func envelopeAdditionalData(attrs byte, id string) []byte {
+	return append([]byte{attrs}, id...)
+}
+
+// LocalKeyProvider reads keys from a JSON key file:
+//
+//	{"current": "2024-06", "keys": {"2024-05": "<base64>", "2024-06": "<base64>"}}
+//
+// Keys are 16, 24 or 32 bytes for AES-128, AES-192 or AES-256. To rotate,
+// add a key, point current at it and call Reload; keep old keys in the file
+// for as long as records encrypted with them are retained.
+type LocalKeyProvider struct {
+	path    string
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewLocalKeyProvider loads a key file
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	provider := &LocalKeyProvider{path: path}
+	if err := provider.Reload(); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Reload rereads the key file
+func (p *LocalKeyProvider) Reload() error {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string][]byte `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse key file %s: %v", p.path, err)
+	}
+	for id, key := range file.Keys {
+		if len(id) == 0 || len(id) > maxKeyIDSize {
+			return fmt.Errorf("key file %s: key ID %q must be 1-%d bytes", p.path, id, maxKeyIDSize)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("key file %s: key %s: %v", p.path, id, err)
+		}
+	}
+	if _, exists := file.Keys[file.Current]; !exists {
+		return fmt.Errorf("key file %s: current key %q not found", p.path, file.Current)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = file.Current
+	p.keys = file.Keys
+	return nil
+}
+
+// CurrentKey returns the key named current in the key file
+func (p *LocalKeyProvider) CurrentKey() (string, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+// Key returns a key from the key file
+func (p *LocalKeyProvider) Key(id string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	key, exists := p.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("not found in %s", p.path)
+	}
+	return key, nil
+}
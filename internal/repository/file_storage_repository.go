@@ -1,6 +1,9 @@
 package repository
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,7 +11,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"gostorelog/internal/entity"
 )
@@ -16,25 +22,104 @@ import (
 // FileStorageRepository implements StorageRepository using file system
 type FileStorageRepository struct {
 	config     *entity.Config
-	partitions map[string]*entity.Partition
+	partitions map[string]*partitionState
+	// mu guards the partition maps only; each partition has its own locks
 	mu         sync.RWMutex
 	repairChan chan string // channel to trigger repair for partition
+	// partitions whose files could not be loaded; they are not served or written
+	failedPartitions map[string]error
+	// appendSignals holds a channel per partition that is closed on the next append
+	appendSignals map[string]chan struct{}
+	signalMu      sync.Mutex
+	done          chan struct{} // closed by Close to stop background workers
+	workers       sync.WaitGroup
+	closeOnce     sync.Once
+	closeErr      error
+	// handles pools read-only segment files
+	handles *handleCache
+	// durability is the validated durability mode
+	durability entity.DurabilityMode
+	// commits batches fsyncs when durability is DurabilityGroup
+	commits *groupCommit
+	// keys encrypts and decrypts records; nil without a key provider
+	keys *keyring
 }
 
-// NewFileStorageRepository creates a new file storage repository
+// NewFileStorageRepository creates a new file storage repository. Encryption
+// keys that cannot be loaded are logged and leave encrypted records
+// unavailable; OpenFileStorageRepository refuses them instead.
 func NewFileStorageRepository(config *entity.Config) *FileStorageRepository {
+	keys, err := newKeyring(config)
+	if err != nil {
+		log.Printf("%v, encrypted records are unavailable", err)
+	}
+	return newFileStorageRepository(config, keys)
+}
+
+// OpenFileStorageRepository creates a new file storage repository like
+// NewFileStorageRepository, but fails if the key file cannot be loaded or
+// encryption is enabled without a key provider
+func OpenFileStorageRepository(config *entity.Config) (*FileStorageRepository, error) {
+	keys, err := newKeyring(config)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStorageRepository(config, keys), nil
+}
+
+// newFileStorageRepository loads the data directory and starts the workers
+func newFileStorageRepository(config *entity.Config, keys *keyring) *FileStorageRepository {
 	repo := &FileStorageRepository{
-		config:     config,
-		partitions: make(map[string]*entity.Partition),
-		repairChan: make(chan string, 10),
+		config:           config,
+		partitions:       make(map[string]*partitionState),
+		repairChan:       make(chan string, 10),
+		failedPartitions: make(map[string]error),
+		appendSignals:    make(map[string]chan struct{}),
+		done:             make(chan struct{}),
+	}
+	maxOpenFiles := 0
+	if config != nil {
+		maxOpenFiles = config.MaxOpenFiles
+	}
+	repo.handles = newHandleCache(maxOpenFiles)
+	repo.keys = keys
+	repo.durability = entity.DurabilitySync
+	if config != nil {
+		durability, err := config.DurabilityOrDefault()
+		if err != nil {
+			// Fail safe: callers are expected to validate the config first
+			log.Printf("%v, using %s", err, entity.DurabilitySync)
+		} else {
+			repo.durability = durability
+		}
+	}
+	if repo.durability == entity.DurabilityGroup {
+		repo.commits = newGroupCommit(config.GroupCommitRecords, config.GroupCommitInterval)
 	}
 	// Load existing partitions and segments
 	repo.loadExistingData()
 	// Start repair worker
-	go repo.repairWorker()
+	repo.startWorker(repo.repairWorker)
+	// Start scrubber
+	if config != nil && config.ScrubInterval > 0 {
+		repo.startWorker(func() { repo.scrubWorker(config.ScrubInterval) })
+	}
+	// Start retention cleaner
+	if config != nil && config.HasRetention() {
+		repo.startWorker(repo.retentionWorker)
+	}
 	return repo
 }
 
+// startWorker runs a background worker that Close waits for
+func (r *FileStorageRepository) startWorker(worker func()) {
+	r.workers.Add(1)
+	go func() {
+		defer r.workers.Done()
+		worker()
+	}()
+}
+
 // loadExistingData loads existing partitions and segments from disk
 func (r *FileStorageRepository) loadExistingData() {
 	if r.config == nil {
@@ -51,288 +136,947 @@ func (r *FileStorageRepository) loadExistingData() {
 	if entries == nil {
 		return
 	}
+	keys := []string{}
 	for _, entry := range entries {
 		if entry == nil || !entry.IsDir() {
 			continue
 		}
-		partitionKey := entry.Name()
-		if partitionKey == "" {
+		if strings.HasPrefix(entry.Name(), deletedPartitionPrefix) {
+			// Left over from a deletion interrupted by a crash
+			if err := os.RemoveAll(filepath.Join(r.config.DataDir, entry.Name())); err != nil {
+				log.Printf("Failed to remove deleted partition files %s: %v", entry.Name(), err)
+			}
+			continue
+		}
+		partitionKey, err := migratePartitionDir(r.config.DataDir, entry.Name())
+		if err != nil {
+			if partitionKey == "" {
+				partitionKey = entry.Name()
+			}
+			log.Printf("Failed to map directory %s in data dir to a partition, refusing to serve it: %v", entry.Name(), err)
+			r.failedPartitions[partitionKey] = err
+			continue
+		}
+		keys = append(keys, partitionKey)
+	}
+	// Directories are all renamed first, so a key whose legacy directory
+	// conflicts with its encoded one is never served
+	for _, partitionKey := range keys {
+		if _, failed := r.failedPartitions[partitionKey]; failed {
 			continue
 		}
-		r.loadPartition(partitionKey)
+		if err := r.loadPartition(partitionKey); err != nil {
+			log.Printf("Failed to load partition %s, refusing to serve it: %v", partitionKey, err)
+			r.failedPartitions[partitionKey] = err
+		}
 	}
 }
 
-// loadPartition loads a partition from disk
-func (r *FileStorageRepository) loadPartition(partitionKey string) {
+// loadPartition loads a partition from disk. Segments in an older format
+// stay readable but are closed for writing so new records go to a segment in
+// the current format. Segments that overlap or leave gaps in the offsets
+// fail the load.
+func (r *FileStorageRepository) loadPartition(partitionKey string) error {
 	if r.config == nil || partitionKey == "" {
-		return
+		return nil
 	}
-	partitionDir := filepath.Join(r.config.DataDir, partitionKey)
-	partition := entity.NewPartition(partitionKey, r.config.DataDir, r.config.MaxFileSize)
+	partitionDir := entity.PartitionDir(r.config.DataDir, partitionKey)
+	segments := []*entity.Segment{}
 	// Load segments
 	entries, err := os.ReadDir(partitionDir)
 	if err != nil {
-		return
+		return nil
 	}
 	if entries == nil {
-		return
+		return nil
 	}
+	var report recoveryReport
 	for _, entry := range entries {
 		if entry == nil || entry.IsDir() || filepath.Ext(entry.Name()) != ".store" {
 			continue
 		}
 		// Load segment
-		segmentPath := filepath.Join(partitionDir, entry.Name())
 		baseOffsetStr := entry.Name()[:len(entry.Name())-6] // remove .store
 		var baseOffset uint64
-		fmt.Sscanf(baseOffsetStr, "segment_%d", &baseOffset)
+		if _, err := fmt.Sscanf(baseOffsetStr, "segment_%d", &baseOffset); err != nil {
+			log.Printf("Skipping unrecognized file %s in partition %s", entry.Name(), partitionKey)
+			continue
+		}
 		segment := entity.NewSegment(partitionKey, baseOffset, r.config.MaxFileSize, r.config.DataDir)
+		if err := recoverCompaction(segment); err != nil {
+			return err
+		}
+		if err := r.loadSegmentFormat(segment); err != nil {
+			return err
+		}
+		if err := recoverSegment(segment, &report); err != nil {
+			return fmt.Errorf("recover segment %s: %w", segment.StorePath, err)
+		}
+		if segment.FormatVersion < entity.SegmentFormatVersion {
+			log.Printf("Segment %s uses format version %d, keeping it read-only", segment.StorePath, segment.FormatVersion)
+			segment.IsActive = false
+		}
 		// Calculate size and next offset
-		if stat, err := os.Stat(segmentPath); err == nil {
+		if stat, err := os.Stat(segment.StorePath); err == nil {
 			segment.Size = uint64(stat.Size())
 		}
 		// Load index to get next offset
-		indexPath := filepath.Join(partitionDir, baseOffsetStr+".index")
-		if file, err := os.Open(indexPath); err == nil {
-			defer file.Close()
-			stat, err := file.Stat()
-			if err == nil {
-				size := stat.Size()
-				count := size / 16 // each entry 16 bytes
+		if segment.Compacted {
+			entries, err := readIndexEntries(segment)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				segment.NextOffset = entries[len(entries)-1].Offset + 1
+			}
+		} else if stat, err := os.Stat(segment.IndexPath); err == nil {
+			size := stat.Size() - headerSize(segment)
+			if size > 0 {
+				count := size / indexEntrySize
 				segment.NextOffset = baseOffset + uint64(count)
 			}
 		}
-		if partition.Segments == nil {
-			partition.Segments = []*entity.Segment{}
-		}
-		partition.Segments = append(partition.Segments, segment)
-		if segment.NextOffset > partition.CurrentOffset {
-			partition.CurrentOffset = segment.NextOffset
+		segments = append(segments, segment)
+	}
+	partition, err := entity.RestorePartition(partitionKey, r.config.DataDir, r.config.MaxFileSize, segments)
+	if err != nil {
+		return err
+	}
+	// Time indexes carry the partition's newest timestamp from segment to segment
+	var newest time.Time
+	for _, segment := range partition.Segments {
+		if err := recoverTimeIndex(segment, newest, r.keys); err != nil {
+			return fmt.Errorf("recover time index of segment %s: %w", segment.StorePath, err)
 		}
+		newest = segment.MaxTimestamp
+	}
+	if report.changed() {
+		log.Printf("Recovered partition %s: checked %d segment(s), truncated %d store byte(s), dropped %d index entr(ies), rebuilt %d index(es)",
+			partitionKey, report.Segments, report.TruncatedBytes, report.DroppedEntries, report.RebuiltIndexes)
+	} else {
+		log.Printf("Partition %s is consistent: checked %d segment(s)", partitionKey, report.Segments)
 	}
 	if r.partitions == nil {
-		r.partitions = make(map[string]*entity.Partition)
+		r.partitions = make(map[string]*partitionState)
 	}
-	r.partitions[partitionKey] = partition
+	r.partitions[partitionKey] = &partitionState{Partition: partition}
+	return nil
+}
+
+// loadSegmentFormat reads the store and index headers of a segment and
+// records its format version, rejecting unknown versions and stray files
+func (r *FileStorageRepository) loadSegmentFormat(seg *entity.Segment) error {
+	storeHeader, err := readSegmentHeader(seg.StorePath, storeMagic, seg.BaseOffset)
+	if err != nil {
+		return err
+	}
+	indexHeader, err := readSegmentHeader(seg.IndexPath, indexMagic, seg.BaseOffset)
+	if err != nil {
+		return err
+	}
+	switch {
+	case storeHeader != nil && indexHeader != nil && storeHeader.Version != indexHeader.Version:
+		return fmt.Errorf("segment %s: store format version %d does not match index format version %d", seg.StorePath, storeHeader.Version, indexHeader.Version)
+	case storeHeader != nil:
+		seg.FormatVersion = storeHeader.Version
+		seg.Compacted = storeHeader.Flags&segmentFlagCompacted != 0
+	case indexHeader != nil:
+		seg.FormatVersion = indexHeader.Version
+	}
+	if seg.Compacted {
+		seg.IsActive = false
+	}
+	return nil
 }
 
 // Append appends a record to the storage
 func (r *FileStorageRepository) Append(record *entity.Record) error {
 	if r.config == nil || record == nil || record.PartitionKey == "" {
-		return errors.New("invalid config, record, or partition key")
+		return fmt.Errorf("%w: missing config, record, or partition key", entity.ErrInvalidInput)
 	}
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	return r.AppendBatch([]*entity.Record{record})
+}
 
-	partition, exists := r.partitions[record.PartitionKey]
-	if !exists {
-		partition = entity.NewPartition(record.PartitionKey, r.config.DataDir, r.config.MaxFileSize)
-		if r.partitions == nil {
-			r.partitions = make(map[string]*entity.Partition)
+// AppendBatch appends records to a single partition atomically: either all
+// records are written and indexed, or none are. When it returns, the records
+// are as durable as the configured durability mode promises.
+func (r *FileStorageRepository) AppendBatch(records []*entity.Record) error {
+	committed, err := r.appendBatch(records, 0, false, false)
+	if err != nil || committed == nil {
+		return err
+	}
+	// Wait outside the lock so other appends can join the group commit
+	return <-committed
+}
+
+// AppendReplicated appends records copied from another node at the offsets
+// they carry, which must increase. The sender holds no other records from
+// offset since up to the batch's last one: the offsets the batch skips there
+// were removed by compaction. Records the partition already holds are
+// compared with the batch: from the first one that differs on, the
+// partition is truncated and the batch's records are stored instead. When
+// that is the batch's first record, earlier held records may differ too, so
+// the batch is rejected with entity.ErrConflict and the sender should retry
+// from further back. A first new offset past the partition's next offset
+// would leave a hole unless since covers it, and is rejected with
+// entity.ErrOutOfRange. With reset, the sender holds nothing before the
+// batch, so in both cases the partition drops every record and starts over
+// at the batch's first offset instead. It returns the partition's next
+// offset.
+func (r *FileStorageRepository) AppendReplicated(records []*entity.Record, since uint64, reset bool) (uint64, error) {
+	for i, record := range records {
+		if record == nil || records[0] == nil {
+			continue
+		}
+		if i == 0 && since > record.Offset {
+			return 0, fmt.Errorf("%w: replicated records since offset %d start at %d", entity.ErrInvalidInput, since, record.Offset)
+		}
+		if i > 0 && records[i-1] != nil && record.Offset <= records[i-1].Offset {
+			return 0, fmt.Errorf("%w: replicated offsets must increase, got %d after %d", entity.ErrInvalidInput, record.Offset, records[i-1].Offset)
+		}
+	}
+	committed, err := r.appendBatch(records, since, true, reset)
+	if err != nil {
+		return 0, err
+	}
+	if committed != nil {
+		if err := <-committed; err != nil {
+			return 0, err
 		}
-		r.partitions[record.PartitionKey] = partition
-		// Create partition dir
-		os.MkdirAll(filepath.Join(r.config.DataDir, record.PartitionKey), 0755)
 	}
-	if partition == nil {
-		return errors.New("partition is nil")
+	state, err := r.lookupPartition(records[0].PartitionKey)
+	if err != nil {
+		return 0, err
 	}
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return state.CurrentOffset, nil
+}
 
-	activeSegment := partition.GetActiveSegment()
-	if activeSegment == nil {
-		return errors.New("active segment is nil")
+// appendBatch writes a batch under the partition's append lock. With group
+// commit it returns a channel that reports when the batch has been fsynced.
+// Replicated records keep their offsets, see AppendReplicated.
+func (r *FileStorageRepository) appendBatch(records []*entity.Record, since uint64, replicated, reset bool) (<-chan error, error) {
+	if r.config == nil || len(records) == 0 {
+		return nil, fmt.Errorf("%w: missing config or empty batch", entity.ErrInvalidInput)
+	}
+	partitionKey := records[0].PartitionKey
+	for _, record := range records {
+		if record == nil || record.PartitionKey == "" {
+			return nil, fmt.Errorf("%w: missing record or partition key", entity.ErrInvalidInput)
+		}
+		if record.PartitionKey != partitionKey {
+			return nil, fmt.Errorf("%w: batch records must share one partition key", entity.ErrInvalidInput)
+		}
+	}
+	if err := entity.ValidatePartitionKey(partitionKey); err != nil {
+		return nil, err
+	}
+	codec, err := codecFor(r.config.CompressionFor(partitionKey))
+	if err != nil {
+		return nil, err
+	}
+	var key *frameKey
+	if r.config.EncryptionFor(partitionKey) {
+		if key, err = r.keys.current(); err != nil {
+			return nil, fmt.Errorf("encrypt partition %s: %w", partitionKey, err)
+		}
 	}
 
-	// Calculate record size (data + metadata)
-	recordSize := uint64(len(record.Data) + 16) // rough estimate
+	// Encode record frames (see record_format.go and record_batch.go) before
+	// locking, since compression does not depend on the offsets
+	now := time.Now()
+	for _, record := range records {
+		if record.Timestamp.IsZero() {
+			record.Timestamp = now
+		}
+	}
+	encoded := encodeBatch(records, codec, key, replicated)
 
-	if activeSegment.ShouldRollOver(recordSize) {
-		activeSegment.IsActive = false
-		if partition.Segments == nil {
-			partition.Segments = []*entity.Segment{}
+	state, err := r.lockWritablePartition(partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	defer state.appendMu.Unlock()
+	if replicated {
+		start, err := r.replicatedStart(state, records, since, reset)
+		if err != nil {
+			return nil, err
+		}
+		if start == len(records) {
+			return nil, nil
+		}
+		if start > 0 {
+			// A batch frame holds all the records it was encoded from
+			records = records[start:]
+			encoded = encodeBatch(records, codec, key, true)
 		}
-		partition.Segments = append(partition.Segments, entity.NewSegment(record.PartitionKey, partition.CurrentOffset, r.config.MaxFileSize, r.config.DataDir))
-		activeSegment = partition.Segments[len(partition.Segments)-1]
-		if activeSegment == nil {
-			return errors.New("new active segment is nil")
+		if !consecutiveFrom(records, state.CurrentOffset) {
+			return nil, r.appendSparse(state, records, encoded)
 		}
 	}
 
-	record.Offset = activeSegment.NextOffset
+	// Records take the size of their encoded frames in the store file
+	recordSizes := encoded.recordSizes(len(records))
+	batchSize := uint64(0)
+	for _, recordSize := range recordSizes {
+		batchSize += recordSize
+	}
 
-	// Write to .store file
-	storeFile, err := os.OpenFile(activeSegment.StorePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+	activeSegment := r.segmentForBatch(state, batchSize)
+	if activeSegment == nil {
+		return nil, errors.New("active segment is nil")
 	}
-	defer storeFile.Close()
 
-	// Get current position
-	stat, err := storeFile.Stat()
+	writer, err := r.activeWriter(state, activeSegment)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	position := stat.Size()
+	storeStart := writer.storeSize
 
-	// Write record: [length 4][dataType 1][data]
-	length := uint32(len(record.Data) + 1) // +1 for dataType
-	if err := binary.Write(storeFile, binary.BigEndian, length); err != nil {
-		return err
+	// Assign offsets and build the index entries for the frames
+	for i, record := range records {
+		record.Offset = activeSegment.NextOffset + uint64(i)
 	}
-	dataTypeByte := byte(record.DataType)
-	if _, err := storeFile.Write([]byte{dataTypeByte}); err != nil {
-		return err
+	frames, entries := encoded.layout(records, storeStart)
+
+	// Frames are flushed to the file even without fsync so readers find them
+	syncEach := r.durability == entity.DurabilitySync
+	if _, err := writer.store.Write(frames); err != nil {
+		r.truncateStore(writer, storeStart, partitionKey)
+		return nil, err
 	}
-	if _, err := storeFile.Write(record.Data); err != nil {
-		return err
+	if err := writer.store.Flush(); err != nil {
+		r.truncateStore(writer, storeStart, partitionKey)
+		return nil, err
 	}
-	if err := storeFile.Sync(); err != nil {
-		return err
+	if syncEach {
+		if err := writer.storeFile.Sync(); err != nil {
+			r.truncateStore(writer, storeStart, partitionKey)
+			return nil, err
+		}
 	}
+	writer.storeSize += int64(len(frames))
 
-	// Write to .index file with retry
+	// Write to .index file with retry. Entries go at the position implied by
+	// the segment's offsets, so a retry overwrites any partial earlier attempt.
+	indexStart := headerSize(activeSegment) + int64(activeSegment.NextOffset-activeSegment.BaseOffset)*indexEntrySize
 	var indexErr error
 	for retries := 0; retries < 3; retries++ {
-		indexFile, err := os.OpenFile(activeSegment.IndexPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			indexErr = err
-			continue
-		}
-		if err := binary.Write(indexFile, binary.BigEndian, record.Offset); err != nil {
-			indexFile.Close()
-			indexErr = err
-			continue
-		}
-		if err := binary.Write(indexFile, binary.BigEndian, uint64(position)); err != nil {
-			indexFile.Close()
+		if _, err := writer.indexFile.WriteAt(entries, indexStart); err != nil {
 			indexErr = err
 			continue
 		}
-		if err := indexFile.Sync(); err != nil {
-			indexFile.Close()
-			indexErr = err
-			continue
+		if syncEach {
+			if err := writer.indexFile.Sync(); err != nil {
+				indexErr = err
+				continue
+			}
 		}
-		indexFile.Close()
 		indexErr = nil
 		break
 	}
 	if indexErr != nil {
 		log.Printf("Failed to write index after retries: %v", indexErr)
-		// Trigger repair
-		select {
-		case r.repairChan <- record.PartitionKey:
-		default:
+		r.truncateStore(writer, storeStart, partitionKey)
+		return nil, indexErr
+	}
+
+	// Write to .timeindex file for records newer than any before them
+	timeEntries, newest := encodeTimeIndexEntries(records, activeSegment.MaxTimestamp)
+	if len(timeEntries) > 0 {
+		if err := r.writeTimeIndex(writer, timeEntries, syncEach); err != nil {
+			log.Printf("Failed to write time index: %v", err)
+			r.truncateStore(writer, storeStart, partitionKey)
+			return nil, err
 		}
-		return indexErr
 	}
 
-	// Update segment
-	activeSegment.AddRecord(recordSize)
-	partition.CurrentOffset = activeSegment.NextOffset
+	// Publish the records to readers
+	state.mu.Lock()
+	for _, recordSize := range recordSizes {
+		activeSegment.AddRecord(recordSize)
+	}
+	activeSegment.MaxTimestamp = newest
+	state.CurrentOffset = activeSegment.NextOffset
+	state.mu.Unlock()
+	r.notifyAppend(partitionKey)
 
 	// Sanity check
-	if err := r.sanityCheck(activeSegment); err != nil {
+	if err := r.checkAppend(writer); err != nil {
 		log.Printf("Sanity check failed: %v, triggering repair", err)
-		select {
-		case r.repairChan <- record.PartitionKey:
-		default:
+		r.requestRepair(partitionKey)
+	}
+
+	if r.commits != nil {
+		return r.commits.add(writer, len(records)), nil
+	}
+	return nil, nil
+}
+
+// replicatedStart returns the index of the first record of a replicated
+// batch to append, see AppendReplicated, truncating or resetting the
+// partition as needed. The caller holds state.appendMu.
+func (r *FileStorageRepository) replicatedStart(state *partitionState, records []*entity.Record, since uint64, reset bool) (int, error) {
+	first := records[0].Offset
+	if first > state.CurrentOffset && since > state.CurrentOffset {
+		if !reset {
+			return 0, fmt.Errorf("%w: replicated offset %d is past next offset %d of partition %s", entity.ErrOutOfRange, first, state.CurrentOffset, state.Key)
 		}
+		return 0, r.resetPartition(state, first)
 	}
+	held := sort.Search(len(records), func(i int) bool {
+		return records[i].Offset >= state.CurrentOffset
+	})
+	diverged, err := r.firstDivergence(state, records[:held])
+	if err != nil || diverged == held {
+		return held, err
+	}
+	if diverged > 0 {
+		log.Printf("Replicated record %d of partition %s differs from the one held, truncating", records[diverged].Offset, state.Key)
+		return diverged, r.truncatePartition(state, records[diverged-1].Offset)
+	}
+	state.mu.RLock()
+	earliest := state.EarliestOffset()
+	state.mu.RUnlock()
+	if !reset && first > earliest {
+		return 0, fmt.Errorf("%w: replicated record %d of partition %s differs from the one held", entity.ErrConflict, first, state.Key)
+	}
+	log.Printf("Replicated record %d of partition %s differs from the one held, starting over", first, state.Key)
+	return 0, r.resetPartition(state, first)
+}
 
-	return nil
+// firstDivergence returns the index of the first of records, all held by
+// the partition, whose stored copy differs from it, or len(records). Records
+// this partition no longer holds, because retention or compaction removed
+// them, cannot be compared and count as equal.
+func (r *FileStorageRepository) firstDivergence(state *partitionState, records []*entity.Record) (int, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	state.mu.RLock()
+	earliest := state.EarliestOffset()
+	state.mu.RUnlock()
+	i := 0
+	for i < len(records) && records[i].Offset < earliest {
+		i++
+	}
+	if i == len(records) {
+		return i, nil
+	}
+	errStop := errors.New("stop")
+	err := r.Scan(state.Key, records[i].Offset, ScanOptions{}, func(held *entity.Record) error {
+		// Records compaction removed here or at the sender cannot be
+		// compared either
+		for i < len(records) && records[i].Offset < held.Offset {
+			i++
+		}
+		if i < len(records) && held.Offset < records[i].Offset {
+			return nil
+		}
+		if i == len(records) || !sameRecord(held, records[i]) {
+			return errStop
+		}
+		i++
+		return nil
+	})
+	if err == nil {
+		// The remaining records were removed here
+		return len(records), nil
+	}
+	if err != errStop {
+		return 0, err
+	}
+	return i, nil
 }
 
-// Read reads a record by offset
-func (r *FileStorageRepository) Read(partitionKey string, offset uint64) (*entity.Record, error) {
-	if partitionKey == "" {
-		return nil, errors.New("invalid partition key")
+// sameRecord reports whether two copies of a record hold the same contents
+func sameRecord(a, b *entity.Record) bool {
+	if a.DataType != b.DataType || a.Key != b.Key || a.Tombstone != b.Tombstone || !a.Timestamp.Equal(b.Timestamp) || !bytes.Equal(a.Data, b.Data) || len(a.Headers) != len(b.Headers) {
+		return false
 	}
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	for name, value := range a.Headers {
+		if other, exists := b.Headers[name]; !exists || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
 
-	partition, exists := r.partitions[partitionKey]
-	if !exists || partition == nil {
-		return nil, errors.New("partition not found")
+// resetPartition removes every segment of a partition so that its next
+// record goes to a new segment at nextOffset. The caller holds
+// state.appendMu and appends right after; a crash in between leaves an empty
+// partition, which the sender resets again.
+func (r *FileStorageRepository) resetPartition(state *partitionState, nextOffset uint64) error {
+	if r.commits != nil {
+		r.commits.commit()
 	}
-	if partition.Segments == nil || len(partition.Segments) == 0 {
-		return nil, errors.New("no segments found")
+	if err := closeWriter(state); err != nil {
+		return err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.compaction = compactionState{}
+	// Newest first, so a crash leaves the remaining offsets contiguous
+	for len(state.Segments) > 0 {
+		seg := state.Segments[len(state.Segments)-1]
+		r.handles.evict(seg.StorePath)
+		r.handles.evict(seg.IndexPath)
+		r.handles.evict(seg.TimeIndexPath)
+		if err := removeSegmentFiles(seg); err != nil {
+			return fmt.Errorf("reset partition %s: %w", state.Key, err)
+		}
+		state.Segments = state.Segments[:len(state.Segments)-1]
 	}
+	log.Printf("Reset partition %s from next offset %d to %d", state.Key, state.CurrentOffset, nextOffset)
+	state.CurrentOffset = nextOffset
+	state.GetActiveSegment()
+	return nil
+}
 
-	// Find the segment containing the offset
-	var targetSegment *entity.Segment
-	for _, seg := range partition.Segments {
-		if seg == nil {
-			continue
+// consecutiveFrom reports whether records hold consecutive offsets starting
+// at offset
+func consecutiveFrom(records []*entity.Record, offset uint64) bool {
+	for i, record := range records {
+		if record.Offset != offset+uint64(i) {
+			return false
 		}
-		if offset >= seg.BaseOffset && offset < seg.NextOffset {
-			targetSegment = seg
-			break
+	}
+	return true
+}
+
+// appendSparse stores replicated records whose offsets skip records the
+// sender's compaction removed. Like a compacted segment, they go to a closed
+// segment starting at the partition's next offset, with an index entry per
+// record, and the next append starts a new segment after them. The files are
+// written next to their final names and renamed store first, so
+// recoverCompaction finishes or discards them after a crash. The caller
+// holds state.appendMu.
+func (r *FileStorageRepository) appendSparse(state *partitionState, records []*entity.Record, encoded *encodedBatch) error {
+	if r.commits != nil {
+		r.commits.commit()
+	}
+	if err := closeWriter(state); err != nil {
+		return err
+	}
+	state.mu.Lock()
+	newest := time.Time{}
+	if len(state.Segments) > 0 {
+		last := state.Segments[len(state.Segments)-1]
+		newest = last.MaxTimestamp
+		if last.NextOffset == last.BaseOffset {
+			// An empty segment would share the new segment's files
+			r.handles.evict(last.StorePath)
+			r.handles.evict(last.IndexPath)
+			r.handles.evict(last.TimeIndexPath)
+			if err := removeSegmentFiles(last); err != nil {
+				state.mu.Unlock()
+				return err
+			}
+			state.Segments = state.Segments[:len(state.Segments)-1]
+		} else {
+			last.IsActive = false
 		}
 	}
-	if targetSegment == nil {
-		return nil, errors.New("offset not found")
+	seg := entity.NewSegment(state.Key, state.CurrentOffset, r.config.MaxFileSize, r.config.DataDir)
+	state.mu.Unlock()
+
+	storeTmp := seg.StorePath + compactSuffix
+	indexTmp := seg.IndexPath + compactSuffix
+	var store, index bytes.Buffer
+	writeSegmentHeader(&store, storeMagic, seg.BaseOffset, segmentFlagCompacted)
+	writeSegmentHeader(&index, indexMagic, seg.BaseOffset, segmentFlagCompacted)
+	frames, entries := encoded.layout(records, int64(store.Len()))
+	store.Write(frames)
+	index.Write(entries)
+	for _, file := range []struct {
+		path string
+		data []byte
+	}{{storeTmp, store.Bytes()}, {indexTmp, index.Bytes()}} {
+		if err := writeFileSync(file.path, file.data); err != nil {
+			os.Remove(storeTmp)
+			os.Remove(indexTmp)
+			return err
+		}
+	}
+	if err := os.Rename(storeTmp, seg.StorePath); err != nil {
+		os.Remove(storeTmp)
+		os.Remove(indexTmp)
+		return err
+	}
+	if err := os.Rename(indexTmp, seg.IndexPath); err != nil {
+		// The next append would reuse the segment's store file
+		err = fmt.Errorf("segment %s has no index until it is reloaded: %w", seg.StorePath, err)
+		r.mu.Lock()
+		r.failedPartitions[state.Key] = err
+		r.mu.Unlock()
+		return err
+	}
+	seg.IsActive = false
+	seg.Compacted = true
+	seg.NextOffset = records[len(records)-1].Offset + 1
+	seg.Size = uint64(store.Len())
+	_, seg.MaxTimestamp = encodeTimeIndexEntries(records, newest)
+	if err := recoverTimeIndex(seg, newest, r.keys); err != nil {
+		log.Printf("Building time index of segment %s failed, it is rebuilt on the next load: %v", seg.StorePath, err)
 	}
 
-	// Open index file to find position
-	indexFile, err := os.Open(targetSegment.IndexPath)
+	// Publish the records to readers
+	state.mu.Lock()
+	state.Segments = append(state.Segments, seg)
+	state.CurrentOffset = seg.NextOffset
+	state.mu.Unlock()
+	r.notifyAppend(state.Key)
+	log.Printf("Stored replicated offsets %d-%d of partition %s in compacted segment %d", records[0].Offset, seg.NextOffset-1, state.Key, seg.BaseOffset)
+	return nil
+}
+
+// writeFileSync writes data to a new file at path and syncs it
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer indexFile.Close()
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
 
-	relativeOffset := offset - targetSegment.BaseOffset
-	// Each entry is 16 bytes (offset 8, position 8)
-	indexFile.Seek(int64(relativeOffset*16), 0)
+// segmentForBatch returns the segment a batch of batchSize bytes goes to.
+// A batch never spans segments. An empty segment takes the batch whatever its
+// size, since a new segment would start at the same offset.
+func (r *FileStorageRepository) segmentForBatch(state *partitionState, batchSize uint64) *entity.Segment {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	activeSegment := state.GetActiveSegment()
+	if activeSegment.NextOffset > activeSegment.BaseOffset && activeSegment.ShouldRollOver(batchSize) {
+		activeSegment.IsActive = false
+		next := entity.NewSegment(state.Key, state.CurrentOffset, r.config.MaxFileSize, r.config.DataDir)
+		next.MaxTimestamp = activeSegment.MaxTimestamp
+		state.Segments = append(state.Segments, next)
+		activeSegment = next
+	}
+	return activeSegment
+}
 
-	var storedOffset, position uint64
-	if err := binary.Read(indexFile, binary.BigEndian, &storedOffset); err != nil {
-		return nil, err
+// truncateStore rolls the active store file back to size after a failed
+// write, falling back to the repair worker if that fails too
+func (r *FileStorageRepository) truncateStore(writer *segmentWriter, size int64, partitionKey string) {
+	writer.store.Reset(writer.storeFile)
+	if err := writer.storeFile.Truncate(size); err != nil {
+		log.Printf("Failed to roll back store file %s: %v", writer.seg.StorePath, err)
+		// Resume after whatever actually reached the file
+		if stat, statErr := writer.storeFile.Stat(); statErr == nil {
+			writer.storeSize = stat.Size()
+		}
+		r.requestRepair(partitionKey)
+		return
 	}
-	if err := binary.Read(indexFile, binary.BigEndian, &position); err != nil {
+	writer.storeSize = size
+}
+
+// Read reads a record by offset
+func (r *FileStorageRepository) Read(partitionKey string, offset uint64) (*entity.Record, error) {
+	if partitionKey == "" {
+		return nil, entity.ErrInvalidPartitionKey
+	}
+	state, err := r.lookupPartition(partitionKey)
+	if err != nil {
 		return nil, err
 	}
 
-	// Open store file and read the record
-	storeFile, err := os.Open(targetSegment.StorePath)
+	// Find the segment containing the offset
+	view, err := r.openSegmentAt(state, offset)
 	if err != nil {
 		return nil, err
 	}
-	defer storeFile.Close()
+	if view == nil {
+		return nil, errOffsetNotFound
+	}
+	defer r.closeSegmentView(view)
+	targetSegment := &view.seg
 
-	storeFile.Seek(int64(position), 0)
-	var length uint32
-	if err := binary.Read(storeFile, binary.BigEndian, &length); err != nil {
-		return nil, err
+	// Find the position in the index
+	slot := view.entries.search(targetSegment, offset)
+	if slot >= view.entries.count() || view.entries.at(slot).Offset != offset {
+		// Compaction removed the record
+		return nil, errOffsetNotFound
 	}
-	// Read dataType and data
-	dataTypeByte := make([]byte, 1)
-	if _, err := io.ReadFull(storeFile, dataTypeByte); err != nil {
+	entry := view.entries.at(slot)
+
+	// Read the record from the store
+	record, err := readRecordAt(view.store.file, targetSegment.StorePath, int64(entry.Position), offset, r.keys, nil)
+	if err != nil {
 		return nil, err
 	}
-	data := make([]byte, length-1)
-	if _, err := io.ReadFull(storeFile, data); err != nil {
-		return nil, err
+	record.Offset = offset
+	record.PartitionKey = partitionKey
+
+	return record, nil
+}
+
+// WaitForOffset blocks until the partition holds a record at offset or ctx
+// is done, in which case the context error is returned
+func (r *FileStorageRepository) WaitForOffset(ctx context.Context, partitionKey string, offset uint64) error {
+	if partitionKey == "" {
+		return entity.ErrInvalidPartitionKey
+	}
+	for {
+		// Take the signal before checking so an append in between is not missed
+		signal := r.appendSignal(partitionKey)
+		r.mu.RLock()
+		err, failed := r.failedPartitions[partitionKey]
+		state := r.partitions[partitionKey]
+		r.mu.RUnlock()
+		if failed {
+			return unavailablePartition(partitionKey, err)
+		}
+		nextOffset := uint64(0)
+		if state != nil {
+			state.mu.RLock()
+			nextOffset = state.CurrentOffset
+			state.mu.RUnlock()
+		}
+		if offset < nextOffset {
+			return nil
+		}
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	record := &entity.Record{
-		Offset:       offset,
-		Data:         data,
-		DataType:     entity.DataType(dataTypeByte[0]),
-		PartitionKey: partitionKey,
+// appendSignal returns the channel closed by the next append to a partition
+func (r *FileStorageRepository) appendSignal(partitionKey string) chan struct{} {
+	r.signalMu.Lock()
+	defer r.signalMu.Unlock()
+	signal, exists := r.appendSignals[partitionKey]
+	if !exists {
+		signal = make(chan struct{})
+		r.appendSignals[partitionKey] = signal
 	}
+	return signal
+}
 
-	return record, nil
+// notifyAppend wakes everyone waiting for new records in a partition
+func (r *FileStorageRepository) notifyAppend(partitionKey string) {
+	r.signalMu.Lock()
+	defer r.signalMu.Unlock()
+	if signal, exists := r.appendSignals[partitionKey]; exists {
+		close(signal)
+		delete(r.appendSignals, partitionKey)
+	}
+}
+
+// Scan calls fn for every record from fromOffset onwards, in offset order
+// across segment boundaries, until the end of the partition, a limit in opts
+// is reached or fn returns an error. Each segment's files are opened once.
+func (r *FileStorageRepository) Scan(partitionKey string, fromOffset uint64, opts ScanOptions, fn func(*entity.Record) error) error {
+	if partitionKey == "" {
+		return entity.ErrInvalidPartitionKey
+	}
+	if fn == nil {
+		return fmt.Errorf("%w: scan callback is nil", entity.ErrInvalidInput)
+	}
+	state, err := r.lookupPartition(partitionKey)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	totalBytes := uint64(0)
+	emit := func(record *entity.Record) (bool, error) {
+		if opts.MaxBytes > 0 && count > 0 && totalBytes+uint64(len(record.Data)) > opts.MaxBytes {
+			return true, nil
+		}
+		if err := fn(record); err != nil {
+			return true, err
+		}
+		count++
+		totalBytes += uint64(len(record.Data))
+		return opts.MaxCount > 0 && count >= opts.MaxCount, nil
+	}
+
+	// Segments are opened one at a time so fn runs without partition locks
+	next := fromOffset
+	for {
+		view, err := r.openSegmentAt(state, next)
+		if err != nil || view == nil {
+			return err
+		}
+		stop, err := scanSegment(view, next, r.keys, emit)
+		r.closeSegmentView(view)
+		if err != nil || stop {
+			return err
+		}
+		next = view.seg.NextOffset
+	}
+}
+
+// scanSegment reads the records of a segment from fromOffset to its end,
+// passing each to emit until emit asks to stop
+func scanSegment(view *segmentView, fromOffset uint64, keys *keyring, emit func(*entity.Record) (bool, error)) (bool, error) {
+	seg := &view.seg
+	start := fromOffset
+	if start < seg.BaseOffset {
+		start = seg.BaseOffset
+	}
+
+	slot := view.entries.search(seg, start)
+
+	storeFile := view.store.file
+	stat, err := storeFile.Stat()
+	if err != nil {
+		return true, err
+	}
+
+	var storeReader *bufio.Reader
+	readerPos := int64(-1)
+	var batch batchCache
+	for ; slot < view.entries.count(); slot++ {
+		entry := view.entries.at(slot)
+		offset, position := entry.Offset, entry.Position
+		if offset >= seg.NextOffset {
+			return false, nil
+		}
+		var record *entity.Record
+		if batch.cached(int64(position)) {
+			// The rest of a batch frame that was already read
+			record, err = batch.record(offset, seg.StorePath)
+		} else {
+			// Frames are read sequentially unless the index skips ahead
+			if int64(position) != readerPos {
+				readerPos = int64(position)
+				storeReader = bufio.NewReader(io.NewSectionReader(storeFile, readerPos, stat.Size()-readerPos))
+			}
+			body, readErr := readFrame(storeReader, stat.Size()-readerPos)
+			if readErr != nil {
+				return true, &CorruptRecordError{Path: seg.StorePath, Position: readerPos, Reason: readErr.Error()}
+			}
+			record, err = batch.decode(body, offset, keys, seg.StorePath, readerPos)
+			readerPos += frameLengthSize + int64(len(body))
+		}
+		if err != nil {
+			return true, err
+		}
+		record.Offset = offset
+		record.PartitionKey = seg.PartitionKey
+		if stop, err := emit(record); err != nil || stop {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// orderedSegments returns the non-empty segments of a partition sorted by
+// base offset
+func orderedSegments(partition *entity.Partition) []*entity.Segment {
+	segments := make([]*entity.Segment, 0, len(partition.Segments))
+	for _, seg := range partition.Segments {
+		if seg != nil && seg.NextOffset > seg.BaseOffset {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].BaseOffset < segments[j].BaseOffset
+	})
+	return segments
 }
 
-// Close closes the repository
+// Close stops the background workers and closes every partition's writer.
+// Calling it again returns the result of the first call.
 func (r *FileStorageRepository) Close() error {
-	close(r.repairChan)
+	r.closeOnce.Do(func() {
+		close(r.done)
+		// Workers may be repairing or compacting files
+		r.workers.Wait()
+		for _, state := range r.partitionStates() {
+			if err := r.closeForShutdown(state); err != nil && r.closeErr == nil {
+				r.closeErr = err
+			}
+		}
+		r.handles.closeAll()
+	})
+	return r.closeErr
+}
+
+// closeForShutdown waits for a partition's append in progress, acknowledges
+// pending group commits and closes its writer
+func (r *FileStorageRepository) closeForShutdown(state *partitionState) error {
+	state.appendMu.Lock()
+	defer state.appendMu.Unlock()
+	if r.commits != nil {
+		r.commits.commit()
+	}
+	return closeWriter(state)
+}
+
+// closePartitionWriter flushes, syncs and closes a partition's active writer
+func closePartitionWriter(state *partitionState) error {
+	state.appendMu.Lock()
+	defer state.appendMu.Unlock()
+	return closeWriter(state)
+}
+
+// closeWriter is closePartitionWriter for callers holding state.appendMu
+func closeWriter(state *partitionState) error {
+	writer := state.writer
+	if writer == nil {
+		return nil
+	}
+	state.writer = nil
+	// Nothing is left to the OS on a clean shutdown
+	err := writer.store.Flush()
+	if syncErr := writer.sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := writer.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkAppend verifies the entries just appended to a segment: the index must
+// end with the batch's last offset, pointing at a valid frame that ends where
+// the store file does. It costs the same whatever the segment's size.
+func (r *FileStorageRepository) checkAppend(writer *segmentWriter) error {
+	seg := writer.seg
+	count := int64(seg.NextOffset - seg.BaseOffset)
+	entry, err := readIndexEntry(writer.indexFile, seg, count-1)
+	if err != nil {
+		return fmt.Errorf("inconsistency: index has fewer than %d entries: %v", count, err)
+	}
+	// The slot after the batch is preallocated space or the end of the file
+	if next, err := readIndexEntry(writer.indexFile, seg, count); err == nil && next != (indexEntry{}) {
+		return fmt.Errorf("inconsistency: index has entries past offset %d", seg.NextOffset-1)
+	}
+	if entry.Offset != seg.NextOffset-1 {
+		return fmt.Errorf("inconsistency: last index entry has offset %d, expected %d", entry.Offset, seg.NextOffset-1)
+	}
+	stat, err := writer.storeFile.Stat()
+	if err != nil {
+		return err
+	}
+	end, ok := validIndexEntry(seg, writer.storeFile, stat.Size(), count-1, entry)
+	if !ok {
+		return fmt.Errorf("inconsistency: last index entry points at an invalid frame at position %d", entry.Position)
+	}
+	if end != stat.Size() || end != writer.storeSize {
+		return fmt.Errorf("inconsistency: last frame ends at %d, store size is %d", end, stat.Size())
+	}
 	return nil
 }
 
-// sanityCheck verifies store and index consistency for a segment
+// sanityCheck verifies a whole segment: every frame must be valid and every
+// index entry must point at the next frame in order
 func (r *FileStorageRepository) sanityCheck(seg *entity.Segment) error {
 	if seg == nil || seg.StorePath == "" || seg.IndexPath == "" {
 		return errors.New("invalid segment")
@@ -342,57 +1086,151 @@ func (r *FileStorageRepository) sanityCheck(seg *entity.Segment) error {
 		return err
 	}
 	defer storeFile.Close()
-
 	indexFile, err := os.Open(seg.IndexPath)
 	if err != nil {
 		return err
 	}
 	defer indexFile.Close()
+	return verifySegment(seg, storeFile, indexFile)
+}
 
-	storeCount := uint64(0)
-	pos := int64(0)
-	for {
-		var length uint32
-		if err := binary.Read(storeFile, binary.BigEndian, &length); err != nil {
-			break
+// verifySegment runs the checks of sanityCheck on open segment files
+func verifySegment(seg *entity.Segment, storeFile, indexFile *os.File) error {
+	positions := []int64{}
+	batched := map[int]uint64{} // Offsets of records in batch frames by index entry
+	err := walkFrames(storeFile, seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+		if isBatchFrame(body) {
+			offsets, err := batchOffsets(body)
+			if err != nil {
+				return err
+			}
+			for _, offset := range offsets {
+				batched[len(positions)] = offset
+				positions = append(positions, position)
+			}
+			return nil
+		}
+		positions = append(positions, position)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := readIndexFile(indexFile, seg)
+	if err != nil {
+		return err
+	}
+	if len(positions) != len(entries) {
+		return fmt.Errorf("inconsistency: store has %d, index has %d", len(positions), len(entries))
+	}
+	for i, entry := range entries {
+		if int64(entry.Position) != positions[i] {
+			return fmt.Errorf("inconsistency: index entry %d points at %d, frame is at %d", i, entry.Position, positions[i])
+		}
+		if !seg.Compacted && entry.Offset != seg.BaseOffset+uint64(i) {
+			return fmt.Errorf("inconsistency: index entry %d has offset %d, expected %d", i, entry.Offset, seg.BaseOffset+uint64(i))
+		}
+		if offset, inBatch := batched[i]; inBatch && entry.Offset != offset {
+			return fmt.Errorf("inconsistency: index entry %d has offset %d, its batch holds %d", i, entry.Offset, offset)
+		}
+		if i > 0 && entry.Offset <= entries[i-1].Offset {
+			return fmt.Errorf("inconsistency: index entry %d has offset %d after %d", i, entry.Offset, entries[i-1].Offset)
+		}
+	}
+	return nil
+}
+
+// scanStoreFrames walks a store file from start and returns the position of
+// every record in a valid frame, repeated for each record of a batch frame.
+// Scanning stops at the first frame that is torn or fails validation, which
+// is reported as a *CorruptRecordError.
+func scanStoreFrames(storePath string, start int64) ([]int64, error) {
+	positions := []int64{}
+	err := walkStoreFrames(storePath, start, func(position int64, body []byte) error {
+		for i := frameRecordCount(body); i > 0; i-- {
+			positions = append(positions, position)
 		}
-		pos += 4 + int64(length)
-		storeFile.Seek(pos, 0)
-		storeCount++
+		return nil
+	})
+	return positions, err
+}
+
+// walkStoreFrames calls fn with the position and body of every valid frame
+// in a store file, starting at start
+func walkStoreFrames(storePath string, start int64, fn func(position int64, body []byte) error) error {
+	storeFile, err := os.Open(storePath)
+	if err != nil {
+		return err
+	}
+	defer storeFile.Close()
+	return walkFrames(storeFile, storePath, start, fn)
+}
+
+// walkFrames is walkStoreFrames on an open store file. It reads with ReadAt,
+// so the file may be shared.
+func walkFrames(storeFile *os.File, storePath string, start int64, fn func(position int64, body []byte) error) error {
+	stat, err := storeFile.Stat()
+	if err != nil {
+		return err
 	}
 
-	indexCount := uint64(0)
+	reader := bufio.NewReader(io.NewSectionReader(storeFile, start, stat.Size()-start))
+	pos := start
 	for {
-		var offset, position uint64
-		if err := binary.Read(indexFile, binary.BigEndian, &offset); err != nil {
-			break
+		body, err := readFrame(reader, stat.Size()-pos)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &CorruptRecordError{Path: storePath, Position: pos, Reason: err.Error()}
 		}
-		if err := binary.Read(indexFile, binary.BigEndian, &position); err != nil {
-			break
+		if err := checkRecordFrame(body); err != nil {
+			return &CorruptRecordError{Path: storePath, Position: pos, Reason: err.Error()}
 		}
-		indexCount++
+		if err := fn(pos, body); err != nil {
+			return err
+		}
+		pos += frameLengthSize + int64(len(body))
 	}
+}
 
-	if storeCount != indexCount {
-		return fmt.Errorf("inconsistency: store has %d, index has %d", storeCount, indexCount)
+// requestRepair queues a partition for the repair worker. The request is
+// dropped if the queue is full, as a repair is pending then anyway. The
+// channel is never closed, so this is safe during and after Close.
+func (r *FileStorageRepository) requestRepair(partitionKey string) {
+	select {
+	case r.repairChan <- partitionKey:
+	default:
 	}
-	return nil
 }
 
-// repairWorker listens for repair requests and fixes inconsistencies
+// repairWorker listens for repair requests and fixes inconsistencies until
+// the repository is closed
 func (r *FileStorageRepository) repairWorker() {
-	for partitionKey := range r.repairChan {
-		r.mu.Lock()
-		partition, exists := r.partitions[partitionKey]
-		if !exists {
-			r.mu.Unlock()
-			continue
-		}
-		// Check each segment
-		for _, seg := range partition.Segments {
-			r.repairSegment(seg)
+	for {
+		select {
+		case partitionKey := <-r.repairChan:
+			r.repairPartition(partitionKey)
+		case <-r.done:
+			return
 		}
-		r.mu.Unlock()
+	}
+}
+
+// repairPartition repairs every segment of a partition
+func (r *FileStorageRepository) repairPartition(partitionKey string) {
+	state, err := r.lookupPartition(partitionKey)
+	if err != nil {
+		return
+	}
+	// Only appends to the partition being repaired wait
+	state.appendMu.Lock()
+	defer state.appendMu.Unlock()
+	if state.deleted {
+		return
+	}
+	for _, seg := range state.Segments {
+		r.repairSegment(seg)
 	}
 }
 
@@ -402,71 +1240,50 @@ func (r *FileStorageRepository) repairSegment(seg *entity.Segment) {
 		log.Printf("Invalid segment for repair")
 		return
 	}
-	storeFile, err := os.Open(seg.StorePath)
-	if err != nil {
-		log.Printf("Failed to open store file for repair: %v", err)
-		return
-	}
-	defer storeFile.Close()
-
 	indexFile, err := os.OpenFile(seg.IndexPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		log.Printf("Failed to open index file for repair: %v", err)
 		return
 	}
 	defer indexFile.Close()
+	if err := ensureSegmentHeader(indexFile, seg, indexMagic); err != nil {
+		log.Printf("Failed to write index header for repair: %v", err)
+		return
+	}
 
 	// Count index entries
-	indexCount := uint64(0)
-	for {
-		var offset, position uint64
-		if err := binary.Read(indexFile, binary.BigEndian, &offset); err != nil {
-			break
-		}
-		if err := binary.Read(indexFile, binary.BigEndian, &position); err != nil {
-			break
-		}
-		indexCount++
+	count, err := indexEntryCount(indexFile, seg)
+	if err != nil {
+		log.Printf("Failed to read index file for repair: %v", err)
+		return
 	}
+	indexCount := uint64(count)
 
-	// Count store entries
-	storeCount := uint64(0)
-	pos := int64(0)
-	for {
-		var length uint32
-		if err := binary.Read(storeFile, binary.BigEndian, &length); err != nil {
-			break
-		}
-		pos += 4 + int64(length)
-		storeFile.Seek(pos, 0)
-		storeCount++
+	// Collect valid store frames; corrupt records are never indexed
+	positions, err := scanStoreFrames(seg.StorePath, headerSize(seg))
+	if err != nil {
+		log.Printf("Corruption detected while repairing segment %s: %v", seg.StorePath, err)
 	}
+	storeCount := uint64(len(positions))
 
+	if storeCount > indexCount && seg.Compacted {
+		log.Printf("Cannot repair compacted segment %s: store has %d, index has %d", seg.StorePath, storeCount, indexCount)
+		return
+	}
 	if storeCount > indexCount {
 		log.Printf("Repairing segment %s: store has %d, index has %d", seg.StorePath, storeCount, indexCount)
-		// Append missing index entries
-		storeFile.Seek(0, 0)
-		pos = 0
-		for i := uint64(0); i < storeCount; i++ {
-			var length uint32
-			binary.Read(storeFile, binary.BigEndian, &length)
-			// Skip data
-			storeFile.Seek(int64(length), 1)
-			if i >= indexCount {
-				// Append to index
-				offset := seg.BaseOffset + i
-				if err := binary.Write(indexFile, binary.BigEndian, offset); err != nil {
-					log.Printf("Failed to write offset to index: %v", err)
-					break
-				}
-				if err := binary.Write(indexFile, binary.BigEndian, uint64(pos)); err != nil {
-					log.Printf("Failed to write position to index: %v", err)
-					break
-				}
-				indexFile.Sync()
-			}
-			pos += 4 + int64(length)
+		// Write the missing entries over any partially written one. The file
+		// is not truncated, since readers may have it mapped.
+		var entries bytes.Buffer
+		for i := indexCount; i < storeCount; i++ {
+			binary.Write(&entries, binary.BigEndian, seg.BaseOffset+i)
+			binary.Write(&entries, binary.BigEndian, uint64(positions[i]))
 		}
+		if _, err := indexFile.WriteAt(entries.Bytes(), headerSize(seg)+int64(indexCount*indexEntrySize)); err != nil {
+			log.Printf("Failed to write entries to index: %v", err)
+			return
+		}
+		indexFile.Sync()
 		log.Printf("Repair completed for segment %s", seg.StorePath)
 	}
-}
\ No newline at end of file
+}
@@ -1,12 +1,18 @@
 package repository
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"gostorelog/internal/entity"
 )
@@ -56,6 +62,1854 @@ func TestFileStorageRepository_AppendAndRead(t *testing.T) {
 	t.Logf("TestFileStorageRepository_AppendAndRead passed: append and read work correctly")
 }
 
+func TestFileStorageRepository_RecordMetadata(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024,
+	}
+	repo := NewFileStorageRepository(config)
+
+	before := time.Now()
+	record := &entity.Record{
+		Data:         []byte(`{"status":"shipped"}`),
+		DataType:     entity.DataTypeJSON,
+		PartitionKey: "test-partition",
+		Key:          "order-42",
+		Headers:      map[string][]byte{"trace-id": []byte("abc123"), "empty": {}},
+	}
+	if err := repo.Append(record); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Reload from disk to make sure metadata is persisted
+	reloaded := NewFileStorageRepository(config)
+	readRecord, err := reloaded.Read("test-partition", 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if readRecord.Key != "order-42" {
+		t.Errorf("Expected key 'order-42', got %q", readRecord.Key)
+	}
+	if string(readRecord.Headers["trace-id"]) != "abc123" || len(readRecord.Headers) != 2 {
+		t.Errorf("Expected headers to round-trip, got %v", readRecord.Headers)
+	}
+	if readRecord.Timestamp.Before(before) || !readRecord.Timestamp.Equal(record.Timestamp) {
+		t.Errorf("Expected append timestamp %v, got %v", record.Timestamp, readRecord.Timestamp)
+	}
+	if string(readRecord.Data) != `{"status":"shipped"}` {
+		t.Errorf("Expected data to round-trip, got %s", string(readRecord.Data))
+	}
+
+	// Keys and headers count towards the segment size, so batches of
+	// records with large metadata roll segments before MaxFileSize
+	batch := []*entity.Record{}
+	for i := 0; i < 2; i++ {
+		batch = append(batch, &entity.Record{
+			Data:         []byte("x"),
+			DataType:     entity.DataTypeBytes,
+			PartitionKey: "metadata-partition",
+			Key:          strings.Repeat("k", 200),
+			Headers:      map[string][]byte{"trace-id": []byte(strings.Repeat("h", 100))},
+		})
+	}
+	for i := 0; i < 6; i++ {
+		if err := repo.AppendBatch(batch); err != nil {
+			t.Fatalf("AppendBatch failed: %v", err)
+		}
+	}
+	for _, seg := range repo.partitions["metadata-partition"].Segments {
+		stat, err := os.Stat(seg.StorePath)
+		if err != nil {
+			t.Fatalf("Stat %s failed: %v", seg.StorePath, err)
+		}
+		if uint64(stat.Size()) > config.MaxFileSize {
+			t.Errorf("Expected %s within %d bytes, got %d", seg.StorePath, config.MaxFileSize, stat.Size())
+		}
+	}
+	t.Logf("TestFileStorageRepository_RecordMetadata passed: timestamp, key and headers persisted and counted")
+}
+
+func TestFileStorageRepository_AppendBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024,
+	}
+	repo := NewFileStorageRepository(config)
+
+	if err := repo.Append(&entity.Record{Data: []byte("single"), DataType: entity.DataTypeBytes, PartitionKey: "test-partition"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	records := []*entity.Record{}
+	for i := 0; i < 5; i++ {
+		records = append(records, &entity.Record{
+			Data:         []byte(fmt.Sprintf("batch-%d", i)),
+			DataType:     entity.DataTypeBytes,
+			PartitionKey: "test-partition",
+		})
+	}
+	if err := repo.AppendBatch(records); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i, record := range records {
+		if record.Offset != uint64(i+1) {
+			t.Errorf("Expected offset %d, got %d", i+1, record.Offset)
+		}
+		readRecord, err := repo.Read("test-partition", record.Offset)
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", record.Offset, err)
+		}
+		if string(readRecord.Data) != fmt.Sprintf("batch-%d", i) {
+			t.Errorf("Expected batch-%d, got %s", i, string(readRecord.Data))
+		}
+	}
+
+	// Mixed partitions are rejected without writing anything
+	mixed := []*entity.Record{
+		{Data: []byte("a"), DataType: entity.DataTypeBytes, PartitionKey: "test-partition"},
+		{Data: []byte("b"), DataType: entity.DataTypeBytes, PartitionKey: "other-partition"},
+	}
+	if err := repo.AppendBatch(mixed); err == nil {
+		t.Errorf("Expected error for mixed partition batch")
+	}
+	if next := repo.partitions["test-partition"].CurrentOffset; next != 6 {
+		t.Errorf("Expected next offset 6, got %d", next)
+	}
+
+	// Offsets survive a reload
+	reloaded := NewFileStorageRepository(config)
+	if _, err := reloaded.Read("test-partition", 5); err != nil {
+		t.Fatalf("Read after reload failed: %v", err)
+	}
+	t.Logf("TestFileStorageRepository_AppendBatch passed: batch written with contiguous offsets")
+}
+
+func TestFileStorageRepository_Scan(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 100, // Small size so the scan crosses segments
+	}
+	repo := NewFileStorageRepository(config)
+	for i := 0; i < 20; i++ {
+		record := &entity.Record{
+			Data:         []byte(fmt.Sprintf("record-%02d", i)),
+			DataType:     entity.DataTypeBytes,
+			PartitionKey: "test-partition",
+		}
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append %d failed: %v", i, err)
+		}
+	}
+	if len(repo.partitions["test-partition"].Segments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(repo.partitions["test-partition"].Segments))
+	}
+
+	scan := func(from uint64, opts ScanOptions) []uint64 {
+		offsets := []uint64{}
+		err := repo.Scan("test-partition", from, opts, func(record *entity.Record) error {
+			if string(record.Data) != fmt.Sprintf("record-%02d", record.Offset) {
+				t.Errorf("Offset %d has data %s", record.Offset, string(record.Data))
+			}
+			offsets = append(offsets, record.Offset)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Scan from %d failed: %v", from, err)
+		}
+		return offsets
+	}
+
+	if offsets := scan(0, ScanOptions{}); len(offsets) != 20 || offsets[19] != 19 {
+		t.Errorf("Expected all 20 offsets in order, got %v", offsets)
+	}
+	if offsets := scan(5, ScanOptions{MaxCount: 7}); len(offsets) != 7 || offsets[0] != 5 || offsets[6] != 11 {
+		t.Errorf("Expected offsets 5-11, got %v", offsets)
+	}
+	// Each record carries 9 data bytes
+	if offsets := scan(3, ScanOptions{MaxBytes: 30}); len(offsets) != 3 {
+		t.Errorf("Expected 3 records within 30 bytes, got %v", offsets)
+	}
+	if offsets := scan(3, ScanOptions{MaxBytes: 1}); len(offsets) != 1 {
+		t.Errorf("Expected the first record even above max bytes, got %v", offsets)
+	}
+	if offsets := scan(20, ScanOptions{}); len(offsets) != 0 {
+		t.Errorf("Expected no records past the end, got %v", offsets)
+	}
+	t.Logf("TestFileStorageRepository_Scan passed: scan crosses segments and honors limits")
+}
+
+func TestFileStorageRepository_WaitForOffset(t *testing.T) {
+	dir := t.TempDir()
+
+	repo := NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+
+	// Nothing is written in time
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := repo.WaitForOffset(ctx, "test-partition", 0); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+
+	// A waiter is released by a later append
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- repo.WaitForOffset(ctx, "test-partition", 1)
+	}()
+	for i := 0; i < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if err := repo.Append(&entity.Record{Data: []byte("tail"), DataType: entity.DataTypeBytes, PartitionKey: "test-partition"}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Expected waiter to be released, got %v", err)
+	}
+
+	// Existing offsets return immediately
+	if err := repo.WaitForOffset(context.Background(), "test-partition", 0); err != nil {
+		t.Fatalf("Expected no wait for existing offset, got %v", err)
+	}
+	t.Logf("TestFileStorageRepository_WaitForOffset passed: waiters released by appends")
+}
+
+func TestFileStorageRepository_Retention(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 100, // Small size so records spread over several segments
+		PartitionRetention: map[string]entity.RetentionPolicy{
+			"by-age":  {MaxAge: time.Hour},
+			"by-size": {MaxBytes: 300},
+		},
+	}
+	repo := NewFileStorageRepository(config)
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 20; i++ {
+		for _, key := range []string{"by-age", "by-size", "kept"} {
+			record := &entity.Record{Data: []byte(fmt.Sprintf("record-%02d", i)), DataType: entity.DataTypeBytes, PartitionKey: key}
+			if key == "by-age" && i < 10 {
+				record.Timestamp = old
+			}
+			if err := repo.Append(record); err != nil {
+				t.Fatalf("Append %d to %s failed: %v", i, key, err)
+			}
+		}
+	}
+
+	repo.enforceRetention(time.Now())
+
+	// Every record older than an hour is in a segment before offset 10
+	ageEarliest := repo.partitions["by-age"].EarliestOffset()
+	if ageEarliest == 0 || ageEarliest > 10 {
+		t.Fatalf("Expected old segments of by-age to be deleted, earliest offset is %d", ageEarliest)
+	}
+	if _, err := repo.Read("by-age", 10); err != nil {
+		t.Fatalf("Read of unexpired record failed: %v", err)
+	}
+	_, err := repo.Read("by-age", 0)
+	var rangeErr *OffsetOutOfRangeError
+	if !errors.As(err, &rangeErr) || rangeErr.EarliestOffset != ageEarliest || !errors.Is(err, entity.ErrOutOfRange) {
+		t.Fatalf("Expected out of range error with earliest offset %d, got %v", ageEarliest, err)
+	}
+	if err := repo.Scan("by-age", 0, ScanOptions{}, func(*entity.Record) error { return nil }); !errors.As(err, &rangeErr) {
+		t.Fatalf("Expected scan below earliest offset to fail, got %v", err)
+	}
+
+	sizeEarliest := repo.partitions["by-size"].EarliestOffset()
+	if sizeEarliest == 0 {
+		t.Fatalf("Expected oldest segments of by-size to be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "by-size", "segment_0.store")); !os.IsNotExist(err) {
+		t.Errorf("Expected segment_0.store to be deleted, got %v", err)
+	}
+	total := uint64(0)
+	for _, seg := range orderedSegments(repo.partitions["by-size"].Partition) {
+		total += segmentDiskSize(seg)
+	}
+	if total > 300 {
+		t.Errorf("Expected by-size to hold at most 300 bytes, holds %d", total)
+	}
+
+	if earliest := repo.partitions["kept"].EarliestOffset(); earliest != 0 {
+		t.Errorf("Expected partition without retention to keep offset 0, earliest is %d", earliest)
+	}
+
+	// Offsets continue after a reload
+	reloaded := NewFileStorageRepository(config)
+	partition := reloaded.partitions["by-size"]
+	if partition.EarliestOffset() != sizeEarliest || partition.CurrentOffset != 20 {
+		t.Fatalf("Expected offsets %d-19 after reload, got earliest %d next %d", sizeEarliest, partition.EarliestOffset(), partition.CurrentOffset)
+	}
+	record := &entity.Record{Data: []byte("after-reload"), DataType: entity.DataTypeBytes, PartitionKey: "by-size"}
+	if err := reloaded.Append(record); err != nil || record.Offset != 20 {
+		t.Fatalf("Expected append after reload at offset 20, got %d (%v)", record.Offset, err)
+	}
+	t.Logf("TestFileStorageRepository_Retention passed: expired segments deleted and reads below earliest offset rejected")
+}
+
+func TestFileStorageRepository_Compaction(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:            dir,
+		MaxFileSize:        155, // Five records per segment
+		PartitionRetention: map[string]entity.RetentionPolicy{"changelog": {Compact: true, TombstoneRetention: time.Hour}},
+	}
+	repo := NewFileStorageRepository(config)
+	appendRecord := func(record *entity.Record) {
+		record.PartitionKey = "changelog"
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	// Offsets 0-29 cycle through keys k0, k1 and k2
+	for i := 0; i < 30; i++ {
+		appendRecord(&entity.Record{Data: []byte(fmt.Sprintf("v-%02d", i)), DataType: entity.DataTypeString, Key: fmt.Sprintf("k%d", i%3)})
+	}
+	// Offset 30 deletes k1 long ago, offset 31 deletes k3 just now
+	expired, _ := entity.NewTombstone("k1", "changelog")
+	expired.Timestamp = time.Now().Add(-2 * time.Hour)
+	appendRecord(expired)
+	recent, _ := entity.NewTombstone("k3", "changelog")
+	appendRecord(recent)
+	for i := 32; i < 40; i++ {
+		appendRecord(&entity.Record{Data: []byte(fmt.Sprintf("x-%02d", i)), DataType: entity.DataTypeString})
+	}
+
+	repo.enforceRetention(time.Now())
+
+	check := func(repo *FileStorageRepository) {
+		for _, offset := range []uint64{4, 27, 29, 33} {
+			if _, err := repo.Read("changelog", offset); err != nil {
+				t.Errorf("Expected offset %d to survive compaction, got %v", offset, err)
+			}
+		}
+		for _, offset := range []uint64{0, 3, 26, 30} {
+			if _, err := repo.Read("changelog", offset); err == nil {
+				t.Errorf("Expected offset %d to be compacted away", offset)
+			}
+		}
+		if record, err := repo.Read("changelog", 31); err != nil || !record.IsTombstone() {
+			t.Errorf("Expected recent tombstone at offset 31, got %v (%v)", record, err)
+		}
+		offsets := []uint64{}
+		err := repo.Scan("changelog", 1, ScanOptions{}, func(record *entity.Record) error {
+			offsets = append(offsets, record.Offset)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(offsets) == 0 || offsets[0] != 4 || offsets[len(offsets)-1] != 39 || len(offsets) >= 39 {
+			t.Errorf("Expected a sparse scan from 4 to 39, got %v", offsets)
+		}
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] <= offsets[i-1] {
+				t.Errorf("Scan offsets out of order: %v", offsets)
+			}
+		}
+		// Time indexes only point at surviving records
+		for _, seg := range repo.partitions["changelog"].Segments {
+			file, err := os.Open(seg.TimeIndexPath)
+			if err != nil {
+				t.Fatalf("Open time index failed: %v", err)
+			}
+			count, _ := timeIndexEntryCount(file)
+			for slot := int64(0); slot < count; slot++ {
+				entry, err := readTimeIndexEntry(file, slot)
+				if err != nil {
+					t.Fatalf("Read time index entry failed: %v", err)
+				}
+				if _, err := repo.Read("changelog", entry.Offset); err != nil {
+					t.Errorf("Time index of segment %d points at removed offset %d", seg.BaseOffset, entry.Offset)
+				}
+			}
+			file.Close()
+		}
+	}
+	check(repo)
+
+	// Offsets and sparse indexes survive a reload
+	reloaded := NewFileStorageRepository(config)
+	if next := reloaded.partitions["changelog"].CurrentOffset; next != 40 {
+		t.Fatalf("Expected next offset 40 after reload, got %d", next)
+	}
+	check(reloaded)
+
+	// A compacted index left behind by a failed swap is put in place on load
+	first := reloaded.partitions["changelog"].Segments[0]
+	compacted, err := os.ReadFile(first.IndexPath)
+	if err != nil {
+		t.Fatalf("Read index failed: %v", err)
+	}
+	os.WriteFile(first.IndexPath+compactSuffix, compacted, 0644)
+	os.WriteFile(first.IndexPath, compacted[:segmentHeaderSize], 0644)
+	recovered := NewFileStorageRepository(config)
+	if _, err := os.Stat(first.IndexPath + compactSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected leftover compacted index to be renamed, got %v", err)
+	}
+	check(recovered)
+	t.Logf("TestFileStorageRepository_Compaction passed: superseded records removed with offsets preserved")
+}
+
+func TestFileStorageRepository_GroupCommit(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:             dir,
+		MaxFileSize:         1024 * 1024,
+		Durability:          entity.DurabilityGroup,
+		GroupCommitInterval: 20 * time.Millisecond,
+	}
+	repo := NewFileStorageRepository(config)
+
+	// Concurrent appenders share fsyncs
+	const appenders = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, appenders)
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- repo.Append(&entity.Record{Data: []byte(fmt.Sprintf("record-%d", i)), DataType: entity.DataTypeString, PartitionKey: "test-partition"})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if repo.commits.commits == 0 || repo.commits.commits >= appenders {
+		t.Errorf("Expected appends to share fsyncs, got %d commits for %d appends", repo.commits.commits, appenders)
+	}
+	t.Logf("%d appends acknowledged after %d fsyncs", appenders, repo.commits.commits)
+
+	// A full group is committed without waiting for the interval
+	config.GroupCommitRecords = 5
+	config.GroupCommitInterval = time.Hour
+	repo = NewFileStorageRepository(config)
+	start := time.Now()
+	records := make([]*entity.Record, 5)
+	for i := range records {
+		records[i] = &entity.Record{Data: []byte("batch"), DataType: entity.DataTypeString, PartitionKey: "test-partition"}
+	}
+	if err := repo.AppendBatch(records); err != nil {
+		t.Fatalf("AppendBatch failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("Expected full group to commit immediately, took %v", elapsed)
+	}
+	if _, err := NewFileStorageRepository(config).Read("test-partition", appenders+4); err != nil {
+		t.Fatalf("Read after group commit failed: %v", err)
+	}
+	t.Logf("TestFileStorageRepository_GroupCommit passed: concurrent appends acknowledged after shared fsyncs")
+}
+
+func TestFileStorageRepository_DurabilityOS(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{DataDir: dir, MaxFileSize: 1024 * 1024, Durability: entity.DurabilityOS}
+	repo := NewFileStorageRepository(config)
+	for i := 0; i < 10; i++ {
+		if err := repo.Append(&entity.Record{Data: []byte("os"), DataType: entity.DataTypeString, PartitionKey: "test-partition"}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	// Records are readable before any fsync
+	if _, err := repo.Read("test-partition", 9); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if next := NewFileStorageRepository(config).partitions["test-partition"].CurrentOffset; next != 10 {
+		t.Fatalf("Expected 10 records after reopen, got %d", next)
+	}
+	t.Logf("TestFileStorageRepository_DurabilityOS passed: records flushed on close")
+}
+
+func TestFileStorageRepository_CrashRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{DataDir: dir, MaxFileSize: 1024 * 1024}
+	repo := NewFileStorageRepository(config)
+	for _, partitionKey := range []string{"torn-tail", "dangling-index", "missing-index"} {
+		for i := 0; i < 10; i++ {
+			record := &entity.Record{Data: []byte(fmt.Sprintf("record-%d", i)), DataType: entity.DataTypeString, PartitionKey: partitionKey}
+			if err := repo.Append(record); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+	}
+	repo.Close()
+	segmentPath := func(partitionKey, ext string) string {
+		return filepath.Join(dir, partitionKey, "segment_0"+ext)
+	}
+	sizeOf := func(path string) int64 {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat %s failed: %v", path, err)
+		}
+		return stat.Size()
+	}
+
+	// A partial frame in the store and a partial entry in the index
+	tornStoreSize := sizeOf(segmentPath("torn-tail", ".store"))
+	store, _ := os.OpenFile(segmentPath("torn-tail", ".store"), os.O_APPEND|os.O_WRONLY, 0644)
+	store.Write([]byte{0, 0, 0, 40, 0xc1, 1, 2})
+	store.Close()
+	index, _ := os.OpenFile(segmentPath("torn-tail", ".index"), os.O_APPEND|os.O_WRONLY, 0644)
+	index.Write(make([]byte, 8))
+	index.Close()
+
+	// The store lost the end of its last record but the index kept its entry
+	os.Truncate(segmentPath("dangling-index", ".store"), sizeOf(segmentPath("dangling-index", ".store"))-3)
+
+	// The index is gone entirely
+	os.Remove(segmentPath("missing-index", ".index"))
+
+	reloaded := NewFileStorageRepository(config)
+	expectNext := map[string]uint64{"torn-tail": 10, "dangling-index": 9, "missing-index": 10}
+	for partitionKey, next := range expectNext {
+		partition := reloaded.partitions[partitionKey]
+		if partition == nil || partition.CurrentOffset != next {
+			t.Fatalf("Expected partition %s to recover to next offset %d, got %+v", partitionKey, next, partition)
+		}
+		if _, err := reloaded.Read(partitionKey, next-1); err != nil {
+			t.Errorf("Read of last recovered record in %s failed: %v", partitionKey, err)
+		}
+		// Appends continue right after the recovered records
+		record := &entity.Record{Data: []byte("after-recovery"), DataType: entity.DataTypeString, PartitionKey: partitionKey}
+		if err := reloaded.Append(record); err != nil || record.Offset != next {
+			t.Errorf("Expected append to %s at offset %d, got %d (%v)", partitionKey, next, record.Offset, err)
+		}
+		if read, err := reloaded.Read(partitionKey, next); err != nil || string(read.Data) != "after-recovery" {
+			t.Errorf("Read after recovery in %s returned %v (%v)", partitionKey, read, err)
+		}
+	}
+	if _, err := reloaded.Read("torn-tail", 9); err != nil {
+		t.Errorf("Expected torn-tail records to survive, got %v", err)
+	}
+	if size := sizeOf(segmentPath("torn-tail", ".store")); size <= tornStoreSize {
+		t.Errorf("Expected appended record after recovered store of %d bytes, size is %d", tornStoreSize, size)
+	}
+	// Closing trims the preallocated index
+	reloaded.Close()
+	if size := sizeOf(segmentPath("missing-index", ".index")); size != segmentHeaderSize+11*indexEntrySize {
+		t.Errorf("Expected rebuilt index with 11 entries, size is %d", size)
+	}
+	t.Logf("TestFileStorageRepository_CrashRecovery passed: torn tails truncated and missing index rebuilt")
+}
+
+func TestFileStorageRepository_ReloadSegmentOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{DataDir: dir, MaxFileSize: 145} // Five records per segment
+	repo := NewFileStorageRepository(config)
+	for i := 0; i < 50; i++ {
+		record := &entity.Record{Data: []byte(fmt.Sprintf("r-%02d", i)), DataType: entity.DataTypeString, PartitionKey: "test-partition"}
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	repo.Close()
+
+	// segment_10 sorts before segment_5 by name
+	reloaded := NewFileStorageRepository(config)
+	partition := reloaded.partitions["test-partition"]
+	for i := 1; i < len(partition.Segments); i++ {
+		if partition.Segments[i].BaseOffset <= partition.Segments[i-1].BaseOffset {
+			t.Fatalf("Segments out of order after reload at %d: %d after %d", i, partition.Segments[i].BaseOffset, partition.Segments[i-1].BaseOffset)
+		}
+	}
+	last := partition.Segments[len(partition.Segments)-1]
+	if partition.GetActiveSegment() != last || last.BaseOffset != 45 {
+		t.Fatalf("Expected segment_45 to be active, got segment_%d", partition.GetActiveSegment().BaseOffset)
+	}
+	record := &entity.Record{Data: []byte("r-50"), DataType: entity.DataTypeString, PartitionKey: "test-partition"}
+	if err := reloaded.Append(record); err != nil || record.Offset != 50 {
+		t.Fatalf("Expected append at offset 50, got %d (%v)", record.Offset, err)
+	}
+	reloaded.Close()
+
+	// A missing segment leaves a hole, so the partition is quarantined
+	os.Remove(filepath.Join(dir, "test-partition", "segment_20.store"))
+	os.Remove(filepath.Join(dir, "test-partition", "segment_20.index"))
+	broken := NewFileStorageRepository(config)
+	if _, failed := broken.failedPartitions["test-partition"]; !failed {
+		t.Fatalf("Expected partition with missing offsets to be quarantined")
+	}
+	if err := broken.Append(&entity.Record{Data: []byte("x"), DataType: entity.DataTypeString, PartitionKey: "test-partition"}); err == nil {
+		t.Errorf("Expected append to quarantined partition to fail")
+	}
+	t.Logf("TestFileStorageRepository_ReloadSegmentOrder passed: segments ordered numerically and gaps quarantined")
+}
+
+func TestFileStorageRepository_Scrubber(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{DataDir: dir, MaxFileSize: 145} // Five records per segment
+	repo := NewFileStorageRepository(config)
+	for i := 0; i < 12; i++ {
+		record := &entity.Record{Data: []byte(fmt.Sprintf("r-%02d", i)), DataType: entity.DataTypeString, PartitionKey: "test-partition"}
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	// The closed segment_5 loses its last index entry
+	indexPath := filepath.Join(dir, "test-partition", "segment_5.index")
+	stat, _ := os.Stat(indexPath)
+	os.Truncate(indexPath, stat.Size()-indexEntrySize)
+
+	// The scrubber visits closed segments in turn and wraps around
+	cursor := repo.scrubNext(nil)
+	if cursor == nil || cursor.baseOffset != 0 {
+		t.Fatalf("Expected scrubber to start at segment_0, got %+v", cursor)
+	}
+	cursor = repo.scrubNext(cursor)
+	if cursor.baseOffset != 5 {
+		t.Fatalf("Expected scrubber to check segment_5 next, got %+v", cursor)
+	}
+	if next := repo.scrubNext(cursor); next.baseOffset != 0 {
+		t.Errorf("Expected scrubber to wrap around past the active segment, got %+v", next)
+	}
+
+	// The repair worker restores the missing entry
+	seg := repo.partitions["test-partition"].Segments[1]
+	deadline := time.Now().Add(5 * time.Second)
+	for repo.sanityCheck(seg) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected scrubber to trigger repair, still inconsistent: %v", repo.sanityCheck(seg))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Logf("TestFileStorageRepository_Scrubber passed: inconsistent closed segment repaired")
+}
+
+// Run with -race: appends, scans, compaction and scrubbing across many
+// partitions at once
+func TestFileStorageRepository_ConcurrentPartitions(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 200,
+		Durability:  entity.DurabilityOS,
+		Retention:   entity.RetentionPolicy{Compact: true, TombstoneRetention: time.Hour},
+	}
+	repo := NewFileStorageRepository(config)
+	defer repo.Close()
+
+	const partitions = 16
+	const perPartition = 200
+	const keys = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*partitions)
+	for p := 0; p < partitions; p++ {
+		partitionKey := fmt.Sprintf("partition-%02d", p)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perPartition; i++ {
+				record := &entity.Record{Data: []byte(fmt.Sprintf("r-%03d", i)), DataType: entity.DataTypeString, PartitionKey: partitionKey, Key: fmt.Sprintf("k-%d", i%keys)}
+				if err := repo.Append(record); err != nil {
+					errs <- fmt.Errorf("append to %s: %w", partitionKey, err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				last := int64(-1)
+				err := repo.Scan(partitionKey, 0, ScanOptions{}, func(record *entity.Record) error {
+					if int64(record.Offset) <= last {
+						return fmt.Errorf("offset %d after %d", record.Offset, last)
+					}
+					last = int64(record.Offset)
+					return nil
+				})
+				if err != nil && !errors.Is(err, entity.ErrNotFound) {
+					errs <- fmt.Errorf("scan of %s: %w", partitionKey, err)
+					return
+				}
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	var maintenance sync.WaitGroup
+	maintenance.Add(1)
+	go func() {
+		defer maintenance.Done()
+		var cursor *scrubCursor
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			repo.enforceRetention(time.Now())
+			cursor = repo.scrubNext(cursor)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	maintenance.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for p := 0; p < partitions; p++ {
+		partitionKey := fmt.Sprintf("partition-%02d", p)
+		latest := make(map[string]string)
+		err := repo.Scan(partitionKey, 0, ScanOptions{}, func(record *entity.Record) error {
+			latest[record.Key] = string(record.Data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Scan of %s failed: %v", partitionKey, err)
+		}
+		for i := perPartition - keys; i < perPartition; i++ {
+			if value := latest[fmt.Sprintf("k-%d", i%keys)]; value != fmt.Sprintf("r-%03d", i) {
+				t.Errorf("Expected latest value r-%03d in %s, got %q", i, partitionKey, value)
+			}
+		}
+	}
+
+	// A slow scan callback holds no lock that appends need
+	scanning := make(chan struct{})
+	release := make(chan struct{})
+	go repo.Scan("partition-00", 0, ScanOptions{MaxCount: 1}, func(*entity.Record) error {
+		close(scanning)
+		<-release
+		return nil
+	})
+	<-scanning
+	appended := make(chan error, 1)
+	go func() {
+		appended <- repo.Append(&entity.Record{Data: []byte("during-scan"), DataType: entity.DataTypeString, PartitionKey: "partition-00"})
+	}()
+	select {
+	case err := <-appended:
+		if err != nil {
+			t.Fatalf("Append during scan failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Append blocked behind a scan of the same partition")
+	}
+	close(release)
+	t.Logf("TestFileStorageRepository_ConcurrentPartitions passed: %d partitions appended, scanned and compacted concurrently", partitions)
+}
+
+func TestFileStorageRepository_MappedIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{DataDir: dir, MaxFileSize: 1024} // Room for 64 index entries
+	repo := NewFileStorageRepository(config)
+	for i := 0; i < 3; i++ {
+		record := &entity.Record{Data: []byte(fmt.Sprintf("r-%d", i)), DataType: entity.DataTypeString, PartitionKey: "test-partition"}
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	indexSize := func(base int) int64 {
+		stat, err := os.Stat(filepath.Join(dir, "test-partition", fmt.Sprintf("segment_%d.index", base)))
+		if err != nil {
+			t.Fatalf("Stat index failed: %v", err)
+		}
+		return stat.Size()
+	}
+	if size := indexSize(0); size != segmentHeaderSize+64*indexEntrySize {
+		t.Fatalf("Expected active index preallocated for 64 entries, size is %d", size)
+	}
+	for i := uint64(0); i < 3; i++ {
+		if record, err := repo.Read("test-partition", i); err != nil || string(record.Data) != fmt.Sprintf("r-%d", i) {
+			t.Fatalf("Read %d returned %v (%v)", i, record, err)
+		}
+	}
+	if _, err := repo.Read("test-partition", 3); err == nil {
+		t.Errorf("Expected preallocated entries not to be readable")
+	}
+
+	// A crash leaves the preallocated space behind; recovery trims it
+	reloaded := NewFileStorageRepository(config)
+	if next := reloaded.partitions["test-partition"].CurrentOffset; next != 3 {
+		t.Fatalf("Expected next offset 3 after reload, got %d", next)
+	}
+	if size := indexSize(0); size != segmentHeaderSize+3*indexEntrySize {
+		t.Errorf("Expected recovered index with 3 entries, size is %d", size)
+	}
+
+	// Rolling trims the old index and preallocates the new one
+	big := &entity.Record{Data: make([]byte, 1000), DataType: entity.DataTypeBytes, PartitionKey: "test-partition"}
+	if err := reloaded.Append(big); err != nil || big.Offset != 3 {
+		t.Fatalf("Expected append at offset 3, got %d (%v)", big.Offset, err)
+	}
+	if size := indexSize(0); size != segmentHeaderSize+3*indexEntrySize {
+		t.Errorf("Expected closed index with 3 entries, size is %d", size)
+	}
+	if size := indexSize(3); size != segmentHeaderSize+64*indexEntrySize {
+		t.Errorf("Expected new active index preallocated, size is %d", size)
+	}
+	if record, err := reloaded.Read("test-partition", 3); err != nil || len(record.Data) != 1000 {
+		t.Fatalf("Read of new segment returned %v (%v)", record, err)
+	}
+	reloaded.Close()
+	t.Logf("TestFileStorageRepository_MappedIndex passed: index preallocated, mapped and trimmed")
+}
+
+func TestFileStorageRepository_OffsetForTime(t *testing.T) {
+	dir := t.TempDir()
+
+	// Records a second apart across several segments; offset 4 is older than its predecessor
+	config := &entity.Config{DataDir: dir, MaxFileSize: 64}
+	repo := NewFileStorageRepository(config)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		ts := base.Add(time.Duration(i) * time.Second)
+		if i == 4 {
+			ts = base
+		}
+		record := &entity.Record{Data: []byte(fmt.Sprintf("record-%d", i)), DataType: entity.DataTypeString, PartitionKey: "test-partition", Timestamp: ts}
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if segments := len(repo.partitions["test-partition"].Segments); segments < 3 {
+		t.Fatalf("Expected several segments, got %d", segments)
+	}
+
+	cases := []struct {
+		at     time.Time
+		offset uint64
+	}{
+		{base.Add(-time.Hour), 0},
+		{base, 0},
+		{base.Add(500 * time.Millisecond), 1},
+		{base.Add(4 * time.Second), 5}, // Offset 4 never raised the newest time
+		{base.Add(5 * time.Second), 5},
+		{base.Add(9 * time.Second), 9},
+		{base.Add(time.Hour), 10},
+	}
+	check := func(repo *FileStorageRepository, stage string) {
+		for _, c := range cases {
+			offset, err := repo.OffsetForTime("test-partition", c.at)
+			if err != nil {
+				t.Fatalf("%s: OffsetForTime(%v) failed: %v", stage, c.at, err)
+			}
+			if offset != c.offset {
+				t.Errorf("%s: OffsetForTime(%v) = %d, expected %d", stage, c.at, offset, c.offset)
+			}
+		}
+	}
+	check(repo, "live")
+	if _, err := repo.OffsetForTime("missing-partition", base); err == nil {
+		t.Errorf("Expected error for a missing partition")
+	}
+	repo.Close()
+
+	reloaded := NewFileStorageRepository(config)
+	check(reloaded, "reloaded")
+	reloaded.Close()
+
+	// A lost time index is rebuilt from the records
+	if err := os.Remove(filepath.Join(dir, "test-partition", "segment_0.timeindex")); err != nil {
+		t.Fatalf("Remove time index failed: %v", err)
+	}
+	rebuilt := NewFileStorageRepository(config)
+	check(rebuilt, "rebuilt")
+	next := &entity.Record{Data: []byte("record-10"), DataType: entity.DataTypeString, PartitionKey: "test-partition", Timestamp: base.Add(time.Hour)}
+	if err := rebuilt.Append(next); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if offset, err := rebuilt.OffsetForTime("test-partition", base.Add(10*time.Second)); err != nil || offset != 10 {
+		t.Errorf("Expected offset 10 after a new append, got %d (%v)", offset, err)
+	}
+	rebuilt.Close()
+	t.Logf("TestFileStorageRepository_OffsetForTime passed: offsets resolved by time across segments, reloads and rebuilds")
+}
+
+func TestFileStorageRepository_PartitionAdmin(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:            dir,
+		MaxFileSize:        128,
+		PartitionRetention: map[string]entity.RetentionPolicy{"compacted": {Compact: true}},
+	}
+	repo := NewFileStorageRepository(config)
+	appendRange := func(repo *FileStorageRepository, partition string, from, to int, prefix string) {
+		for i := from; i < to; i++ {
+			record := &entity.Record{Data: []byte(fmt.Sprintf("%s-%d", prefix, i)), DataType: entity.DataTypeString, PartitionKey: partition, Key: fmt.Sprintf("k%d", i%3)}
+			if err := repo.Append(record); err != nil {
+				t.Fatalf("Append to %s failed: %v", partition, err)
+			}
+			if record.Offset != uint64(i) {
+				t.Fatalf("Append to %s got offset %d, expected %d", partition, record.Offset, i)
+			}
+		}
+	}
+	appendRange(repo, "orders", 0, 20, "order")
+	// Compaction keeps every record without a key
+	for i := 0; i < 20; i++ {
+		record := &entity.Record{Data: []byte(fmt.Sprintf("item-%d", i)), DataType: entity.DataTypeString, PartitionKey: "compacted"}
+		if i%2 == 1 {
+			record.Key = "odd"
+		}
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append to compacted failed: %v", err)
+		}
+	}
+	repo.failedPartitions["broken"] = errors.New("segment 0 overlaps segment 5")
+
+	// List and describe
+	infos, err := repo.ListPartitions()
+	if err != nil {
+		t.Fatalf("ListPartitions failed: %v", err)
+	}
+	if len(infos) != 3 || infos[0].Key != "broken" || infos[1].Key != "compacted" || infos[2].Key != "orders" {
+		t.Fatalf("Expected broken, compacted and orders, got %+v", infos)
+	}
+	if infos[0].Error == "" {
+		t.Errorf("Expected the failed partition to report its error")
+	}
+	orders := infos[2]
+	if orders.EarliestOffset != 0 || orders.LatestOffset == nil || *orders.LatestOffset != 19 || orders.NextOffset != 20 || orders.SegmentCount < 3 || orders.Size == 0 {
+		t.Errorf("Unexpected summary of orders: %+v", orders)
+	}
+	described, err := repo.DescribePartition("orders")
+	if err != nil {
+		t.Fatalf("DescribePartition failed: %v", err)
+	}
+	if len(described.Segments) != orders.SegmentCount || described.Size != orders.Size {
+		t.Fatalf("Describe has %d segment(s) of %d bytes, list has %d of %d", len(described.Segments), described.Size, orders.SegmentCount, orders.Size)
+	}
+	next := uint64(0)
+	for _, seg := range described.Segments {
+		if seg.BaseOffset != next || seg.Size == 0 || seg.FormatVersion != entity.SegmentFormatVersion {
+			t.Errorf("Unexpected segment %+v after offset %d", seg, next)
+		}
+		next = seg.NextOffset
+	}
+	if next != 20 || !described.Segments[len(described.Segments)-1].Active {
+		t.Errorf("Expected segments to end at 20 with the last active, got %+v", described.Segments)
+	}
+	if _, err := repo.DescribePartition("missing"); err == nil {
+		t.Errorf("Expected error describing a missing partition")
+	}
+
+	// Truncation cuts a segment short and removes the ones after it, on disk as well
+	checkTruncated := func(repo *FileStorageRepository, partition string, next uint64, prefix string) {
+		info, err := repo.DescribePartition(partition)
+		if err != nil {
+			t.Fatalf("DescribePartition failed: %v", err)
+		}
+		if info.NextOffset != next || info.LatestOffset == nil || *info.LatestOffset != next-1 {
+			t.Fatalf("Expected %s to end at %d, got %+v", partition, next, info)
+		}
+		record, err := repo.Read(partition, next-1)
+		if err != nil || string(record.Data) != fmt.Sprintf("%s-%d", prefix, next-1) {
+			t.Errorf("Read %s/%d returned %v (%v)", partition, next-1, record, err)
+		}
+		if _, err := repo.Read(partition, next); err == nil {
+			t.Errorf("Expected offset %d of %s to be gone", next, partition)
+		}
+	}
+	if err := repo.TruncatePartition("orders", 7); err != nil {
+		t.Fatalf("TruncatePartition failed: %v", err)
+	}
+	checkTruncated(repo, "orders", 8, "order")
+	if err := repo.TruncatePartition("orders", 100); err != nil {
+		t.Errorf("Expected truncating past the end to do nothing, got %v", err)
+	}
+	appendRange(repo, "orders", 8, 12, "renewed")
+	checkTruncated(repo, "orders", 12, "renewed")
+
+	// Truncate at a segment boundary
+	described, _ = repo.DescribePartition("orders")
+	boundary := described.Segments[1].BaseOffset
+	if err := repo.TruncatePartition("orders", boundary-1); err != nil {
+		t.Fatalf("TruncatePartition at boundary failed: %v", err)
+	}
+	checkTruncated(repo, "orders", boundary, "order")
+	if described, _ = repo.DescribePartition("orders"); len(described.Segments) != 1 || !described.Segments[0].Active {
+		t.Errorf("Expected one active segment after truncating at a boundary, got %+v", described.Segments)
+	}
+
+	// A compacted segment ends at its last surviving record
+	repo.enforceRetention(time.Now())
+	if described, _ = repo.DescribePartition("compacted"); !described.Segments[0].Compacted {
+		t.Fatalf("Expected the first segment of compacted to be compacted")
+	}
+	if _, err := repo.Read("compacted", 1); err == nil {
+		t.Fatalf("Expected compaction to remove offset 1")
+	}
+	if err := repo.TruncatePartition("compacted", 1); err != nil {
+		t.Fatalf("TruncatePartition of a compacted segment failed: %v", err)
+	}
+	checkTruncated(repo, "compacted", 1, "item")
+	repo.Close()
+
+	// Reloading finds the same partitions
+	repo = NewFileStorageRepository(config)
+	checkTruncated(repo, "orders", boundary, "order")
+	checkTruncated(repo, "compacted", 1, "item")
+	appendRange(repo, "orders", int(boundary), int(boundary)+3, "reloaded")
+	checkTruncated(repo, "orders", boundary+3, "reloaded")
+
+	// Deleting a partition while it is read
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				repo.Read("orders", 0)
+				repo.Scan("orders", 0, ScanOptions{}, func(*entity.Record) error { return nil })
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := repo.DeletePartition("orders"); err != nil {
+		t.Fatalf("DeletePartition failed: %v", err)
+	}
+	close(stop)
+	readers.Wait()
+	if _, err := repo.Read("orders", 0); err == nil {
+		t.Errorf("Expected reads of a deleted partition to fail")
+	}
+	if err := repo.DeletePartition("orders"); err == nil {
+		t.Errorf("Expected error deleting a missing partition")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orders")); !os.IsNotExist(err) {
+		t.Errorf("Expected the partition directory to be removed, got %v", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, deletedPartitionPrefix+"*")); len(leftovers) > 0 {
+		t.Errorf("Expected no leftover directories, got %v", leftovers)
+	}
+
+	// Appending recreates it from offset 0
+	appendRange(repo, "orders", 0, 2, "recreated")
+	repo.Close()
+	repo = NewFileStorageRepository(config)
+	defer repo.Close()
+	checkTruncated(repo, "orders", 2, "recreated")
+	t.Logf("TestFileStorageRepository_PartitionAdmin passed: partitions listed, described, truncated and deleted")
+}
+
+func TestFileStorageRepository_PartitionKeys(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "data")
+	os.MkdirAll(dir, 0755)
+
+	config := &entity.Config{DataDir: dir, MaxFileSize: 1024}
+	repo := NewFileStorageRepository(config)
+	keys := []string{"plain", "../escape", "orders/eu", "a b", "50%", "名前"}
+	for _, key := range keys {
+		if err := repo.Append(&entity.Record{Data: []byte("in " + key), DataType: entity.DataTypeString, PartitionKey: key}); err != nil {
+			t.Fatalf("Append to %q failed: %v", key, err)
+		}
+	}
+	for _, key := range []string{"bad\x00key", "\xff", strings.Repeat("/", 100)} {
+		if err := repo.Append(&entity.Record{Data: []byte("x"), DataType: entity.DataTypeString, PartitionKey: key}); !errors.Is(err, entity.ErrInvalidPartitionKey) {
+			t.Errorf("Expected Append to %q to be rejected, got %v", key, err)
+		}
+	}
+	repo.Close()
+
+	// Every partition stays a direct child of the data dir
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the data dir under %s, got %d entries", root, len(entries))
+	}
+	dirs, _ := os.ReadDir(dir)
+	if len(dirs) != len(keys) {
+		t.Errorf("Expected %d partition directories, got %d", len(keys), len(dirs))
+	}
+	// Directories that map to no key are listed as failed
+	os.MkdirAll(filepath.Join(dir, "bad\x01dir"), 0755)
+
+	repo = NewFileStorageRepository(config)
+	defer repo.Close()
+	infos, _ := repo.ListPartitions()
+	if len(infos) != len(keys)+1 {
+		t.Errorf("Expected %d partitions after reload, got %+v", len(keys)+1, infos)
+	}
+	failed := 0
+	for _, info := range infos {
+		if info.Error != "" {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected the stray directory to be listed as failed, got %+v", infos)
+	}
+	for _, key := range keys {
+		record, err := repo.Read(key, 0)
+		if err != nil || string(record.Data) != "in "+key || record.PartitionKey != key {
+			t.Errorf("Read %q after reload returned %v (%v)", key, record, err)
+		}
+	}
+	t.Logf("TestFileStorageRepository_PartitionKeys passed: unsafe keys stored inside the data dir and reloaded")
+}
+
+func TestFileStorageRepository_Compression(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:              dir,
+		MaxFileSize:          2048,
+		Compression:          entity.CompressionSnappy,
+		PartitionCompression: map[string]entity.Compression{"events": entity.CompressionGzip, "plain": entity.CompressionNone},
+		PartitionRetention:   map[string]entity.RetentionPolicy{"events": {Compact: true}},
+	}
+	payload := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"type":"page_view","user":"user-%d","path":"/products/category/item","referrer":"https://example.com/products/category","agent":"Mozilla/5.0 (X11; Linux x86_64)"}`, i, i%5))
+	}
+	appendAll := func(repo *FileStorageRepository, partition string, from, to int) {
+		for i := from; i < to; i++ {
+			record := &entity.Record{Data: payload(i), DataType: entity.DataTypeJSON, PartitionKey: partition, Key: fmt.Sprintf("k%d", i%5)}
+			if err := repo.Append(record); err != nil {
+				t.Fatalf("Append to %s failed: %v", partition, err)
+			}
+		}
+	}
+	readAll := func(repo *FileStorageRepository, partition string, count int) {
+		for i := 0; i < count; i++ {
+			record, err := repo.Read(partition, uint64(i))
+			if err != nil {
+				t.Fatalf("Read %s/%d failed: %v", partition, i, err)
+			}
+			if string(record.Data) != string(payload(i)) || record.Key != fmt.Sprintf("k%d", i%5) {
+				t.Fatalf("Read %s/%d returned %q key %q", partition, i, record.Data, record.Key)
+			}
+		}
+	}
+	storeBytes := func(partition string) int64 {
+		paths, _ := filepath.Glob(filepath.Join(dir, partition, "*.store"))
+		total := int64(0)
+		for _, path := range paths {
+			if stat, err := os.Stat(path); err == nil {
+				total += stat.Size()
+			}
+		}
+		return total
+	}
+
+	repo := NewFileStorageRepository(config)
+	for _, partition := range []string{"events", "metrics", "plain"} {
+		appendAll(repo, partition, 0, 30)
+		readAll(repo, partition, 30)
+	}
+	if plain := storeBytes("plain"); storeBytes("events") >= plain || storeBytes("metrics") >= plain {
+		t.Errorf("Expected compressed partitions to be smaller than %d bytes, got gzip %d and snappy %d", plain, storeBytes("events"), storeBytes("metrics"))
+	}
+	repo.Close()
+
+	// Switching codecs leaves earlier records readable
+	config.PartitionCompression["events"] = entity.CompressionSnappy
+	repo = NewFileStorageRepository(config)
+	appendAll(repo, "events", 30, 40)
+	readAll(repo, "events", 40)
+	codecs := map[byte]bool{}
+	for _, seg := range repo.partitions["events"].Segments {
+		walkStoreFrames(seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+			codecs[(body[0]&recordAttrCodecMask)>>recordAttrCodecShift] = true
+			return nil
+		})
+	}
+	if !codecs[codecGzip] || !codecs[codecSnappy] {
+		t.Errorf("Expected gzip and snappy records in one partition, got codecs %v", codecs)
+	}
+
+	// Compaction keeps the newest compressed record per key
+	if segments := len(repo.partitions["events"].Segments); segments < 2 {
+		t.Fatalf("Expected closed segments to compact, got %d segment(s)", segments)
+	}
+	repo.enforceRetention(time.Now())
+	if !repo.partitions["events"].Segments[0].Compacted {
+		t.Errorf("Expected the first segment to be compacted")
+	}
+	scanned := 0
+	err := repo.Scan("events", 0, ScanOptions{}, func(record *entity.Record) error {
+		if string(record.Data) != string(payload(int(record.Offset))) {
+			t.Errorf("Scan of offset %d returned %q", record.Offset, record.Data)
+		}
+		scanned++
+		return nil
+	})
+	if err != nil || scanned == 0 || scanned >= 40 {
+		t.Errorf("Expected a compacted scan, got %d record(s) (%v)", scanned, err)
+	}
+	repo.Close()
+
+	// Zstd records join the others
+	config.PartitionCompression["plain"] = entity.CompressionZstd
+	repo = NewFileStorageRepository(config)
+	appendAll(repo, "plain", 30, 40)
+	readAll(repo, "plain", 40)
+	codecs = map[byte]bool{}
+	for _, seg := range repo.partitions["plain"].Segments {
+		walkStoreFrames(seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+			codecs[(body[0]&recordAttrCodecMask)>>recordAttrCodecShift] = true
+			return nil
+		})
+	}
+	if !codecs[codecNone] || !codecs[codecZstd] {
+		t.Errorf("Expected uncompressed and zstd records in one partition, got codecs %v", codecs)
+	}
+	repo.Close()
+	t.Logf("TestFileStorageRepository_Compression passed: gzip, snappy and zstd records read back, mixed and compacted")
+}
+
+func TestFileStorageRepository_BatchCompression(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.json")
+	keys, _ := json.Marshal(map[string]interface{}{"current": "a", "keys": map[string][]byte{"a": []byte(strings.Repeat("a", 32))}})
+	if err := os.WriteFile(keyFile, keys, 0600); err != nil {
+		t.Fatalf("Write key file failed: %v", err)
+	}
+	config := &entity.Config{
+		DataDir:              dir + "/data",
+		MaxFileSize:          4096,
+		KeyFile:              keyFile,
+		Compression:          entity.CompressionZstd,
+		PartitionCompression: map[string]entity.Compression{"plain": entity.CompressionNone, "sealed": entity.CompressionGzip},
+		PartitionEncryption:  map[string]bool{"sealed": true},
+	}
+	// Records too small to compress on their own
+	payload := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"user":"user-%d"}`, i, i%3))
+	}
+	appendBatch := func(repo *FileStorageRepository, partition string, from, to int) {
+		records := []*entity.Record{}
+		for i := from; i < to; i++ {
+			records = append(records, &entity.Record{Data: payload(i), DataType: entity.DataTypeJSON, PartitionKey: partition, Key: fmt.Sprintf("k%d", i%3)})
+		}
+		if err := repo.AppendBatch(records); err != nil {
+			t.Fatalf("AppendBatch %s %d-%d failed: %v", partition, from, to, err)
+		}
+	}
+	readAll := func(repo *FileStorageRepository, partition string, count int) {
+		for i := 0; i < count; i++ {
+			record, err := repo.Read(partition, uint64(i))
+			if err != nil {
+				t.Fatalf("Read %s/%d failed: %v", partition, i, err)
+			}
+			if string(record.Data) != string(payload(i)) || record.Key != fmt.Sprintf("k%d", i%3) || record.Offset != uint64(i) {
+				t.Fatalf("Read %s/%d returned offset %d %q key %q", partition, i, record.Offset, record.Data, record.Key)
+			}
+		}
+		if _, err := repo.Read(partition, uint64(count)); !errors.Is(err, entity.ErrNotFound) {
+			t.Fatalf("Expected offset %d of %s to be missing, got %v", count, partition, err)
+		}
+	}
+	scanFrom := func(repo *FileStorageRepository, partition string, from, count int) {
+		next := from
+		err := repo.Scan(partition, uint64(from), ScanOptions{}, func(record *entity.Record) error {
+			if record.Offset != uint64(next) || string(record.Data) != string(payload(next)) {
+				t.Errorf("Scan of %s returned offset %d %q, expected %d", partition, record.Offset, record.Data, next)
+			}
+			next++
+			return nil
+		})
+		if err != nil || next != count {
+			t.Fatalf("Scan of %s from %d stopped at %d of %d: %v", partition, from, next, count, err)
+		}
+	}
+	batchFrames := func(repo *FileStorageRepository, partition string) (int, int64) {
+		frames, size := 0, int64(0)
+		for _, seg := range repo.partitions[partition].Segments {
+			if err := repo.sanityCheck(seg); err != nil {
+				t.Errorf("Segment %s is inconsistent: %v", seg.StorePath, err)
+			}
+			walkStoreFrames(seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+				if isBatchFrame(body) {
+					frames++
+				}
+				size += frameLengthSize + int64(len(body))
+				return nil
+			})
+		}
+		return frames, size
+	}
+
+	repo, err := OpenFileStorageRepository(config)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, partition := range []string{"events", "plain", "sealed"} {
+		appendBatch(repo, partition, 0, 10)
+		appendBatch(repo, partition, 10, 20)
+		appendBatch(repo, partition, 20, 30)
+		if err := repo.Append(&entity.Record{Data: payload(30), DataType: entity.DataTypeJSON, PartitionKey: partition, Key: "k0"}); err != nil {
+			t.Fatalf("Append to %s failed: %v", partition, err)
+		}
+		readAll(repo, partition, 31)
+		scanFrom(repo, partition, 5, 31)
+		scanFrom(repo, partition, 25, 31)
+	}
+	zstdFrames, zstdSize := batchFrames(repo, "events")
+	plainFrames, plainSize := batchFrames(repo, "plain")
+	sealedFrames, _ := batchFrames(repo, "sealed")
+	if zstdFrames != 3 || sealedFrames != 3 || plainFrames != 0 {
+		t.Errorf("Expected a batch frame per compressed batch, got %d zstd, %d sealed and %d plain", zstdFrames, sealedFrames, plainFrames)
+	}
+	if zstdSize >= plainSize {
+		t.Errorf("Expected batch compression to shrink small records, got %d bytes against %d", zstdSize, plainSize)
+	}
+	repo.Close()
+
+	// Reloading checks every frame and index entry
+	repo = NewFileStorageRepository(config)
+	for _, partition := range []string{"events", "sealed"} {
+		if next := repo.partitions[partition].CurrentOffset; next != 31 {
+			t.Fatalf("Expected reload of %s to keep 31 records, got %d", partition, next)
+		}
+		readAll(repo, partition, 31)
+	}
+
+	// Truncating in the middle of a batch keeps the records before the cut
+	for _, partition := range []string{"events", "sealed"} {
+		if err := repo.TruncatePartition(partition, 14); err != nil {
+			t.Fatalf("TruncatePartition %s failed: %v", partition, err)
+		}
+		readAll(repo, partition, 15)
+		scanFrom(repo, partition, 10, 15)
+		appendBatch(repo, partition, 15, 25)
+		readAll(repo, partition, 25)
+		if frames, _ := batchFrames(repo, partition); frames != 3 {
+			t.Errorf("Expected 3 batch frames in %s after truncation, got %d", partition, frames)
+		}
+	}
+	repo.Close()
+
+	// A batch whose index entries were only partly written is dropped whole
+	seg := repo.partitions["events"].Segments[len(repo.partitions["events"].Segments)-1]
+	entries, err := readIndexEntries(seg)
+	if err != nil || len(entries) != 25 {
+		t.Fatalf("Expected 25 index entries, got %d (%v)", len(entries), err)
+	}
+	if err := os.Truncate(seg.IndexPath, headerSize(seg)+22*indexEntrySize); err != nil {
+		t.Fatalf("Truncate index failed: %v", err)
+	}
+	// A missing index is rebuilt with an entry per record of every batch
+	if err := os.Remove(repo.partitions["sealed"].Segments[0].IndexPath); err != nil {
+		t.Fatalf("Remove index failed: %v", err)
+	}
+	repo = NewFileStorageRepository(config)
+	if next := repo.partitions["events"].CurrentOffset; next != 15 {
+		t.Errorf("Expected recovery to drop the torn batch, next offset %d", next)
+	}
+	readAll(repo, "events", 15)
+	readAll(repo, "sealed", 25)
+	batchFrames(repo, "sealed")
+	repo.Close()
+
+	// Compaction rewrites a batch frame with the records it keeps
+	config.MaxFileSize = 256
+	config.PartitionRetention = map[string]entity.RetentionPolicy{"keyed": {Compact: true}}
+	repo = NewFileStorageRepository(config)
+	for i := 0; i < 4; i++ {
+		appendBatch(repo, "keyed", i*10, i*10+10)
+	}
+	if segments := len(repo.partitions["keyed"].Segments); segments < 3 {
+		t.Fatalf("Expected batches to roll segments, got %d segment(s)", segments)
+	}
+	repo.enforceRetention(time.Now())
+	partial := 0
+	for _, seg := range repo.partitions["keyed"].Segments {
+		walkStoreFrames(seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+			if isBatchFrame(body) && frameRecordCount(body) < 10 {
+				partial++
+			}
+			return nil
+		})
+	}
+	if !repo.partitions["keyed"].Segments[0].Compacted || partial == 0 {
+		t.Errorf("Expected compaction to rewrite batch frames, got %d partial batch(es)", partial)
+	}
+	repo.Close()
+	repo = NewFileStorageRepository(config)
+	batchFrames(repo, "keyed")
+	kept := 0
+	for i := 0; i < 40; i++ {
+		record, err := repo.Read("keyed", uint64(i))
+		if errors.Is(err, entity.ErrNotFound) {
+			continue
+		}
+		if err != nil || string(record.Data) != string(payload(i)) {
+			t.Fatalf("Read keyed/%d after compaction returned %v: %v", i, record, err)
+		}
+		kept++
+	}
+	if kept == 0 || kept >= 40 {
+		t.Errorf("Expected compaction to keep some records, kept %d", kept)
+	}
+	err = repo.Scan("keyed", 0, ScanOptions{}, func(record *entity.Record) error {
+		if string(record.Data) != string(payload(int(record.Offset))) {
+			t.Errorf("Scan of offset %d returned %q", record.Offset, record.Data)
+		}
+		kept--
+		return nil
+	})
+	if err != nil || kept != 0 {
+		t.Errorf("Expected the scan to return the records read, %d left (%v)", kept, err)
+	}
+
+	// Replicated batches are compressed with the offsets they carry
+	replicated := func(offsets ...int) []*entity.Record {
+		records := []*entity.Record{}
+		for _, offset := range offsets {
+			records = append(records, &entity.Record{Data: payload(offset), DataType: entity.DataTypeJSON, PartitionKey: "follower", Key: fmt.Sprintf("k%d", offset%3), Offset: uint64(offset), Timestamp: time.Unix(int64(offset), 0)})
+		}
+		return records
+	}
+	if _, err := repo.AppendReplicated(replicated(0, 1, 2, 3, 4, 5), 0, false); err != nil {
+		t.Fatalf("AppendReplicated failed: %v", err)
+	}
+	// The overlap with held records is dropped before the rest is written
+	if _, err := repo.AppendReplicated(replicated(4, 5, 6, 7, 8, 9), 4, false); err != nil {
+		t.Fatalf("AppendReplicated with overlap failed: %v", err)
+	}
+	// Offsets the leader compacted away leave holes in one batch
+	if _, err := repo.AppendReplicated(replicated(12, 15, 16, 19), 10, false); err != nil {
+		t.Fatalf("AppendReplicated with holes failed: %v", err)
+	}
+	if frames, _ := batchFrames(repo, "follower"); frames != 3 {
+		t.Errorf("Expected 3 replicated batch frames, got %d", frames)
+	}
+	for _, offset := range []int{0, 5, 6, 9, 12, 15, 16, 19} {
+		if record, err := repo.Read("follower", uint64(offset)); err != nil || string(record.Data) != string(payload(offset)) {
+			t.Errorf("Read follower/%d returned %v: %v", offset, record, err)
+		}
+	}
+	for _, offset := range []int{10, 13, 18} {
+		if _, err := repo.Read("follower", uint64(offset)); !errors.Is(err, entity.ErrNotFound) {
+			t.Errorf("Expected follower/%d to be missing, got %v", offset, err)
+		}
+	}
+	repo.Close()
+	t.Logf("TestFileStorageRepository_BatchCompression passed: batches compressed as one frame, read, scanned, truncated, compacted and recovered")
+}
+
+func TestFileStorageRepository_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.json")
+	writeKeys := func(current string, ids ...string) {
+		keys := map[string][]byte{}
+		for _, id := range ids {
+			keys[id] = []byte(strings.Repeat(id, 32)[:32])
+		}
+		data, _ := json.Marshal(map[string]interface{}{"current": current, "keys": keys})
+		if err := os.WriteFile(keyFile, data, 0600); err != nil {
+			t.Fatalf("Write key file failed: %v", err)
+		}
+	}
+	writeKeys("a", "a")
+
+	config := &entity.Config{
+		DataDir:              dir + "/data",
+		MaxFileSize:          1024,
+		KeyFile:              keyFile,
+		PartitionEncryption:  map[string]bool{"pii": true},
+		PartitionCompression: map[string]entity.Compression{"pii": entity.CompressionSnappy},
+		PartitionRetention:   map[string]entity.RetentionPolicy{"pii": {Compact: true}},
+	}
+	secret := func(i int) string {
+		return fmt.Sprintf("ssn=123-45-%04d ssn=123-45-%04d ssn=123-45-%04d", i, i, i)
+	}
+	appendAll := func(repo *FileStorageRepository, partition string, from, to int) {
+		for i := from; i < to; i++ {
+			record := &entity.Record{Data: []byte(secret(i)), DataType: entity.DataTypeString, PartitionKey: partition, Key: fmt.Sprintf("user-%d", i%4)}
+			if err := repo.Append(record); err != nil {
+				t.Fatalf("Append to %s failed: %v", partition, err)
+			}
+		}
+	}
+	readAll := func(repo *FileStorageRepository, from, to int) {
+		for i := from; i < to; i++ {
+			record, err := repo.Read("pii", uint64(i))
+			if err != nil {
+				t.Fatalf("Read %d failed: %v", i, err)
+			}
+			if string(record.Data) != secret(i) || record.Key != fmt.Sprintf("user-%d", i%4) {
+				t.Fatalf("Read %d returned %q key %q", i, record.Data, record.Key)
+			}
+		}
+	}
+	storeContains := func(partition, text string) bool {
+		paths, _ := filepath.Glob(filepath.Join(config.DataDir, partition, "*.store"))
+		for _, path := range paths {
+			if data, _ := os.ReadFile(path); strings.Contains(string(data), text) {
+				return true
+			}
+		}
+		return false
+	}
+
+	repo, err := OpenFileStorageRepository(config)
+	if err != nil {
+		t.Fatalf("Open with a valid key file failed: %v", err)
+	}
+	appendAll(repo, "pii", 0, 10)
+	appendAll(repo, "plain", 0, 1)
+	readAll(repo, 0, 10)
+	if storeContains("pii", "123-45") || storeContains("pii", "user-") {
+		t.Errorf("Expected no plaintext data or keys in the encrypted partition")
+	}
+	if !storeContains("plain", "123-45") {
+		t.Errorf("Expected plaintext in the unencrypted partition")
+	}
+	repo.Close()
+
+	// After rotating, old records stay readable and new ones use the new key
+	writeKeys("b", "a", "b")
+	repo = NewFileStorageRepository(config)
+	appendAll(repo, "pii", 10, 20)
+	readAll(repo, 0, 20)
+	keyIDs := map[string]bool{}
+	for _, seg := range repo.partitions["pii"].Segments {
+		walkStoreFrames(seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+			_, payload, _ := verifyRecordFrame(body)
+			id, _, _, err := splitEnvelope(payload)
+			if err == nil {
+				keyIDs[id] = true
+			}
+			return nil
+		})
+	}
+	if !keyIDs["a"] || !keyIDs["b"] {
+		t.Errorf("Expected records under keys a and b, got %v", keyIDs)
+	}
+
+	repo.Close()
+
+	// Without the old key its records are unavailable, not corrupt, and survive a reload
+	writeKeys("b", "b")
+	repo = NewFileStorageRepository(config)
+	if next := repo.partitions["pii"].CurrentOffset; next != 20 {
+		t.Fatalf("Expected reload to keep 20 records, got %d", next)
+	}
+	_, err = repo.Read("pii", 3)
+	var keyErr *KeyUnavailableError
+	if !errors.As(err, &keyErr) || keyErr.KeyID != "a" || !errors.Is(err, entity.ErrUnavailable) {
+		t.Errorf("Expected KeyUnavailableError for key a, got %v", err)
+	}
+	for _, seg := range repo.partitions["pii"].Segments {
+		if err := repo.sanityCheck(seg); err != nil {
+			t.Errorf("Expected encrypted segment to verify without keys: %v", err)
+		}
+	}
+	readAll(repo, 10, 20)
+	repo.enforceRetention(time.Now())
+	if repo.partitions["pii"].Segments[0].Compacted {
+		t.Errorf("Expected compaction to leave records it cannot read alone")
+	}
+	repo.Close()
+
+	// Compaction reads keys inside encrypted records
+	writeKeys("b", "a", "b")
+	repo = NewFileStorageRepository(config)
+	repo.enforceRetention(time.Now())
+	if !repo.partitions["pii"].Segments[0].Compacted {
+		t.Errorf("Expected the first segment to be compacted")
+	}
+	if record, err := repo.Read("pii", 19); err != nil || string(record.Data) != secret(19) {
+		t.Errorf("Read after compaction returned %v (%v)", record, err)
+	}
+	repo.Close()
+
+	// Encryption without keys is refused
+	config.KeyFile = ""
+	repo = NewFileStorageRepository(config)
+	if err := repo.Append(&entity.Record{Data: []byte("x"), DataType: entity.DataTypeString, PartitionKey: "pii"}); err == nil {
+		t.Errorf("Expected append without a key provider to fail")
+	}
+	repo.Close()
+	if _, err := OpenFileStorageRepository(config); !errors.Is(err, errNoKeyProvider) {
+		t.Errorf("Expected encryption without a key provider to be refused at start, got %v", err)
+	}
+	if _, err := NewLocalKeyProvider(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Expected error for a missing key file")
+	}
+	config.KeyFile = filepath.Join(dir, "missing.json")
+	if _, err := OpenFileStorageRepository(config); err == nil {
+		t.Errorf("Expected a missing key file to be refused at start")
+	}
+	os.WriteFile(keyFile, []byte(`{"current": "short", "keys": {"short": "c2hvcnQ="}}`), 0600)
+	if _, err := NewLocalKeyProvider(keyFile); err == nil {
+		t.Errorf("Expected error for a key of the wrong size")
+	}
+	config.KeyFile = keyFile
+	if _, err := OpenFileStorageRepository(config); err == nil {
+		t.Errorf("Expected a malformed key file to be refused at start")
+	}
+	t.Logf("TestFileStorageRepository_Encryption passed: records encrypted, rotated, compacted and verified without keys")
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	seed := uint32(1)
+	for i := range random {
+		seed = seed*1664525 + 1013904223
+		random[i] = byte(seed >> 24)
+	}
+	inputs := [][]byte{
+		{},
+		[]byte("abc"),
+		[]byte(strings.Repeat("a", 1000)),
+		[]byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 3000)), // Longer than a 16-bit offset
+		random,
+		append(append([]byte{}, random...), random[:300]...),
+	}
+	for i, input := range inputs {
+		encoded := snappyEncode(input)
+		decoded, err := snappyDecode(encoded)
+		if err != nil {
+			t.Fatalf("Input %d: decode failed: %v", i, err)
+		}
+		if string(decoded) != string(input) {
+			t.Fatalf("Input %d: round trip changed %d bytes into %d", i, len(input), len(decoded))
+		}
+	}
+	if encoded := snappyEncode(inputs[3]); len(encoded) > len(inputs[3])/10 {
+		t.Errorf("Expected repetitive text to compress, got %d of %d bytes", len(encoded), len(inputs[3]))
+	}
+	for _, corrupt := range [][]byte{{}, {10, 0x02, 0x05, 0x00}, {3, 0x08, 'a'}, {200, 1}} {
+		if _, err := snappyDecode(corrupt); err == nil {
+			t.Errorf("Expected error decoding %v", corrupt)
+		}
+	}
+	t.Logf("TestSnappyRoundTrip passed: %d inputs round-tripped", len(inputs))
+}
+
+func TestFileStorageRepository_ChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024,
+	}
+	repo := NewFileStorageRepository(config)
+
+	record := &entity.Record{
+		Data:         []byte("checksummed data"),
+		DataType:     entity.DataTypeBytes,
+		PartitionKey: "test-partition",
+	}
+	if err := repo.Append(record); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Flip the last data byte on disk
+	storePath := dir + "/test-partition/segment_0.store"
+	raw, err := os.ReadFile(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	if err := os.WriteFile(storePath, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.Read("test-partition", 0)
+	var corruptErr *CorruptRecordError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("Expected CorruptRecordError, got %v", err)
+	}
+	if !errors.Is(err, entity.ErrCorrupted) {
+		t.Errorf("Expected CorruptRecordError to match ErrCorrupted")
+	}
+	if corruptErr.Position != segmentHeaderSize {
+		t.Errorf("Expected corrupt position %d, got %d", segmentHeaderSize, corruptErr.Position)
+	}
+	if err := repo.sanityCheck(repo.partitions["test-partition"].Segments[0]); err == nil {
+		t.Errorf("Expected sanity check to report corruption")
+	}
+	t.Logf("TestFileStorageRepository_ChecksumMismatch passed: corruption detected: %v", err)
+}
+
+func TestFileStorageRepository_LegacyFraming(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/legacy-partition", 0755)
+
+	// Write a segment in the old [length 4][dataType 1][data] framing
+	storeFile, _ := os.Create(dir + "/legacy-partition/segment_0.store")
+	indexFile, _ := os.Create(dir + "/legacy-partition/segment_0.index")
+	pos := uint64(0)
+	for i, data := range []string{"old-1", "old-2"} {
+		binary.Write(storeFile, binary.BigEndian, uint32(len(data)+1))
+		storeFile.Write([]byte{byte(entity.DataTypeString)})
+		storeFile.Write([]byte(data))
+		binary.Write(indexFile, binary.BigEndian, uint64(i))
+		binary.Write(indexFile, binary.BigEndian, pos)
+		pos += uint64(4 + len(data) + 1)
+	}
+	storeFile.Close()
+	indexFile.Close()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024,
+	}
+	repo := NewFileStorageRepository(config)
+
+	// New records are checksummed alongside the legacy ones
+	record := &entity.Record{
+		Data:         []byte("new-3"),
+		DataType:     entity.DataTypeString,
+		PartitionKey: "legacy-partition",
+	}
+	if err := repo.Append(record); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i, expected := range []string{"old-1", "old-2", "new-3"} {
+		readRecord, err := repo.Read("legacy-partition", uint64(i))
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", i, err)
+		}
+		if string(readRecord.Data) != expected {
+			t.Errorf("Expected %q, got %q", expected, string(readRecord.Data))
+		}
+	}
+	t.Logf("TestFileStorageRepository_LegacyFraming passed: legacy and checksummed records coexist")
+}
+
+func TestFileStorageRepository_SegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024,
+	}
+	repo := NewFileStorageRepository(config)
+	record := &entity.Record{
+		Data:         []byte("header data"),
+		DataType:     entity.DataTypeBytes,
+		PartitionKey: "test-partition",
+	}
+	if err := repo.Append(record); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for path, magic := range map[string][4]byte{
+		dir + "/test-partition/segment_0.store": storeMagic,
+		dir + "/test-partition/segment_0.index": indexMagic,
+	} {
+		header, err := readSegmentHeader(path, magic, 0)
+		if err != nil || header == nil {
+			t.Fatalf("Expected header in %s, got %v", path, err)
+		}
+		if header.Version != entity.SegmentFormatVersion {
+			t.Errorf("Expected version %d, got %d", entity.SegmentFormatVersion, header.Version)
+		}
+	}
+
+	// Bump the version past what this build supports and reload
+	storePath := dir + "/test-partition/segment_0.store"
+	raw, _ := os.ReadFile(storePath)
+	binary.BigEndian.PutUint16(raw[4:], entity.SegmentFormatVersion+1)
+	os.WriteFile(storePath, raw, 0644)
+	os.WriteFile(dir+"/test-partition/segment_7.store", []byte("not a segment"), 0644)
+
+	reloaded := NewFileStorageRepository(config)
+	if _, err := reloaded.Read("test-partition", 0); err == nil {
+		t.Fatalf("Expected partition with unknown format version to be rejected")
+	}
+	if err := reloaded.Append(&entity.Record{Data: []byte("x"), DataType: entity.DataTypeBytes, PartitionKey: "test-partition"}); err == nil {
+		t.Fatalf("Expected append to rejected partition to fail")
+	}
+	t.Logf("TestFileStorageRepository_SegmentHeader passed: headers written and unknown versions rejected")
+}
+
+func TestUpgradeDataDir(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/legacy-partition", 0755)
+
+	storeFile, _ := os.Create(dir + "/legacy-partition/segment_0.store")
+	indexFile, _ := os.Create(dir + "/legacy-partition/segment_0.index")
+	pos := uint64(0)
+	for i, data := range []string{"old-1", "old-2", "old-3"} {
+		binary.Write(storeFile, binary.BigEndian, uint32(len(data)+1))
+		storeFile.Write([]byte{byte(entity.DataTypeString)})
+		storeFile.Write([]byte(data))
+		binary.Write(indexFile, binary.BigEndian, uint64(i))
+		binary.Write(indexFile, binary.BigEndian, pos)
+		pos += uint64(4 + len(data) + 1)
+	}
+	storeFile.Close()
+	indexFile.Close()
+
+	// A directory that maps to no partition is skipped and reported
+	os.MkdirAll(dir+"/bad\x01dir", 0755)
+
+	summary, err := UpgradeDataDir(dir)
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if summary.Upgraded != 1 {
+		t.Errorf("Expected 1 upgraded segment, got %d", summary.Upgraded)
+	}
+	if len(summary.Skipped) != 1 || summary.Skipped[0] != "bad\x01dir" {
+		t.Errorf("Expected the stray directory to be skipped, got %q", summary.Skipped)
+	}
+	// Running again is a no-op
+	if summary, _ := UpgradeDataDir(dir); summary.Upgraded != 0 {
+		t.Errorf("Expected second upgrade to do nothing, got %d", summary.Upgraded)
+	}
+	os.RemoveAll(dir + "/bad\x01dir")
+
+	repo := NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	segment := repo.partitions["legacy-partition"].GetActiveSegment()
+	if segment.FormatVersion != entity.SegmentFormatVersion || segment.BaseOffset != 0 {
+		t.Errorf("Expected upgraded segment_0 to stay active, got base %d version %d", segment.BaseOffset, segment.FormatVersion)
+	}
+	for i, expected := range []string{"old-1", "old-2", "old-3"} {
+		readRecord, err := repo.Read("legacy-partition", uint64(i))
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", i, err)
+		}
+		if string(readRecord.Data) != expected {
+			t.Errorf("Expected %q, got %q", expected, string(readRecord.Data))
+		}
+	}
+
+	// A legacy segment with a corrupt record is left as it was
+	os.MkdirAll(dir+"/corrupt-partition", 0755)
+	corrupt := []byte{0, 0, 0, 2, byte(entity.DataTypeString), 'x', 0, 0, 0, 2, byte(entity.DataTypeString) | codecGzip<<recordAttrCodecShift, 'y'}
+	os.WriteFile(dir+"/corrupt-partition/segment_0.store", corrupt, 0644)
+	if _, err := UpgradeDataDir(dir); !errors.As(err, new(*CorruptRecordError)) {
+		t.Errorf("Expected the upgrade of a corrupt segment to fail, got %v", err)
+	}
+	if data, _ := os.ReadFile(dir + "/corrupt-partition/segment_0.store"); string(data) != string(corrupt) {
+		t.Errorf("Expected the corrupt segment to be left as it was")
+	}
+	t.Logf("TestUpgradeDataDir passed: legacy segment rewritten with header and checksums, corrupt and stray data reported")
+}
+
 func BenchmarkFileStorageRepository_Append(b *testing.B) {
 	wd, _ := os.Getwd()
 	dir := wd + "/../../test-data/benchmark_append"
@@ -83,6 +1937,60 @@ func BenchmarkFileStorageRepository_Append(b *testing.B) {
 	}
 }
 
+func BenchmarkFileStorageRepository_AppendBatch(b *testing.B) {
+	dir := b.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024 * 1024,
+	}
+	repo := NewFileStorageRepository(config)
+
+	// Each iteration appends one record, in batches of 100
+	const batchSize = 100
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		records := make([]*entity.Record, batchSize)
+		for j := range records {
+			records[j] = &entity.Record{
+				Data:         []byte("benchmark data"),
+				DataType:     entity.DataTypeBytes,
+				PartitionKey: "bench-partition",
+			}
+		}
+		if err := repo.AppendBatch(records); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileStorageRepository_AppendGroupCommit(b *testing.B) {
+	dir := b.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024 * 1024,
+		Durability:  entity.DurabilityGroup,
+	}
+	repo := NewFileStorageRepository(config)
+	defer repo.Close()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			record := &entity.Record{
+				Data:         []byte("benchmark data"),
+				DataType:     entity.DataTypeBytes,
+				PartitionKey: "bench-partition",
+			}
+			if err := repo.Append(record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func BenchmarkFileStorageRepository_Read(b *testing.B) {
 	wd, _ := os.Getwd()
 	dir := wd + "/../../test-data/benchmark_read"
@@ -116,6 +2024,75 @@ func BenchmarkFileStorageRepository_Read(b *testing.B) {
 	}
 }
 
+func BenchmarkFileStorageRepository_ReadParallel(b *testing.B) {
+	dir := b.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 4 * 1024, // Spread reads over many segments
+	}
+	repo := NewFileStorageRepository(config)
+	defer repo.Close()
+
+	records := make([]*entity.Record, 1000)
+	for i := range records {
+		records[i] = &entity.Record{
+			Data:         []byte("benchmark data"),
+			DataType:     entity.DataTypeBytes,
+			PartitionKey: "bench-partition",
+		}
+	}
+	for i := 0; i < len(records); i += 100 {
+		if err := repo.AppendBatch(records[i : i+100]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := repo.Read("bench-partition", uint64(i%len(records))); err != nil {
+				b.Fatal(err)
+			}
+			i += 7
+		}
+	})
+}
+
+func BenchmarkFileStorageRepository_Scan(b *testing.B) {
+	dir := b.TempDir()
+
+	config := &entity.Config{
+		DataDir:     dir,
+		MaxFileSize: 1024 * 1024,
+	}
+	repo := NewFileStorageRepository(config)
+	defer repo.Close()
+
+	records := make([]*entity.Record, 1000)
+	for i := range records {
+		records[i] = &entity.Record{
+			Data:         []byte("benchmark data"),
+			DataType:     entity.DataTypeBytes,
+			PartitionKey: "bench-partition",
+		}
+	}
+	if err := repo.AppendBatch(records); err != nil {
+		b.Fatal(err)
+	}
+
+	// Each iteration reads 100 records
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := uint64(i % 900)
+		err := repo.Scan("bench-partition", from, ScanOptions{MaxCount: 100}, func(*entity.Record) error { return nil })
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestFileStorageRepository_Segmentation(t *testing.T) {
 	// Use test-data dir in project root
 	wd, _ := os.Getwd()
@@ -195,23 +2172,23 @@ func dumpStoreToTxt(filename string) {
 	}
 	defer txtFile.Close()
 
-	pos := int64(0)
+	stat, err := file.Stat()
+	if err != nil {
+		return
+	}
+	pos := skipSegmentHeader(file, storeMagic)
 	for {
-		var length uint32
-		if err := binary.Read(file, binary.BigEndian, &length); err != nil {
-			break
-		}
-		var dataType byte
-		if err := binary.Read(file, binary.BigEndian, &dataType); err != nil {
+		body, err := readFrame(file, stat.Size()-pos)
+		if err != nil {
 			break
 		}
-		data := make([]byte, length-1)
-		if _, err := io.ReadFull(file, data); err != nil {
+		record, err := decodeRecordFrame(body, nil)
+		if err != nil {
+			fmt.Fprintf(txtFile, "Pos: %d, Corrupt: %v\n", pos, err)
 			break
 		}
-		fmt.Fprintf(txtFile, "Pos: %d, Type: %d, Data: %s\n", pos, dataType, string(data))
-		pos += 4 + int64(length)
-		file.Seek(pos, 0)
+		fmt.Fprintf(txtFile, "Pos: %d, Type: %d, Time: %s, Key: %s, Headers: %d, Data: %s\n", pos, record.DataType, record.Timestamp.Format(time.RFC3339Nano), record.Key, len(record.Headers), string(record.Data))
+		pos += frameLengthSize + int64(len(body))
 	}
 }
 
@@ -229,6 +2206,7 @@ func dumpIndexToTxt(filename string) {
 	}
 	defer txtFile.Close()
 
+	skipSegmentHeader(file, indexMagic)
 	for {
 		var offset, position uint64
 		if err := binary.Read(file, binary.BigEndian, &offset); err != nil {
@@ -239,4 +2217,243 @@ func dumpIndexToTxt(filename string) {
 		}
 		fmt.Fprintf(txtFile, "Offset: %d, Position: %d\n", offset, position)
 	}
-}
\ No newline at end of file
+}
+// skipSegmentHeader positions file after its segment header, if it has one
+func skipSegmentHeader(file *os.File, magic [4]byte) int64 {
+	prefix := make([]byte, len(magic))
+	if _, err := io.ReadFull(file, prefix); err == nil && string(prefix) == string(magic[:]) {
+		file.Seek(segmentHeaderSize, 0)
+		return segmentHeaderSize
+	}
+	file.Seek(0, 0)
+	return 0
+}
+
+func TestFileStorageRepository_ErrorKinds(t *testing.T) {
+	dir := t.TempDir()
+
+	repo := NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	defer repo.Close()
+	record, _ := entity.NewRecord("data", entity.DataTypeString, "orders")
+	if err := repo.Append(record); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"missing partition", func() error { _, err := repo.Read("missing", 0); return err }(), entity.ErrNotFound},
+		{"missing offset", func() error { _, err := repo.Read("orders", 5); return err }(), entity.ErrNotFound},
+		{"empty partition key", func() error { _, err := repo.Read("", 0); return err }(), entity.ErrInvalidInput},
+		{"mixed batch", repo.AppendBatch([]*entity.Record{
+			{Data: []byte("a"), PartitionKey: "orders"},
+			{Data: []byte("b"), PartitionKey: "payments"},
+		}), entity.ErrInvalidInput},
+		{"bad partition key", repo.Append(&entity.Record{Data: []byte("a"), PartitionKey: "a\x00b"}), entity.ErrInvalidInput},
+		{"delete missing partition", repo.DeletePartition("missing"), entity.ErrNotFound},
+	}
+	for _, c := range cases {
+		if !errors.Is(c.err, c.kind) {
+			t.Errorf("%s: expected an error matching %v, got %v", c.name, c.kind, c.err)
+		}
+	}
+	if err := repo.DeletePartition("missing"); err == nil || err.Error() != "partition not found" {
+		t.Errorf("Expected the not found message to be kept, got %v", err)
+	}
+	t.Logf("TestFileStorageRepository_ErrorKinds passed: repository errors match their sentinels")
+}
+
+func TestFileStorageRepository_AppendReplicated(t *testing.T) {
+	dir := t.TempDir()
+
+	repo := NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	defer repo.Close()
+	stamp := time.Unix(1700000000, 0)
+	replicated := func(from, count int) []*entity.Record {
+		records := make([]*entity.Record, count)
+		for i := range records {
+			offset := uint64(from + i)
+			records[i] = &entity.Record{
+				Offset:       offset,
+				Data:         []byte(fmt.Sprintf("record %d", offset)),
+				DataType:     entity.DataTypeString,
+				PartitionKey: "orders",
+				Timestamp:    stamp.Add(time.Duration(offset) * time.Second),
+			}
+		}
+		return records
+	}
+
+	if _, err := repo.AppendReplicated(replicated(2, 3), 2, false); !errors.Is(err, entity.ErrOutOfRange) {
+		t.Fatalf("Expected records past the next offset to be out of range, got %v", err)
+	}
+	next, err := repo.AppendReplicated(replicated(0, 5), 0, false)
+	if err != nil || next != 5 {
+		t.Fatalf("Expected next offset 5, got %d (%v)", next, err)
+	}
+	// Overlapping records are skipped, only 5-7 are new
+	next, err = repo.AppendReplicated(replicated(3, 5), 3, false)
+	if err != nil || next != 8 {
+		t.Fatalf("Expected next offset 8 after an overlapping batch, got %d (%v)", next, err)
+	}
+	if next, err := repo.AppendReplicated(replicated(1, 2), 1, false); err != nil || next != 8 {
+		t.Fatalf("Expected a batch already held to be a no-op, got %d (%v)", next, err)
+	}
+	broken := replicated(8, 3)
+	broken[2].Offset = 9
+	if _, err := repo.AppendReplicated(broken, 8, false); !errors.Is(err, entity.ErrInvalidInput) {
+		t.Fatalf("Expected offsets that do not increase to be rejected, got %v", err)
+	}
+
+	for offset := uint64(0); offset < 8; offset++ {
+		record, err := repo.Read("orders", offset)
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", offset, err)
+		}
+		if string(record.Data) != fmt.Sprintf("record %d", offset) || !record.Timestamp.Equal(stamp.Add(time.Duration(offset)*time.Second)) {
+			t.Errorf("Offset %d holds %q at %v", offset, record.Data, record.Timestamp)
+		}
+	}
+
+	// Held records that differ are replaced from the first one on
+	changed := replicated(5, 4)
+	changed[1].Data = []byte("rewritten 6")
+	if next, err := repo.AppendReplicated(changed, 5, false); err != nil || next != 9 {
+		t.Fatalf("Expected next offset 9 after replacing records, got %d (%v)", next, err)
+	}
+	if record, err := repo.Read("orders", 6); err != nil || string(record.Data) != "rewritten 6" {
+		t.Errorf("Expected offset 6 to be replaced, got %v (%v)", record, err)
+	}
+	// The records before a differing first one may differ too
+	if _, err := repo.AppendReplicated(replicated(6, 2), 6, false); !errors.Is(err, entity.ErrConflict) {
+		t.Errorf("Expected a conflict for a differing first record, got %v", err)
+	}
+
+	// With reset, a batch past a hole replaces the partition's records
+	next, err = repo.AppendReplicated(replicated(20, 2), 20, true)
+	if err != nil || next != 22 {
+		t.Fatalf("Expected next offset 22 after a reset, got %d (%v)", next, err)
+	}
+	if _, err := repo.Read("orders", 7); !errors.Is(err, entity.ErrOutOfRange) {
+		t.Errorf("Expected records before the reset to be gone, got %v", err)
+	}
+
+	// Offsets the sender compacted away since a held offset stay holes
+	sparse := append(replicated(24, 1), replicated(26, 2)...)
+	if _, err := repo.AppendReplicated(sparse, 23, false); !errors.Is(err, entity.ErrOutOfRange) {
+		t.Errorf("Expected a hole before since to be out of range, got %v", err)
+	}
+	next, err = repo.AppendReplicated(sparse, 22, false)
+	if err != nil || next != 28 {
+		t.Fatalf("Expected next offset 28 after sparse records, got %d (%v)", next, err)
+	}
+	if next, err := repo.AppendReplicated(replicated(28, 2), 28, false); err != nil || next != 30 {
+		t.Fatalf("Expected next offset 30 after appending past sparse records, got %d (%v)", next, err)
+	}
+	offsets := []uint64{}
+	repo.Scan("orders", 20, ScanOptions{}, func(record *entity.Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	if fmt.Sprint(offsets) != "[20 21 24 26 27 28 29]" {
+		t.Errorf("Expected the holes to be kept, got offsets %v", offsets)
+	}
+	// A reset may start with a hole too
+	next, err = repo.AppendReplicated(append(replicated(40, 1), replicated(43, 1)...), 40, true)
+	if err != nil || next != 44 {
+		t.Fatalf("Expected next offset 44 after a sparse reset, got %d (%v)", next, err)
+	}
+	if next, err := repo.AppendReplicated(replicated(44, 1), 44, false); err != nil || next != 45 {
+		t.Fatalf("Expected next offset 45, got %d (%v)", next, err)
+	}
+	repo.Close()
+	reloaded := NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	defer reloaded.Close()
+	for _, offset := range []uint64{40, 43, 44} {
+		record, err := reloaded.Read("orders", offset)
+		if err != nil || string(record.Data) != fmt.Sprintf("record %d", offset) {
+			t.Errorf("Expected offset %d after reloading, got %v (%v)", offset, record, err)
+		}
+	}
+	if _, err := reloaded.Read("orders", 41); !errors.Is(err, entity.ErrNotFound) {
+		t.Errorf("Expected offset 41 to be a hole, got %v", err)
+	}
+	if info, _ := reloaded.DescribePartition("orders"); info == nil || info.EarliestOffset != 40 || info.NextOffset != 45 {
+		t.Errorf("Expected offsets 40-44 after reloading, got %+v", info)
+	}
+	t.Logf("TestFileStorageRepository_AppendReplicated passed: replicated records keep their offsets and timestamps")
+}
+
+func TestFileStorageRepository_Close(t *testing.T) {
+	dir := t.TempDir()
+	config := &entity.Config{DataDir: dir, MaxFileSize: 100, ScrubInterval: time.Millisecond, Durability: entity.DurabilityGroup}
+	repo := NewFileStorageRepository(config)
+	for i := 0; i < 12; i++ {
+		record := &entity.Record{Data: []byte(fmt.Sprintf("r-%02d", i)), DataType: entity.DataTypeString, PartitionKey: "test-partition"}
+		if err := repo.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	// A second Close and a late repair request must not panic
+	if err := repo.Close(); err != nil {
+		t.Errorf("Expected a second Close to succeed, got %v", err)
+	}
+	repo.requestRepair("test-partition")
+	if repo.partitions["test-partition"].writer != nil {
+		t.Errorf("Expected the writer to be closed")
+	}
+
+	reloaded := NewFileStorageRepository(config)
+	defer reloaded.Close()
+	if _, err := reloaded.Read("test-partition", 11); err != nil {
+		t.Errorf("Expected every record after reopening, got %v", err)
+	}
+	t.Logf("TestFileStorageRepository_Close passed: Close is idempotent and stops workers first")
+}
+
+func TestFileStorageRepository_LegacyPartitionDirs(t *testing.T) {
+	dir := t.TempDir()
+	config := &entity.Config{DataDir: dir, MaxFileSize: 1024}
+	repo := NewFileStorageRepository(config)
+	for _, key := range []string{"a b", "a%2f", "kept"} {
+		if err := repo.Append(&entity.Record{Data: []byte("in " + key), DataType: entity.DataTypeString, PartitionKey: key}); err != nil {
+			t.Fatalf("Append to %q failed: %v", key, err)
+		}
+	}
+	repo.Close()
+
+	// Move the partitions back to the layout that used the raw key
+	for _, key := range []string{"a b", "a%2f"} {
+		if err := os.Rename(entity.PartitionDir(dir, key), filepath.Join(dir, key)); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+	}
+	// A legacy directory whose encoded one exists is ambiguous
+	os.MkdirAll(filepath.Join(dir, "kept%20"), 0755)
+	os.MkdirAll(filepath.Join(dir, "kept "), 0755)
+
+	repo = NewFileStorageRepository(config)
+	defer repo.Close()
+	for _, key := range []string{"a b", "a%2f", "kept"} {
+		record, err := repo.Read(key, 0)
+		if err != nil || string(record.Data) != "in "+key {
+			t.Errorf("Read %q after migration returned %v (%v)", key, record, err)
+		}
+		if _, err := os.Stat(entity.PartitionDir(dir, key)); err != nil {
+			t.Errorf("Expected %q to be stored under its encoded name: %v", key, err)
+		}
+	}
+	info, err := repo.DescribePartition("kept ")
+	if err != nil || info.Error == "" {
+		t.Errorf("Expected the conflicting legacy directory to be listed as failed, got %+v (%v)", info, err)
+	}
+	if err := repo.Append(&entity.Record{Data: []byte("x"), DataType: entity.DataTypeString, PartitionKey: "kept "}); !errors.Is(err, entity.ErrUnavailable) {
+		t.Errorf("Expected appends to the conflicting partition to fail as unavailable, got %v", err)
+	}
+	t.Logf("TestFileStorageRepository_LegacyPartitionDirs passed: raw-key directories renamed, conflicts refused")
+}
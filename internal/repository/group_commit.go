@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultGroupCommitInterval = 5 * time.Millisecond
+
+// groupCommit collects appends waiting for durability and acknowledges them
+// together after a single fsync of every segment they touched
+type groupCommit struct {
+	maxRecords int
+	interval   time.Duration
+
+	mu      sync.Mutex
+	records int // records waiting for the next fsync
+	waiters []chan error
+	writers map[*segmentWriter]struct{}
+	timer   *time.Timer
+
+	// syncMu serializes commits so a writer is never closed mid-fsync
+	syncMu  sync.Mutex
+	commits uint64 // number of fsync rounds, for tests and metrics
+}
+
+// newGroupCommit creates a group committer that syncs after maxRecords
+// pending records (0 = no limit) or interval, whichever comes first
+func newGroupCommit(maxRecords int, interval time.Duration) *groupCommit {
+	if interval <= 0 {
+		interval = defaultGroupCommitInterval
+	}
+	return &groupCommit{
+		maxRecords: maxRecords,
+		interval:   interval,
+		writers:    make(map[*segmentWriter]struct{}),
+	}
+}
+
+// add registers records written through writer and returns a channel that
+// receives the result of the fsync covering them
+func (g *groupCommit) add(writer *segmentWriter, records int) <-chan error {
+	done := make(chan error, 1)
+	g.mu.Lock()
+	g.waiters = append(g.waiters, done)
+	g.writers[writer] = struct{}{}
+	g.records += records
+	full := g.maxRecords > 0 && g.records >= g.maxRecords
+	if !full && g.timer == nil {
+		g.timer = time.AfterFunc(g.interval, g.commit)
+	}
+	g.mu.Unlock()
+	if full {
+		go g.commit()
+	}
+	return done
+}
+
+// commit fsyncs every pending writer and acknowledges the waiting appends
+func (g *groupCommit) commit() {
+	g.syncMu.Lock()
+	defer g.syncMu.Unlock()
+
+	g.mu.Lock()
+	waiters, writers := g.waiters, g.writers
+	g.waiters, g.writers, g.records = nil, make(map[*segmentWriter]struct{}), 0
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	g.mu.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+
+	var err error
+	for writer := range writers {
+		if syncErr := writer.sync(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+	}
+	g.commits++
+	for _, done := range waiters {
+		done <- err
+	}
+}
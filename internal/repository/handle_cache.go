@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const defaultMaxOpenFiles = 128
+
+// fileHandle is a read-only file shared by concurrent readers. Reads must use
+// ReadAt (or a SectionReader) since the file offset is shared.
+type fileHandle struct {
+	file    *os.File
+	data    []byte // Memory map of the file, if acquired with acquireMapped
+	path    string
+	refs    int
+	evicted bool
+	elem    *list.Element
+}
+
+// handleCache keeps up to capacity read-only segment files open, closing the
+// least recently used one when full. Handles still in use are closed when
+// their last user releases them.
+type handleCache struct {
+	mu       sync.Mutex
+	capacity int
+	handles  map[string]*fileHandle
+	lru      *list.List // front is most recently used
+}
+
+// newHandleCache creates a cache holding at most capacity open files
+func newHandleCache(capacity int) *handleCache {
+	if capacity <= 0 {
+		capacity = defaultMaxOpenFiles
+	}
+	return &handleCache{
+		capacity: capacity,
+		handles:  make(map[string]*fileHandle),
+		lru:      list.New(),
+	}
+}
+
+// acquire returns an open handle for path; callers must release it
+func (c *handleCache) acquire(path string) (*fileHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if handle, exists := c.handles[path]; exists {
+		handle.refs++
+		c.lru.MoveToFront(handle.elem)
+		return handle, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	handle := &fileHandle{file: file, path: path, refs: 1}
+	handle.elem = c.lru.PushFront(handle)
+	c.handles[path] = handle
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back().Value.(*fileHandle))
+	}
+	return handle, nil
+}
+
+// acquireMapped returns an open handle for path with the file memory-mapped.
+// A mapping that valid rejects, e.g. because the file has grown since it was
+// mapped, is replaced once. Callers must release the handle.
+func (c *handleCache) acquireMapped(path string, valid func(data []byte) bool) (*fileHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	handle, exists := c.handles[path]
+	if exists && handle.data != nil && valid(handle.data) {
+		handle.refs++
+		c.lru.MoveToFront(handle.elem)
+		return handle, nil
+	}
+	if exists && handle.data != nil {
+		// Readers of the old mapping keep it until they release it
+		c.remove(handle)
+		exists = false
+	}
+	if !exists {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		handle = &fileHandle{file: file, path: path}
+		handle.elem = c.lru.PushFront(handle)
+		c.handles[path] = handle
+	}
+	stat, err := handle.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mapFile(handle.file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	handle.data = data
+	if !valid(data) {
+		return nil, fmt.Errorf("index file %s is shorter than its segment", path)
+	}
+	handle.refs++
+	c.lru.MoveToFront(handle.elem)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back().Value.(*fileHandle))
+	}
+	return handle, nil
+}
+
+// release gives back a handle obtained from acquire
+func (c *handleCache) release(handle *fileHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	handle.refs--
+	if handle.evicted && handle.refs == 0 {
+		handle.close()
+	}
+}
+
+// evict drops the handle for path, e.g. because the file was deleted or
+// replaced
+func (c *handleCache) evict(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if handle, exists := c.handles[path]; exists {
+		c.remove(handle)
+	}
+}
+
+// closeAll drops every handle
+func (c *handleCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, handle := range c.handles {
+		c.remove(handle)
+	}
+}
+
+// remove takes a handle out of the cache, closing it unless in use; callers
+// must hold c.mu
+func (c *handleCache) remove(handle *fileHandle) {
+	c.lru.Remove(handle.elem)
+	delete(c.handles, handle.path)
+	handle.evicted = true
+	if handle.refs == 0 {
+		handle.close()
+	}
+}
+
+// close unmaps and closes the file of a handle no longer in use
+func (h *fileHandle) close() {
+	unmapFile(h.data)
+	h.data = nil
+	h.file.Close()
+}
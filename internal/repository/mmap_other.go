@@ -0,0 +1,27 @@
+//go:build !unix
+
+package repository
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of a file into memory where mmap is not
+// available. The copy does not see later writes; callers map the file again
+// when it falls behind.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmapFile releases a mapping made by mapFile
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"gostorelog/internal/entity"
+)
+
+// partitionState is a loaded partition with the locks guarding it. Segments
+// and offsets only change with both appendMu and mu held, so either one is
+// enough to read them. Writers hold mu only briefly, which lets readers work
+// on segment files while an append to the same partition is in progress.
+type partitionState struct {
+	*entity.Partition
+	mu sync.RWMutex
+	// appendMu serializes appends, repairs, retention and compaction
+	appendMu   sync.Mutex
+	writer     *segmentWriter  // Active segment writer, guarded by appendMu
+	compaction compactionState // Guarded by appendMu
+	// deleted is set with both locks held once DeletePartition removed the
+	// partition; holders of an older reference must not use it
+	deleted bool
+}
+
+// segmentView is a snapshot of a segment with its files held open. Both
+// files are acquired under the partition lock, so they belong to the same
+// version of the segment even if compaction replaces it afterwards.
+type segmentView struct {
+	seg     entity.Segment
+	index   *fileHandle
+	store   *fileHandle
+	entries indexEntries // The segment's index entries, memory-mapped
+}
+
+var (
+	errPartitionNotFound = fmt.Errorf("partition %w", entity.ErrNotFound)
+	errOffsetNotFound    = fmt.Errorf("offset %w", entity.ErrNotFound)
+)
+
+// unavailablePartition reports a partition that failed to load
+func unavailablePartition(partitionKey string, err error) error {
+	return fmt.Errorf("partition %s is %w: %w", partitionKey, entity.ErrUnavailable, err)
+}
+
+// lookupPartition returns a loaded partition for reading
+func (r *FileStorageRepository) lookupPartition(partitionKey string) (*partitionState, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err, failed := r.failedPartitions[partitionKey]; failed {
+		return nil, unavailablePartition(partitionKey, err)
+	}
+	state, exists := r.partitions[partitionKey]
+	if !exists || state == nil {
+		return nil, errPartitionNotFound
+	}
+	return state, nil
+}
+
+// writablePartition returns the partition to append to, creating it on first
+// use. The map lock is only held for writing while a partition is created.
+func (r *FileStorageRepository) writablePartition(partitionKey string) (*partitionState, error) {
+	r.mu.RLock()
+	err, failed := r.failedPartitions[partitionKey]
+	state := r.partitions[partitionKey]
+	r.mu.RUnlock()
+	if failed {
+		return nil, unavailablePartition(partitionKey, err)
+	}
+	if state != nil {
+		return state, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err, failed := r.failedPartitions[partitionKey]; failed {
+		return nil, unavailablePartition(partitionKey, err)
+	}
+	if state, exists := r.partitions[partitionKey]; exists && state != nil {
+		return state, nil
+	}
+	// Create partition dir
+	os.MkdirAll(entity.PartitionDir(r.config.DataDir, partitionKey), 0755)
+	state = &partitionState{Partition: entity.NewPartition(partitionKey, r.config.DataDir, r.config.MaxFileSize)}
+	r.partitions[partitionKey] = state
+	return state, nil
+}
+
+// lockWritablePartition returns the partition to append to with its
+// appendMu held, skipping a partition deleted while waiting for the lock
+func (r *FileStorageRepository) lockWritablePartition(partitionKey string) (*partitionState, error) {
+	for {
+		state, err := r.writablePartition(partitionKey)
+		if err != nil {
+			return nil, err
+		}
+		state.appendMu.Lock()
+		if !state.deleted {
+			return state, nil
+		}
+		state.appendMu.Unlock()
+	}
+}
+
+// partitionStates returns every loaded partition
+func (r *FileStorageRepository) partitionStates() map[string]*partitionState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	states := make(map[string]*partitionState, len(r.partitions))
+	for key, state := range r.partitions {
+		if state != nil {
+			states[key] = state
+		}
+	}
+	return states
+}
+
+// openSegmentAt opens the segment holding offset for reading. It returns nil
+// if the partition has no records from offset on.
+func (r *FileStorageRepository) openSegmentAt(state *partitionState, offset uint64) (*segmentView, error) {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	if state.deleted {
+		return nil, errPartitionNotFound
+	}
+	if len(state.Segments) == 0 {
+		return nil, errors.New("no segments found")
+	}
+	if err := checkEarliest(state.Partition, offset); err != nil {
+		return nil, err
+	}
+	seg := state.SegmentAt(offset)
+	if seg == nil {
+		return nil, nil
+	}
+	return r.openSegmentView(seg)
+}
+
+// openSegmentView acquires a segment's files; callers must hold the
+// partition's mu
+func (r *FileStorageRepository) openSegmentView(seg *entity.Segment) (*segmentView, error) {
+	index, err := r.handles.acquireMapped(seg.IndexPath, func(data []byte) bool {
+		_, ok := mappedEntries(data, seg)
+		return ok
+	})
+	if err != nil {
+		return nil, err
+	}
+	store, err := r.handles.acquire(seg.StorePath)
+	if err != nil {
+		r.handles.release(index)
+		return nil, err
+	}
+	entries, _ := mappedEntries(index.data, seg)
+	return &segmentView{seg: *seg, index: index, store: store, entries: entries}, nil
+}
+
+// closeSegmentView releases the files of a view
+func (r *FileStorageRepository) closeSegmentView(view *segmentView) {
+	r.handles.release(view.index)
+	r.handles.release(view.store)
+}
@@ -0,0 +1,367 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+
+	"gostorelog/internal/entity"
+)
+
+// Batch frames hold the records of an append batch compressed together as
+// one block, so small records that share structure compress as well as
+// large ones:
+//
+//	[length 4][attrs 1][crc32c 4][baseOffset 8][count 4]([delta 4])*[block]
+//
+// The attrs byte has the extended and checksum flags and recordTypeBatch in
+// its type bits, which no data type uses. Its codec and encrypted flag apply
+// to the block, which holds the frames of the records as they would be
+// written on their own, uncompressed and unencrypted, with their length
+// prefixes. Record i has offset baseOffset+delta i. The offsets stay outside
+// the block so recovery can index a batch without keys; the checksum covers
+// them like everything else after it. The index entries of all the records
+// point at the batch frame.
+const (
+	recordTypeBatch byte = 0x03
+
+	batchHeaderSize = 12
+)
+
+// isBatchFrame reports whether a frame body is a batch frame
+func isBatchFrame(body []byte) bool {
+	return len(body) > 0 && body[0]&recordAttrExtended != 0 && body[0]&recordAttrTypeMask == recordTypeBatch
+}
+
+// encodedBatch holds the frames of an append batch, encoded before its
+// offsets are known
+type encodedBatch struct {
+	frames [][]byte // One frame per record, or a single batch frame
+	batch  bool     // frames holds a batch frame that layout completes
+}
+
+// encodeBatch encodes the records of an append batch. With a codec, two or
+// more records are compressed together into a batch frame if that makes
+// them smaller; otherwise each record gets a frame of its own. Replicated
+// records keep their offsets, which must then be set; other records get
+// consecutive ones.
+func encodeBatch(records []*entity.Record, codec byte, key *frameKey, replicated bool) *encodedBatch {
+	deltas := make([]uint32, len(records))
+	for i, record := range records {
+		delta := uint64(i)
+		if replicated {
+			delta = record.Offset - records[0].Offset
+		}
+		if delta > math.MaxUint32 {
+			deltas = nil
+			break
+		}
+		deltas[i] = uint32(delta)
+	}
+	if codec != codecNone && len(records) > 1 && deltas != nil {
+		var block bytes.Buffer
+		for _, record := range records {
+			block.Write(encodeRecordFrame(record, codecNone, nil))
+		}
+		if compressed := compressPayload(codec, block.Bytes()); compressed != nil {
+			return &encodedBatch{frames: [][]byte{newBatchFrame(codec, key, compressed, deltas)}, batch: true}
+		}
+	}
+	frames := make([][]byte, len(records))
+	for i, record := range records {
+		frames[i] = encodeRecordFrame(record, codec, key)
+	}
+	return &encodedBatch{frames: frames}
+}
+
+// recordSizes returns the store bytes each record takes. A batch frame is
+// counted against its first record.
+func (b *encodedBatch) recordSizes(count int) []uint64 {
+	sizes := make([]uint64, count)
+	for i, frame := range b.frames {
+		sizes[i] = uint64(len(frame))
+	}
+	return sizes
+}
+
+// layout returns the store bytes and index entries of the batch once the
+// records have their offsets, with the frames starting at position
+func (b *encodedBatch) layout(records []*entity.Record, position int64) ([]byte, []byte) {
+	var store, entries bytes.Buffer
+	for i, record := range records {
+		binary.Write(&entries, binary.BigEndian, record.Offset)
+		binary.Write(&entries, binary.BigEndian, uint64(position)+uint64(store.Len()))
+		if b.batch {
+			continue
+		}
+		store.Write(b.frames[i])
+	}
+	if b.batch {
+		finishBatchFrame(b.frames[0], records[0].Offset)
+		store.Write(b.frames[0])
+		// Every record of the batch is found at its frame
+		index := entries.Bytes()
+		for i := range records {
+			binary.BigEndian.PutUint64(index[i*indexEntrySize+8:], uint64(position))
+		}
+	}
+	return store.Bytes(), entries.Bytes()
+}
+
+// newBatchFrame builds a batch frame, length prefix included, around a
+// block already compressed with codec. The base offset and checksum are
+// left for finishBatchFrame.
+func newBatchFrame(codec byte, key *frameKey, block []byte, deltas []uint32) []byte {
+	attrs := recordTypeBatch | recordAttrExtended | recordAttrChecksum | codec<<recordAttrCodecShift
+	if key != nil {
+		attrs |= recordAttrEncrypted
+		block = sealPayload(key, attrs, block)
+	}
+	header := frameLengthSize + 1 + frameChecksumSize + batchHeaderSize + 4*len(deltas)
+	frame := make([]byte, header+len(block))
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-frameLengthSize))
+	frame[frameLengthSize] = attrs
+	binary.BigEndian.PutUint32(frame[frameLengthSize+1+frameChecksumSize+8:], uint32(len(deltas)))
+	for i, delta := range deltas {
+		binary.BigEndian.PutUint32(frame[frameLengthSize+1+frameChecksumSize+batchHeaderSize+4*i:], delta)
+	}
+	copy(frame[header:], block)
+	return frame
+}
+
+// finishBatchFrame sets the base offset of a batch frame and its checksum
+func finishBatchFrame(frame []byte, baseOffset uint64) {
+	payload := frame[frameLengthSize+1+frameChecksumSize:]
+	binary.BigEndian.PutUint64(payload, baseOffset)
+	crc := crc32.Update(crc32.Checksum(frame[frameLengthSize:frameLengthSize+1], crc32cTable), crc32cTable, payload)
+	binary.BigEndian.PutUint32(frame[frameLengthSize+1:], crc)
+}
+
+// splitBatchPayload returns the record offsets of a batch frame's payload
+// (everything after the checksum) and the block that follows them
+func splitBatchPayload(payload []byte) ([]uint64, []byte, error) {
+	if len(payload) < batchHeaderSize {
+		return nil, nil, fmt.Errorf("truncated batch header")
+	}
+	base := binary.BigEndian.Uint64(payload)
+	count := binary.BigEndian.Uint32(payload[8:])
+	if count == 0 || int64(count)*4 > int64(len(payload)-batchHeaderSize) {
+		return nil, nil, fmt.Errorf("invalid batch record count %d", count)
+	}
+	offsets := make([]uint64, count)
+	for i := range offsets {
+		offsets[i] = base + uint64(binary.BigEndian.Uint32(payload[batchHeaderSize+4*i:]))
+		if i > 0 && offsets[i] <= offsets[i-1] {
+			return nil, nil, fmt.Errorf("batch offsets must increase")
+		}
+	}
+	return offsets, payload[batchHeaderSize+4*int(count):], nil
+}
+
+// batchOffsets returns the record offsets of a batch frame body
+func batchOffsets(body []byte) ([]uint64, error) {
+	_, payload, err := verifyRecordFrame(body)
+	if err != nil {
+		return nil, err
+	}
+	offsets, _, err := splitBatchPayload(payload)
+	return offsets, err
+}
+
+// frameRecordCount returns the number of records in a checked frame body
+func frameRecordCount(body []byte) int {
+	if !isBatchFrame(body) {
+		return 1
+	}
+	offsets, err := batchOffsets(body)
+	if err != nil {
+		return 1
+	}
+	return len(offsets)
+}
+
+// batchMember is the frame of one record of a batch frame
+type batchMember struct {
+	offset uint64
+	body   []byte
+}
+
+// decodeBatchFrame validates a batch frame body and returns the frames of
+// its records. Encrypted frames are decrypted with keys.
+func decodeBatchFrame(body []byte, keys *keyring) ([]batchMember, error) {
+	attrs, payload, err := verifyRecordFrame(body)
+	if err != nil {
+		return nil, err
+	}
+	offsets, block, err := splitBatchPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	if attrs&recordAttrEncrypted != 0 {
+		decrypted, err := openPayload(keys, attrs, block)
+		if _, unavailable := err.(*KeyUnavailableError); unavailable {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decrypt: %v", err)
+		}
+		block = decrypted
+	}
+	if codec := (attrs & recordAttrCodecMask) >> recordAttrCodecShift; codec != codecNone {
+		decompressed, err := decompressPayload(codec, block)
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %v", err)
+		}
+		block = decompressed
+	}
+	reader := bytes.NewReader(block)
+	members := make([]batchMember, len(offsets))
+	for i, offset := range offsets {
+		member, err := readFrame(reader, int64(reader.Len()))
+		if err != nil {
+			return nil, fmt.Errorf("record %d of batch: %v", offset, err)
+		}
+		if isBatchFrame(member) {
+			return nil, fmt.Errorf("record %d of batch is a batch frame", offset)
+		}
+		members[i] = batchMember{offset: offset, body: member}
+	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes after the last record of batch", reader.Len())
+	}
+	return members, nil
+}
+
+// decodeStoredBatch decodes the batch frame at position in a store file.
+// Failures other than a missing key are reported as a *CorruptRecordError.
+func decodeStoredBatch(body []byte, keys *keyring, storePath string, position int64) ([]batchMember, error) {
+	members, err := decodeBatchFrame(body, keys)
+	if _, unavailable := err.(*KeyUnavailableError); unavailable {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &CorruptRecordError{Path: storePath, Position: position, Reason: err.Error()}
+	}
+	return members, nil
+}
+
+// batchRecord decodes the record at offset from the members of the batch
+// frame at position in a store file
+func batchRecord(members []batchMember, offset uint64, storePath string, position int64) (*entity.Record, error) {
+	i := sort.Search(len(members), func(i int) bool { return members[i].offset >= offset })
+	if i == len(members) || members[i].offset != offset {
+		return nil, &CorruptRecordError{Path: storePath, Position: position, Reason: fmt.Sprintf("batch holds no record at offset %d", offset)}
+	}
+	return decodeStoredRecord(members[i].body, nil, storePath, position)
+}
+
+// batchCache keeps the records of the last batch frame decoded, so reading
+// the records of a batch one after another decodes it once
+type batchCache struct {
+	position int64
+	members  []batchMember
+}
+
+// cached reports whether the frame at position is the cached batch
+func (c *batchCache) cached(position int64) bool {
+	return c.members != nil && c.position == position
+}
+
+// record decodes the record at offset from the cached batch
+func (c *batchCache) record(offset uint64, storePath string) (*entity.Record, error) {
+	return batchRecord(c.members, offset, storePath, c.position)
+}
+
+// decode decodes the record at offset from the frame at position in a store
+// file, which is either the record's own frame or a batch frame that is
+// then cached
+func (c *batchCache) decode(body []byte, offset uint64, keys *keyring, storePath string, position int64) (*entity.Record, error) {
+	if !isBatchFrame(body) {
+		return decodeStoredRecord(body, keys, storePath, position)
+	}
+	members, err := decodeStoredBatch(body, keys, storePath, position)
+	if err != nil {
+		return nil, err
+	}
+	c.position, c.members = position, members
+	return c.record(offset, storePath)
+}
+
+// checkBatchFrame validates a batch frame as far as it can without keys,
+// which for an encrypted frame is up to its checksum, offsets and envelope
+func checkBatchFrame(body []byte) error {
+	attrs, payload, err := verifyRecordFrame(body)
+	if err != nil {
+		return err
+	}
+	_, block, err := splitBatchPayload(payload)
+	if err != nil {
+		return err
+	}
+	if attrs&recordAttrEncrypted != 0 {
+		_, _, _, err = splitEnvelope(block)
+		return err
+	}
+	members, err := decodeBatchFrame(body, nil)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if _, err := decodeRecordFrame(member.body, nil); err != nil {
+			return fmt.Errorf("record %d of batch: %v", member.offset, err)
+		}
+	}
+	return nil
+}
+
+// rebatchFrame returns a batch frame body holding only the records of body
+// at the given offsets, with the codec and key body was written with. The
+// block is stored uncompressed if the codec no longer makes it smaller.
+func rebatchFrame(body []byte, keys *keyring, offsets []uint64) ([]byte, error) {
+	attrs, payload, err := verifyRecordFrame(body)
+	if err != nil {
+		return nil, err
+	}
+	members, err := decodeBatchFrame(body, keys)
+	if err != nil {
+		return nil, err
+	}
+	var key *frameKey
+	if attrs&recordAttrEncrypted != 0 {
+		_, block, _ := splitBatchPayload(payload)
+		id, _, _, err := splitEnvelope(block)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := keys.cipher(id, nil)
+		if err != nil {
+			return nil, &KeyUnavailableError{KeyID: id, Err: err}
+		}
+		key = &frameKey{id: id, aead: aead}
+	}
+	var block bytes.Buffer
+	var deltas []uint32
+	for _, member := range members {
+		i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= member.offset })
+		if i == len(offsets) || offsets[i] != member.offset {
+			continue
+		}
+		deltas = append(deltas, uint32(member.offset-offsets[0]))
+		binary.Write(&block, binary.BigEndian, uint32(len(member.body)))
+		block.Write(member.body)
+	}
+	if len(deltas) != len(offsets) {
+		return nil, fmt.Errorf("batch holds %d of the %d records to keep", len(deltas), len(offsets))
+	}
+	codec := (attrs & recordAttrCodecMask) >> recordAttrCodecShift
+	stored := compressPayload(codec, block.Bytes())
+	if stored == nil {
+		codec, stored = codecNone, block.Bytes()
+	}
+	frame := newBatchFrame(codec, key, stored, deltas)
+	finishBatchFrame(frame, offsets[0])
+	return frame[frameLengthSize:], nil
+}
@@ -0,0 +1,271 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"gostorelog/internal/entity"
+)
+
+// Store frame layout:
+//
+//	legacy:      [length 4][dataType 1][data]
+//	checksummed: [length 4][attrs 1][crc32c 4][data]
+//	extended:    [length 4][attrs 1][crc32c 4][timestamp 8][keyLen 4][key]
+//	             [headerCount 4]([nameLen 2][name][valueLen 4][value])*[data]
+//
+// length covers everything after the length prefix. The attrs byte keeps the
+// data type in its low bits so legacy frames (no flag bits set) still decode.
+// The checksum is CRC32C over the attrs byte followed by everything after the
+// checksum. Timestamps are Unix nanoseconds, 0 meaning unknown. A non-zero
+// codec in the attrs byte means everything after the checksum of an extended
+// frame is compressed with that codec (see compression.go); the encrypted
+// flag means it is then sealed in an envelope (see encryption.go). The
+// tombstone flag marks an extended frame whose record deletes its key. An
+// extended frame whose type bits hold recordTypeBatch carries the records of
+// an append batch (see record_batch.go).
+const (
+	recordAttrTypeMask   byte = 0x03
+	recordAttrEncrypted  byte = 0x04
+	recordAttrCodecMask  byte = 0x18
+	recordAttrCodecShift      = 3
+	recordAttrTombstone  byte = 0x20
+	recordAttrExtended   byte = 0x40
+	recordAttrChecksum   byte = 0x80
+
+	frameLengthSize   = 4
+	frameChecksumSize = 4
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptRecordError is returned when a stored record fails validation
+type CorruptRecordError struct {
+	Path     string // Store file containing the record
+	Position int64  // Position of the frame in the store file
+	Reason   string // What failed validation
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record in %s at position %d: %s", e.Path, e.Position, e.Reason)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return entity.ErrCorrupted
+}
+
+// encodeRecordFrame encodes a record into an extended, checksummed store
+// frame, compressed with codec if that makes it smaller and encrypted with
+// key unless it is nil
+func encodeRecordFrame(record *entity.Record, codec byte, key *frameKey) []byte {
+	var payload bytes.Buffer
+	var timestamp int64
+	if !record.Timestamp.IsZero() {
+		timestamp = record.Timestamp.UnixNano()
+	}
+	binary.Write(&payload, binary.BigEndian, timestamp)
+	binary.Write(&payload, binary.BigEndian, uint32(len(record.Key)))
+	payload.WriteString(record.Key)
+	names := make([]string, 0, len(record.Headers))
+	for name := range record.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	binary.Write(&payload, binary.BigEndian, uint32(len(names)))
+	for _, name := range names {
+		binary.Write(&payload, binary.BigEndian, uint16(len(name)))
+		payload.WriteString(name)
+		binary.Write(&payload, binary.BigEndian, uint32(len(record.Headers[name])))
+		payload.Write(record.Headers[name])
+	}
+	payload.Write(record.Data)
+
+	attrs := (byte(record.DataType) & recordAttrTypeMask) | recordAttrExtended | recordAttrChecksum
+	if record.Tombstone {
+		attrs |= recordAttrTombstone
+	}
+	stored := payload.Bytes()
+	if compressed := compressPayload(codec, stored); compressed != nil {
+		attrs |= codec << recordAttrCodecShift
+		stored = compressed
+	}
+	if key != nil {
+		attrs |= recordAttrEncrypted
+		stored = sealPayload(key, attrs, stored)
+	}
+	frame := make([]byte, frameLengthSize+1+frameChecksumSize+len(stored))
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-frameLengthSize))
+	frame[frameLengthSize] = attrs
+	copy(frame[frameLengthSize+1+frameChecksumSize:], stored)
+	crc := crc32.Update(crc32.Checksum([]byte{attrs}, crc32cTable), crc32cTable, stored)
+	binary.BigEndian.PutUint32(frame[frameLengthSize+1:], crc)
+	return frame
+}
+
+// decodeRecordFrame validates a frame body (everything after the length
+// prefix) and returns the record it carries, without offset or partition key.
+// Encrypted frames are decrypted with keys.
+func decodeRecordFrame(body []byte, keys *keyring) (*entity.Record, error) {
+	attrs, payload, err := verifyRecordFrame(body)
+	if err != nil {
+		return nil, err
+	}
+	if isBatchFrame(body) {
+		return nil, fmt.Errorf("batch frame where a record frame was expected")
+	}
+	record := &entity.Record{DataType: entity.DataType(attrs & recordAttrTypeMask), Tombstone: attrs&recordAttrTombstone != 0}
+	if attrs&recordAttrExtended == 0 {
+		record.Data = payload
+		return record, nil
+	}
+	if attrs&recordAttrEncrypted != 0 {
+		decrypted, err := openPayload(keys, attrs, payload)
+		if _, unavailable := err.(*KeyUnavailableError); unavailable {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decrypt: %v", err)
+		}
+		payload = decrypted
+	}
+	if codec := (attrs & recordAttrCodecMask) >> recordAttrCodecShift; codec != codecNone {
+		decompressed, err := decompressPayload(codec, payload)
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %v", err)
+		}
+		payload = decompressed
+	}
+	if err := decodeExtendedPayload(payload, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// decodeStoredRecord decodes the frame at position in a store file. Failures
+// other than a missing key are reported as a *CorruptRecordError.
+func decodeStoredRecord(body []byte, keys *keyring, storePath string, position int64) (*entity.Record, error) {
+	record, err := decodeRecordFrame(body, keys)
+	if _, unavailable := err.(*KeyUnavailableError); unavailable {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &CorruptRecordError{Path: storePath, Position: position, Reason: err.Error()}
+	}
+	return record, nil
+}
+
+// checkRecordFrame validates a frame as far as it can without keys, which
+// for an encrypted frame is up to its checksum and envelope
+func checkRecordFrame(body []byte) error {
+	if isBatchFrame(body) {
+		return checkBatchFrame(body)
+	}
+	if len(body) > 0 && body[0]&recordAttrEncrypted != 0 {
+		_, payload, err := verifyRecordFrame(body)
+		if err != nil {
+			return err
+		}
+		_, _, _, err = splitEnvelope(payload)
+		return err
+	}
+	_, err := decodeRecordFrame(body, nil)
+	return err
+}
+
+// verifyRecordFrame checks the attrs byte and checksum of a frame body and
+// returns the attrs and everything after the checksum
+func verifyRecordFrame(body []byte) (byte, []byte, error) {
+	if len(body) == 0 {
+		return 0, nil, fmt.Errorf("empty frame")
+	}
+	attrs := body[0]
+	if attrs&(recordAttrCodecMask|recordAttrEncrypted|recordAttrTombstone) != 0 && attrs&recordAttrExtended == 0 {
+		return 0, nil, fmt.Errorf("unknown attributes %#x", attrs)
+	}
+	payload := body[1:]
+	if attrs&recordAttrChecksum != 0 {
+		if len(body) < 1+frameChecksumSize {
+			return 0, nil, fmt.Errorf("frame too short for checksum")
+		}
+		stored := binary.BigEndian.Uint32(body[1:])
+		payload = body[1+frameChecksumSize:]
+		computed := crc32.Update(crc32.Checksum(body[:1], crc32cTable), crc32cTable, payload)
+		if stored != computed {
+			return 0, nil, fmt.Errorf("checksum mismatch: stored %#08x, computed %#08x", stored, computed)
+		}
+	}
+	return attrs, payload, nil
+}
+
+// decodeExtendedPayload parses the timestamp, key and headers that precede
+// the data in an extended frame
+func decodeExtendedPayload(payload []byte, record *entity.Record) error {
+	reader := bytes.NewReader(payload)
+	var timestamp int64
+	var keyLen, headerCount uint32
+	if err := binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+		return fmt.Errorf("truncated timestamp")
+	}
+	if timestamp != 0 {
+		record.Timestamp = time.Unix(0, timestamp)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil || int64(keyLen) > int64(reader.Len()) {
+		return fmt.Errorf("truncated key")
+	}
+	key := make([]byte, keyLen)
+	reader.Read(key)
+	record.Key = string(key)
+	// Each header takes at least 6 bytes
+	if err := binary.Read(reader, binary.BigEndian, &headerCount); err != nil || int64(headerCount)*6 > int64(reader.Len()) {
+		return fmt.Errorf("truncated headers")
+	}
+	if headerCount > 0 {
+		record.Headers = make(map[string][]byte, headerCount)
+	}
+	for i := uint32(0); i < headerCount; i++ {
+		var nameLen uint16
+		var valueLen uint32
+		if err := binary.Read(reader, binary.BigEndian, &nameLen); err != nil || int(nameLen) > reader.Len() {
+			return fmt.Errorf("truncated header name")
+		}
+		name := make([]byte, nameLen)
+		reader.Read(name)
+		if err := binary.Read(reader, binary.BigEndian, &valueLen); err != nil || int64(valueLen) > int64(reader.Len()) {
+			return fmt.Errorf("truncated header value")
+		}
+		value := make([]byte, valueLen)
+		reader.Read(value)
+		record.Headers[string(name)] = value
+	}
+	record.Data = payload[len(payload)-reader.Len():]
+	return nil
+}
+
+// readFrame reads the next frame body from r. remaining is the number of
+// bytes left in the file and bounds the declared length. It returns io.EOF
+// at a clean end of file and io.ErrUnexpectedEOF for a partially written frame.
+func readFrame(r io.Reader, remaining int64) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("zero frame length")
+	}
+	if int64(length) > remaining-frameLengthSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"gostorelog/internal/entity"
+)
+
+// recoveryReport summarizes what startup recovery changed in a partition
+type recoveryReport struct {
+	Segments       int   // Segments checked
+	TruncatedBytes int64 // Partially written store bytes removed
+	DroppedEntries int   // Index entries removed because they were torn or dangling
+	RebuiltIndexes int   // Index files rebuilt from their store file
+}
+
+func (rep *recoveryReport) changed() bool {
+	return rep.TruncatedBytes > 0 || rep.DroppedEntries > 0 || rep.RebuiltIndexes > 0
+}
+
+// recoverSegment makes a segment consistent after a crash. An index entry
+// counts as committed only if it points at a valid frame, so torn and dangling
+// entries at the end of the index are dropped and store bytes after the last
+// indexed frame are truncated. A missing index is rebuilt from the store.
+func recoverSegment(seg *entity.Segment, report *recoveryReport) error {
+	report.Segments++
+	hdr := headerSize(seg)
+
+	storeFile, err := os.OpenFile(seg.StorePath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		// Nothing the index points at exists
+		return truncateIndex(seg, 0, report)
+	}
+	if err != nil {
+		return err
+	}
+	defer storeFile.Close()
+	stat, err := storeFile.Stat()
+	if err != nil {
+		return err
+	}
+	storeSize := stat.Size()
+
+	indexFile, err := os.OpenFile(seg.IndexPath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		if storeSize <= hdr {
+			return nil
+		}
+		return rebuildSegmentIndex(seg, storeFile, storeSize, report)
+	}
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	indexStat, err := indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	// Preallocated space left by a crash is not counted
+	count, err := indexEntryCount(indexFile, seg)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		if storeSize <= hdr {
+			if indexStat.Size() > hdr {
+				return indexFile.Truncate(hdr)
+			}
+			return nil
+		}
+		return rebuildSegmentIndex(seg, storeFile, storeSize, report)
+	}
+	if indexBytes := indexStat.Size() - hdr; indexBytes%indexEntrySize != 0 {
+		// A torn entry at the end
+		report.DroppedEntries++
+	}
+
+	// Walk back from the last entry to the newest one pointing at a valid frame
+	end := hdr
+	kept := int64(0)
+	for slot := count - 1; slot >= 0; slot-- {
+		entry, err := readIndexEntry(indexFile, seg, slot)
+		if err != nil {
+			return err
+		}
+		if frameEnd, ok := validIndexEntry(seg, storeFile, storeSize, slot, entry); ok {
+			end = frameEnd
+			kept = slot + 1
+			break
+		}
+		report.DroppedEntries++
+	}
+
+	if indexEnd := hdr + kept*indexEntrySize; indexEnd != indexStat.Size() {
+		if err := indexFile.Truncate(indexEnd); err != nil {
+			return err
+		}
+		if err := indexFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if storeSize > end {
+		if err := storeFile.Truncate(end); err != nil {
+			return err
+		}
+		if err := storeFile.Sync(); err != nil {
+			return err
+		}
+		report.TruncatedBytes += storeSize - end
+	}
+	return nil
+}
+
+// validIndexEntry checks that an index entry holds a plausible offset and
+// points at a complete, valid frame, returning where that frame ends. An
+// entry pointing at a batch frame must be the one of its last record, so a
+// batch whose entries were only partly written is dropped as a whole.
+func validIndexEntry(seg *entity.Segment, storeFile *os.File, storeSize int64, slot int64, entry indexEntry) (int64, bool) {
+	if seg.Compacted {
+		if entry.Offset < seg.BaseOffset+uint64(slot) {
+			return 0, false
+		}
+	} else if entry.Offset != seg.BaseOffset+uint64(slot) {
+		return 0, false
+	}
+	position := int64(entry.Position)
+	if position < headerSize(seg) || position >= storeSize {
+		return 0, false
+	}
+	remaining := storeSize - position
+	body, err := readFrame(io.NewSectionReader(storeFile, position, remaining), remaining)
+	if err != nil {
+		return 0, false
+	}
+	if err := checkRecordFrame(body); err != nil {
+		return 0, false
+	}
+	if isBatchFrame(body) {
+		offsets, err := batchOffsets(body)
+		if err != nil || entry.Offset != offsets[len(offsets)-1] {
+			return 0, false
+		}
+	}
+	return position + frameLengthSize + int64(len(body)), true
+}
+
+// rebuildSegmentIndex writes a new index for every valid frame in the store
+// and truncates whatever follows the last one
+func rebuildSegmentIndex(seg *entity.Segment, storeFile *os.File, storeSize int64, report *recoveryReport) error {
+	if seg.Compacted {
+		return fmt.Errorf("segment %s: index of a compacted segment cannot be rebuilt", seg.StorePath)
+	}
+	var entries bytes.Buffer
+	end := headerSize(seg)
+	next := seg.BaseOffset
+	err := walkStoreFrames(seg.StorePath, end, func(position int64, body []byte) error {
+		for i := frameRecordCount(body); i > 0; i-- {
+			binary.Write(&entries, binary.BigEndian, next)
+			binary.Write(&entries, binary.BigEndian, uint64(position))
+			next++
+		}
+		end = position + frameLengthSize + int64(len(body))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Rebuilding index of segment %s stops at %v", seg.StorePath, err)
+	}
+
+	indexFile, err := os.OpenFile(seg.IndexPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	if err := ensureSegmentHeader(indexFile, seg, indexMagic); err != nil {
+		return err
+	}
+	if _, err := indexFile.Write(entries.Bytes()); err != nil {
+		return err
+	}
+	if err := indexFile.Sync(); err != nil {
+		return err
+	}
+	report.RebuiltIndexes++
+
+	if storeSize > end {
+		if err := storeFile.Truncate(end); err != nil {
+			return err
+		}
+		if err := storeFile.Sync(); err != nil {
+			return err
+		}
+		report.TruncatedBytes += storeSize - end
+	}
+	return nil
+}
+
+// truncateIndex cuts an index file down to keep entries
+func truncateIndex(seg *entity.Segment, keep int64, report *recoveryReport) error {
+	indexFile, err := os.OpenFile(seg.IndexPath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	stat, err := indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	indexEnd := headerSize(seg) + keep*indexEntrySize
+	if stat.Size() <= indexEnd {
+		return nil
+	}
+	report.DroppedEntries += int((stat.Size() - indexEnd + indexEntrySize - 1) / indexEntrySize)
+	if err := indexFile.Truncate(indexEnd); err != nil {
+		return err
+	}
+	return indexFile.Sync()
+}
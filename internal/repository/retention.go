@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gostorelog/internal/entity"
+)
+
+const defaultRetentionCheckInterval = time.Minute
+
+// OffsetOutOfRangeError is returned when reading an offset that retention
+// has already deleted
+type OffsetOutOfRangeError struct {
+	PartitionKey   string
+	Offset         uint64
+	EarliestOffset uint64 // Lowest offset still available in the partition
+}
+
+func (e *OffsetOutOfRangeError) Error() string {
+	return fmt.Sprintf("offset %d out of range for partition %s: earliest available offset is %d (older records were removed by retention)", e.Offset, e.PartitionKey, e.EarliestOffset)
+}
+
+func (e *OffsetOutOfRangeError) Unwrap() error {
+	return entity.ErrOutOfRange
+}
+
+// checkEarliest rejects offsets below the earliest offset still stored
+func checkEarliest(partition *entity.Partition, offset uint64) error {
+	if earliest := partition.EarliestOffset(); offset < earliest {
+		return &OffsetOutOfRangeError{PartitionKey: partition.Key, Offset: offset, EarliestOffset: earliest}
+	}
+	return nil
+}
+
+// retentionWorker periodically enforces the configured retention policies
+// until the repository is closed
+func (r *FileStorageRepository) retentionWorker() {
+	interval := r.config.RetentionCheckInterval
+	if interval <= 0 {
+		interval = defaultRetentionCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.enforceRetention(time.Now())
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// enforceRetention applies each partition's retention policy as of now,
+// deleting expired segments and then compacting what is left
+func (r *FileStorageRepository) enforceRetention(now time.Time) {
+	for key, state := range r.partitionStates() {
+		policy := r.config.RetentionFor(key)
+		if !policy.Enabled() {
+			continue
+		}
+		r.enforcePartitionRetention(state, policy, now)
+	}
+}
+
+// enforcePartitionRetention applies a policy to one partition. Appends to
+// the partition wait until it is done; reads only wait while segments are
+// deleted or replaced.
+func (r *FileStorageRepository) enforcePartitionRetention(state *partitionState, policy entity.RetentionPolicy, now time.Time) {
+	state.appendMu.Lock()
+	defer state.appendMu.Unlock()
+	if state.deleted {
+		return
+	}
+
+	state.mu.Lock()
+	deleted := r.applyRetention(state.Partition, policy, now)
+	earliest := state.EarliestOffset()
+	state.mu.Unlock()
+	if deleted > 0 {
+		log.Printf("Retention removed %d segment(s) from partition %s, earliest offset is now %d", deleted, state.Key, earliest)
+	}
+	if policy.Compact {
+		removed, err := r.compactPartition(state, policy, now)
+		if err != nil {
+			log.Printf("Compaction of partition %s failed: %v", state.Key, err)
+		} else if removed > 0 {
+			log.Printf("Compaction removed %d record(s) from partition %s", removed, state.Key)
+		}
+	}
+}
+
+// applyRetention deletes the oldest closed segments of a partition that are
+// past the policy's age or size limit and returns how many were deleted. The
+// newest segment is always kept so the partition's offsets survive a restart.
+// Callers must hold both of the partition's locks.
+func (r *FileStorageRepository) applyRetention(partition *entity.Partition, policy entity.RetentionPolicy, now time.Time) int {
+	segments := orderedSegments(partition)
+	active := partition.GetActiveSegment()
+
+	sizes := make([]uint64, len(segments))
+	totalBytes := uint64(0)
+	for i, seg := range segments {
+		sizes[i] = segmentDiskSize(seg)
+		totalBytes += sizes[i]
+	}
+
+	deleted := 0
+	for deleted < len(segments)-1 && segments[deleted] != active {
+		seg := segments[deleted]
+		expired := false
+		if policy.MaxBytes > 0 && totalBytes > policy.MaxBytes {
+			expired = true
+		} else if policy.MaxAge > 0 {
+			newest, err := segmentNewestTimestamp(seg, r.keys)
+			if err != nil {
+				log.Printf("Retention skipped segment %s: %v", seg.StorePath, err)
+				break
+			}
+			expired = now.Sub(newest) > policy.MaxAge
+		}
+		if !expired {
+			break
+		}
+		r.handles.evict(seg.StorePath)
+		r.handles.evict(seg.IndexPath)
+		r.handles.evict(seg.TimeIndexPath)
+		if err := removeSegmentFiles(seg); err != nil {
+			log.Printf("Retention failed to delete segment %s: %v", seg.StorePath, err)
+			break
+		}
+		totalBytes -= sizes[deleted]
+		deleted++
+	}
+	if deleted == 0 {
+		return 0
+	}
+
+	// Drop the deleted segments, along with any empty entries sharing their range
+	earliest := segments[deleted].BaseOffset
+	kept := make([]*entity.Segment, 0, len(partition.Segments))
+	for _, seg := range partition.Segments {
+		if seg != nil && (seg.BaseOffset >= earliest || seg == active) {
+			kept = append(kept, seg)
+		}
+	}
+	partition.Segments = kept
+	return deleted
+}
+
+// segmentDiskSize returns the bytes a segment occupies on disk, leaving out
+// space preallocated for the active segment's index
+func segmentDiskSize(seg *entity.Segment) uint64 {
+	size := uint64(0)
+	if stat, err := os.Stat(seg.StorePath); err == nil {
+		size += uint64(stat.Size())
+	}
+	if stat, err := os.Stat(seg.IndexPath); err == nil {
+		indexSize := uint64(stat.Size())
+		if used := uint64(headerSize(seg)) + (seg.NextOffset-seg.BaseOffset)*indexEntrySize; !seg.Compacted && used < indexSize {
+			indexSize = used
+		}
+		size += indexSize
+	}
+	return size
+}
+
+// segmentNewestTimestamp returns the timestamp of the last record in a
+// segment, falling back to the store file's modification time for records
+// written before timestamps were stored
+func segmentNewestTimestamp(seg *entity.Segment, keys *keyring) (time.Time, error) {
+	indexFile, err := os.Open(seg.IndexPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer indexFile.Close()
+	count, err := indexEntryCount(indexFile, seg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if count == 0 {
+		return time.Time{}, fmt.Errorf("segment %s has no index entries", seg.StorePath)
+	}
+	entry, err := readIndexEntry(indexFile, seg, count-1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	storeFile, err := os.Open(seg.StorePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer storeFile.Close()
+	record, err := readRecordAt(storeFile, seg.StorePath, int64(entry.Position), entry.Offset, keys, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if record.Timestamp.IsZero() {
+		stat, err := storeFile.Stat()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return stat.ModTime(), nil
+	}
+	return record.Timestamp, nil
+}
+
+// removeSegmentFiles deletes a segment's files
+func removeSegmentFiles(seg *entity.Segment) error {
+	for _, path := range []string{seg.TimeIndexPath, seg.IndexPath, seg.StorePath} {
+		if err := removeIfExists(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
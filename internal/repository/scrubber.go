@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// scrubCursor identifies the last segment the scrubber verified
+type scrubCursor struct {
+	partitionKey string
+	baseOffset   uint64
+}
+
+// scrubWorker verifies one closed segment every ScrubInterval, cycling
+// through all partitions, until the repository is closed
+func (r *FileStorageRepository) scrubWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var cursor *scrubCursor
+	for {
+		select {
+		case <-ticker.C:
+			cursor = r.scrubNext(cursor)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// scrubNext verifies the closed segment following cursor and returns the
+// new cursor. Inconsistent segments are logged and their partition is
+// queued for repair.
+func (r *FileStorageRepository) scrubNext(cursor *scrubCursor) *scrubCursor {
+	states := r.partitionStates()
+	candidates := []scrubCursor{}
+	for partitionKey, state := range states {
+		state.mu.RLock()
+		for _, seg := range orderedSegments(state.Partition) {
+			if !seg.IsActive {
+				candidates = append(candidates, scrubCursor{partitionKey: partitionKey, baseOffset: seg.BaseOffset})
+			}
+		}
+		state.mu.RUnlock()
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].partitionKey != candidates[j].partitionKey {
+			return candidates[i].partitionKey < candidates[j].partitionKey
+		}
+		return candidates[i].baseOffset < candidates[j].baseOffset
+	})
+
+	next := candidates[0]
+	if cursor != nil {
+		i := sort.Search(len(candidates), func(i int) bool {
+			c := candidates[i]
+			return c.partitionKey > cursor.partitionKey ||
+				(c.partitionKey == cursor.partitionKey && c.baseOffset > cursor.baseOffset)
+		})
+		if i < len(candidates) {
+			next = candidates[i]
+		}
+	}
+
+	// Verify without holding the partition lock so appends are not delayed
+	view, err := r.openClosedSegment(states[next.partitionKey], next.baseOffset)
+	if err == nil && view == nil {
+		// Removed by retention in the meantime
+		return &next
+	}
+	if err == nil {
+		err = verifySegment(&view.seg, view.store.file, view.index.file)
+		r.closeSegmentView(view)
+	}
+	if err != nil {
+		log.Printf("Scrubber found inconsistent segment %d of partition %s: %v, triggering repair", next.baseOffset, next.partitionKey, err)
+		r.requestRepair(next.partitionKey)
+	}
+	return &next
+}
+
+// openClosedSegment opens the closed segment of a partition starting at
+// baseOffset, or returns nil if there is none
+func (r *FileStorageRepository) openClosedSegment(state *partitionState, baseOffset uint64) (*segmentView, error) {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	if state.deleted {
+		return nil, nil
+	}
+	seg := state.SegmentAt(baseOffset)
+	if seg == nil || seg.BaseOffset != baseOffset || seg.IsActive {
+		return nil, nil
+	}
+	return r.openSegmentView(seg)
+}
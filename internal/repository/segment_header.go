@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"gostorelog/internal/entity"
+)
+
+// Segment file header layout (both .store and .index):
+//
+//	[magic 4][version 2][flags 2][baseOffset 8]
+//
+// Files written before headers existed have no header and are treated as
+// format version 0.
+const (
+	segmentHeaderSize = 16
+	indexEntrySize    = 16 // [offset 8][position 8]
+
+	// segmentFlagCompacted marks a segment rewritten by compaction, whose
+	// index only holds the offsets that survived
+	segmentFlagCompacted uint16 = 0x0001
+	knownSegmentFlags           = segmentFlagCompacted
+)
+
+var (
+	storeMagic = [4]byte{'G', 'S', 'L', 'S'}
+	indexMagic = [4]byte{'G', 'S', 'L', 'I'}
+)
+
+// segmentHeader is the header at the start of a segment file
+type segmentHeader struct {
+	Magic      [4]byte
+	Version    uint16
+	Flags      uint16
+	BaseOffset uint64
+}
+
+// headerSize returns the size of the file header for a segment's format version
+func headerSize(seg *entity.Segment) int64 {
+	if seg.FormatVersion == 0 {
+		return 0
+	}
+	return segmentHeaderSize
+}
+
+// writeSegmentHeader writes a header for the current format version
+func writeSegmentHeader(w io.Writer, magic [4]byte, baseOffset uint64, flags uint16) error {
+	return binary.Write(w, binary.BigEndian, segmentHeader{
+		Magic:      magic,
+		Version:    entity.SegmentFormatVersion,
+		Flags:      flags,
+		BaseOffset: baseOffset,
+	})
+}
+
+// readSegmentHeader reads the header of a segment file. A missing or empty
+// file yields nil. A file without magic is accepted as a headerless (version
+// 0) segment only if its first entry looks like one; otherwise it is rejected
+// as an unrecognized file.
+func readSegmentHeader(path string, magic [4]byte, baseOffset uint64) (*segmentHeader, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefix := make([]byte, segmentHeaderSize)
+	n, err := io.ReadFull(file, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	prefix = prefix[:n]
+	if n == 0 {
+		return nil, nil
+	}
+
+	if n >= len(magic) && bytes.Equal(prefix[:len(magic)], magic[:]) {
+		if n < segmentHeaderSize {
+			return nil, fmt.Errorf("%s: truncated segment header", path)
+		}
+		var header segmentHeader
+		binary.Read(bytes.NewReader(prefix), binary.BigEndian, &header)
+		if header.Version == 0 || header.Version > entity.SegmentFormatVersion {
+			return nil, fmt.Errorf("%s: unsupported segment format version %d (supported up to %d)", path, header.Version, entity.SegmentFormatVersion)
+		}
+		if header.Flags&^knownSegmentFlags != 0 {
+			return nil, fmt.Errorf("%s: unsupported segment flags %#04x", path, header.Flags)
+		}
+		if header.BaseOffset != baseOffset {
+			return nil, fmt.Errorf("%s: header base offset %d does not match file name offset %d", path, header.BaseOffset, baseOffset)
+		}
+		return &header, nil
+	}
+
+	if !looksLikeLegacySegment(prefix, magic, baseOffset) {
+		return nil, fmt.Errorf("%s: not a segment file", path)
+	}
+	return &segmentHeader{Magic: magic, BaseOffset: baseOffset}, nil
+}
+
+// looksLikeLegacySegment checks whether the start of a headerless file is
+// plausibly a version 0 store or index file
+func looksLikeLegacySegment(prefix []byte, magic [4]byte, baseOffset uint64) bool {
+	if magic == indexMagic {
+		// First entry must map the base offset to position 0
+		if len(prefix) < indexEntrySize {
+			return false
+		}
+		return binary.BigEndian.Uint64(prefix[:8]) == baseOffset && binary.BigEndian.Uint64(prefix[8:16]) == 0
+	}
+	// First frame must have a sane length and a known data type
+	if len(prefix) < frameLengthSize+1 {
+		return false
+	}
+	length := binary.BigEndian.Uint32(prefix[:frameLengthSize])
+	attrs := prefix[frameLengthSize]
+	return length > 0 && attrs&^(recordAttrTypeMask|recordAttrChecksum) == 0 &&
+		entity.DataType(attrs&recordAttrTypeMask) <= entity.DataTypeString
+}
+
+// ensureSegmentHeader writes the header to a freshly created segment file
+func ensureSegmentHeader(file *os.File, seg *entity.Segment, magic [4]byte) error {
+	if seg.FormatVersion == 0 {
+		return nil
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() > 0 {
+		return nil
+	}
+	return writeSegmentHeader(file, magic, seg.BaseOffset, 0)
+}
@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+
+	"gostorelog/internal/entity"
+)
+
+// Index entries are sorted by offset. They are dense (entry i holds
+// BaseOffset+i) unless the segment was compacted, in which case offsets that
+// were compacted away have no entry. The index of the active segment is
+// preallocated, so it may end in zeroed entries that are not in use yet.
+
+// indexEntry maps an offset to the position of its frame in the store file
+type indexEntry struct {
+	Offset   uint64
+	Position uint64
+}
+
+// indexEntryCount returns the number of complete entries in an index file,
+// leaving out preallocated space
+func indexEntryCount(indexFile *os.File, seg *entity.Segment) (int64, error) {
+	stat, err := indexFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size() - headerSize(seg)
+	if size <= 0 {
+		return 0, nil
+	}
+	count := size / indexEntrySize
+	// Frames follow the header, so only unused entries point at position 0.
+	// Headerless legacy segments are never preallocated.
+	if headerSize(seg) == 0 {
+		return count, nil
+	}
+	last, err := readIndexEntry(indexFile, seg, count-1)
+	if err != nil || last.Position != 0 {
+		return count, err
+	}
+	var searchErr error
+	used := sort.Search(int(count), func(i int) bool {
+		entry, err := readIndexEntry(indexFile, seg, int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return entry.Position == 0
+	})
+	return int64(used), searchErr
+}
+
+// readIndexEntry reads the entry in the given slot of an index file
+func readIndexEntry(indexFile *os.File, seg *entity.Segment, slot int64) (indexEntry, error) {
+	buf := make([]byte, indexEntrySize)
+	if _, err := indexFile.ReadAt(buf, headerSize(seg)+slot*indexEntrySize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return indexEntry{}, err
+	}
+	return indexEntry{
+		Offset:   binary.BigEndian.Uint64(buf[:8]),
+		Position: binary.BigEndian.Uint64(buf[8:]),
+	}, nil
+}
+
+// indexEntries is a run of encoded index entries held in memory
+type indexEntries []byte
+
+// mappedEntries returns the entries of seg in a mapped index file. It
+// returns false if the mapping does not hold every entry up to the segment's
+// next offset yet, in which case the file must be mapped again.
+func mappedEntries(data []byte, seg *entity.Segment) (indexEntries, bool) {
+	hdr := headerSize(seg)
+	if int64(len(data)) < hdr {
+		return nil, seg.NextOffset == seg.BaseOffset
+	}
+	entries := indexEntries(data[hdr:])
+	entries = entries[:entries.count()*indexEntrySize]
+	if seg.Compacted {
+		return entries, true
+	}
+	used := int64(seg.NextOffset - seg.BaseOffset)
+	if entries.count() < used {
+		return nil, false
+	}
+	entries = entries[:used*indexEntrySize]
+	if hdr > 0 && used > 0 && entries.at(used-1).Position == 0 {
+		return nil, false
+	}
+	return entries, true
+}
+
+// count returns the number of entries
+func (e indexEntries) count() int64 {
+	return int64(len(e)) / indexEntrySize
+}
+
+// at returns the entry in the given slot
+func (e indexEntries) at(slot int64) indexEntry {
+	buf := e[slot*indexEntrySize:]
+	return indexEntry{
+		Offset:   binary.BigEndian.Uint64(buf[:8]),
+		Position: binary.BigEndian.Uint64(buf[8:16]),
+	}
+}
+
+// search returns the slot of the first entry with an offset at or after
+// offset, and count if there is none. Dense indexes are resolved with a
+// single probe; compacted ones fall back to a binary search.
+func (e indexEntries) search(seg *entity.Segment, offset uint64) int64 {
+	count := e.count()
+	if offset <= seg.BaseOffset {
+		return 0
+	}
+	slot := int64(offset - seg.BaseOffset)
+	if slot < count && e.at(slot).Offset == offset {
+		return slot
+	}
+	return int64(sort.Search(int(count), func(i int) bool {
+		return e.at(int64(i)).Offset >= offset
+	}))
+}
+
+// readIndexEntries reads every entry of a segment's index
+func readIndexEntries(seg *entity.Segment) ([]indexEntry, error) {
+	indexFile, err := os.Open(seg.IndexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer indexFile.Close()
+	return readIndexFile(indexFile, seg)
+}
+
+// readIndexFile reads every entry of an open index file
+func readIndexFile(indexFile *os.File, seg *entity.Segment) ([]indexEntry, error) {
+	count, err := indexEntryCount(indexFile, seg)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, count*indexEntrySize)
+	if _, err := indexFile.ReadAt(buf, headerSize(seg)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	entries := make([]indexEntry, count)
+	for i := range entries {
+		entries[i].Offset = binary.BigEndian.Uint64(buf[i*indexEntrySize:])
+		entries[i].Position = binary.BigEndian.Uint64(buf[i*indexEntrySize+8:])
+	}
+	return entries, nil
+}
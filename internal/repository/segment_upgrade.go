@@ -0,0 +1,193 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gostorelog/internal/entity"
+)
+
+// UpgradeSummary reports what UpgradeDataDir did
+type UpgradeSummary struct {
+	// Upgraded counts the segments rewritten into the current format
+	Upgraded int
+	// Skipped names the directories under the data directory that were left
+	// as they are, because they map to no partition key, could not be renamed
+	// from a raw key or could not be read
+	Skipped []string
+}
+
+// UpgradeDataDir rewrites every segment under dataDir that is headerless or
+// in an older format version into the current segment format. It must not
+// run while a server is using dataDir. Partition directories named after
+// their raw key are renamed to their encoded name first. A segment that
+// fails to upgrade stops the upgrade; the summary then covers the work done
+// before.
+func UpgradeDataDir(dataDir string) (UpgradeSummary, error) {
+	var summary UpgradeSummary
+	partitions, err := os.ReadDir(dataDir)
+	if err != nil {
+		return summary, err
+	}
+	for _, partitionEntry := range partitions {
+		if !partitionEntry.IsDir() {
+			continue
+		}
+		partitionKey, err := migratePartitionDir(dataDir, partitionEntry.Name())
+		if err != nil {
+			log.Printf("Skipping directory %s: %v", partitionEntry.Name(), err)
+			summary.Skipped = append(summary.Skipped, partitionEntry.Name())
+			continue
+		}
+		files, err := os.ReadDir(entity.PartitionDir(dataDir, partitionKey))
+		if err != nil {
+			log.Printf("Skipping directory %s: %v", partitionEntry.Name(), err)
+			summary.Skipped = append(summary.Skipped, partitionEntry.Name())
+			continue
+		}
+		for _, file := range files {
+			if file.IsDir() || filepath.Ext(file.Name()) != ".store" {
+				continue
+			}
+			var baseOffset uint64
+			if _, err := fmt.Sscanf(file.Name(), "segment_%d.store", &baseOffset); err != nil {
+				continue
+			}
+			seg := entity.NewSegment(partitionKey, baseOffset, 0, dataDir)
+			changed, err := upgradeSegment(seg)
+			if err != nil {
+				return summary, fmt.Errorf("upgrade %s: %w", seg.StorePath, err)
+			}
+			if changed {
+				log.Printf("Upgraded segment %s to format version %d", seg.StorePath, entity.SegmentFormatVersion)
+				summary.Upgraded++
+			}
+		}
+	}
+	return summary, nil
+}
+
+// migratePartitionDir returns the partition key a directory under dataDir
+// holds. A directory named after its raw key, as written before keys were
+// encoded, is renamed to entity.PartitionDirName first. For a directory that
+// maps to no key the returned key is empty.
+func migratePartitionDir(dataDir, name string) (string, error) {
+	key, err := entity.ParsePartitionDirName(name)
+	if err == nil {
+		return key, nil
+	}
+	if entity.ValidatePartitionKey(name) != nil {
+		return "", err
+	}
+	target := entity.PartitionDir(dataDir, name)
+	if _, statErr := os.Stat(target); statErr == nil {
+		return name, fmt.Errorf("legacy partition directory %q conflicts with %q, merge or remove one of them", name, filepath.Base(target))
+	}
+	if err := os.Rename(filepath.Join(dataDir, name), target); err != nil {
+		return name, fmt.Errorf("rename legacy partition directory %q: %w", name, err)
+	}
+	log.Printf("Renamed legacy partition directory %s to %s", name, filepath.Base(target))
+	return name, nil
+}
+
+// upgradeSegment brings one segment to the current format. The store file is
+// rewritten first and the index is then rebuilt from it, each through a
+// temporary file and rename, so an interrupted upgrade can simply be rerun.
+func upgradeSegment(seg *entity.Segment) (bool, error) {
+	storeHeader, err := readSegmentHeader(seg.StorePath, storeMagic, seg.BaseOffset)
+	if err != nil || storeHeader == nil {
+		// Nothing to upgrade in an empty segment
+		return false, err
+	}
+	indexHeader, err := readSegmentHeader(seg.IndexPath, indexMagic, seg.BaseOffset)
+	if err != nil {
+		return false, err
+	}
+	storeCurrent := storeHeader.Version == entity.SegmentFormatVersion
+	indexCurrent := indexHeader != nil && indexHeader.Version == entity.SegmentFormatVersion
+	if storeCurrent && indexCurrent {
+		return false, nil
+	}
+
+	if !storeCurrent {
+		seg.FormatVersion = storeHeader.Version
+		if err := rewriteStore(seg); err != nil {
+			return false, err
+		}
+	}
+	if err := rebuildIndex(seg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rewriteStore rewrites a store file in an older format with a current
+// header and extended, checksummed frames. A frame that does not decode
+// fails the rewrite and leaves the store file as it was.
+func rewriteStore(seg *entity.Segment) error {
+	tmpPath := seg.StorePath + ".upgrade"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer tmpFile.Close()
+
+	writer := bufio.NewWriter(tmpFile)
+	if err := writeSegmentHeader(writer, storeMagic, seg.BaseOffset, 0); err != nil {
+		return err
+	}
+	err = walkStoreFrames(seg.StorePath, headerSize(seg), func(position int64, body []byte) error {
+		record, err := decodeRecordFrame(body, nil)
+		if err != nil {
+			return &CorruptRecordError{Path: seg.StorePath, Position: position, Reason: err.Error()}
+		}
+		_, err = writer.Write(encodeRecordFrame(record, codecNone, nil))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, seg.StorePath)
+}
+
+// rebuildIndex writes a fresh index for a store file in the current format
+func rebuildIndex(seg *entity.Segment) error {
+	positions, err := scanStoreFrames(seg.StorePath, segmentHeaderSize)
+	if err != nil {
+		return err
+	}
+	tmpPath := seg.IndexPath + ".upgrade"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer tmpFile.Close()
+
+	writer := bufio.NewWriter(tmpFile)
+	if err := writeSegmentHeader(writer, indexMagic, seg.BaseOffset, 0); err != nil {
+		return err
+	}
+	for i, position := range positions {
+		binary.Write(writer, binary.BigEndian, seg.BaseOffset+uint64(i))
+		binary.Write(writer, binary.BigEndian, uint64(position))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, seg.IndexPath)
+}
@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+
+	"gostorelog/internal/entity"
+)
+
+const (
+	storeWriteBufferSize = 64 * 1024
+	// maxIndexPreallocation caps the space reserved for an active index
+	maxIndexPreallocation = 10 * 1024 * 1024
+)
+
+// segmentWriter keeps the files of a partition's active segment open between
+// appends, with frames buffered in front of the store file
+type segmentWriter struct {
+	seg           *entity.Segment
+	storeFile     *os.File
+	indexFile     *os.File
+	timeIndexFile *os.File
+	store         *bufio.Writer
+	storeSize     int64 // Size of the store file including buffered bytes
+	timeIndexSize int64
+}
+
+// openSegmentWriter opens a segment's files for appending, writing headers
+// to files that are new
+func openSegmentWriter(seg *entity.Segment) (*segmentWriter, error) {
+	storeFile, err := os.OpenFile(seg.StorePath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSegmentHeader(storeFile, seg, storeMagic); err != nil {
+		storeFile.Close()
+		return nil, err
+	}
+	stat, err := storeFile.Stat()
+	if err != nil {
+		storeFile.Close()
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(seg.IndexPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		storeFile.Close()
+		return nil, err
+	}
+	if err := ensureSegmentHeader(indexFile, seg, indexMagic); err != nil {
+		storeFile.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	if err := preallocateIndex(indexFile, seg); err != nil {
+		storeFile.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	timeIndexFile, timeIndexSize, err := openTimeIndex(seg)
+	if err != nil {
+		storeFile.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	return &segmentWriter{
+		seg:           seg,
+		storeFile:     storeFile,
+		indexFile:     indexFile,
+		timeIndexFile: timeIndexFile,
+		store:         bufio.NewWriterSize(storeFile, storeWriteBufferSize),
+		storeSize:     stat.Size(),
+		timeIndexSize: timeIndexSize,
+	}, nil
+}
+
+// openTimeIndex opens a segment's time index for writing and returns its
+// size. Time indexes always have a header, whatever the segment's version.
+func openTimeIndex(seg *entity.Segment) (*os.File, int64, error) {
+	file, err := os.OpenFile(seg.TimeIndexPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	size := stat.Size()
+	if size == 0 {
+		if err := writeSegmentHeader(file, timeIndexMagic, seg.BaseOffset, 0); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		size = segmentHeaderSize
+	}
+	return file, size, nil
+}
+
+// preallocateIndex extends an index file to the most entries its segment
+// can take, so readers can map it once. Sizes are estimated the way
+// AppendBatch does, at no less than 16 bytes per record.
+func preallocateIndex(indexFile *os.File, seg *entity.Segment) error {
+	capacity := int64(seg.MaxSize) / 16 * indexEntrySize
+	if capacity > maxIndexPreallocation {
+		capacity = maxIndexPreallocation
+	}
+	if capacity < indexEntrySize {
+		capacity = indexEntrySize
+	}
+	stat, err := indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	if size := headerSize(seg) + capacity; stat.Size() < size {
+		return indexFile.Truncate(size)
+	}
+	return nil
+}
+
+// close flushes buffered frames, trims the index to the entries in use and
+// closes the segment's files
+func (w *segmentWriter) close() error {
+	err := w.store.Flush()
+	used := headerSize(w.seg) + int64(w.seg.NextOffset-w.seg.BaseOffset)*indexEntrySize
+	if truncErr := w.indexFile.Truncate(used); err == nil {
+		err = truncErr
+	}
+	if closeErr := w.storeFile.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.indexFile.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.timeIndexFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sync fsyncs the segment's files. Buffered frames must already be flushed.
+func (w *segmentWriter) sync() error {
+	if err := w.storeFile.Sync(); err != nil {
+		return err
+	}
+	if err := w.timeIndexFile.Sync(); err != nil {
+		return err
+	}
+	return w.indexFile.Sync()
+}
+
+// activeWriter returns the writer for a partition's active segment, closing
+// the writer of a previous segment after a roll. Callers must hold
+// state.appendMu.
+func (r *FileStorageRepository) activeWriter(state *partitionState, seg *entity.Segment) (*segmentWriter, error) {
+	if writer := state.writer; writer != nil {
+		if writer.seg == seg {
+			return writer, nil
+		}
+		// Appends still waiting on the old segment must be synced before it closes
+		if r.commits != nil {
+			r.commits.commit()
+		}
+		writer.close()
+		state.writer = nil
+	}
+	writer, err := openSegmentWriter(seg)
+	if err != nil {
+		return nil, err
+	}
+	state.writer = writer
+	return writer, nil
+}
+
+// writeTimeIndex appends entries to the active time index, rolling the file
+// back if the write fails
+func (r *FileStorageRepository) writeTimeIndex(writer *segmentWriter, entries []byte, syncEach bool) error {
+	_, err := writer.timeIndexFile.WriteAt(entries, writer.timeIndexSize)
+	if err == nil && syncEach {
+		err = writer.timeIndexFile.Sync()
+	}
+	if err != nil {
+		if truncErr := writer.timeIndexFile.Truncate(writer.timeIndexSize); truncErr != nil {
+			log.Printf("Failed to roll back time index %s: %v", writer.seg.TimeIndexPath, truncErr)
+		}
+		return err
+	}
+	writer.timeIndexSize += int64(len(entries))
+	return nil
+}
+
+// readRecordAt reads and validates the record at offset from the frame at
+// position in a store file. The records of a batch frame are cached in
+// batch, which may be nil.
+func readRecordAt(storeFile *os.File, storePath string, position int64, offset uint64, keys *keyring, batch *batchCache) (*entity.Record, error) {
+	if batch == nil {
+		batch = &batchCache{}
+	} else if batch.cached(position) {
+		return batch.record(offset, storePath)
+	}
+	stat, err := storeFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	remaining := stat.Size() - position
+	body, err := readFrame(io.NewSectionReader(storeFile, position, remaining), remaining)
+	if err != nil {
+		return nil, &CorruptRecordError{Path: storePath, Position: position, Reason: err.Error()}
+	}
+	return batch.decode(body, offset, keys, storePath, position)
+}
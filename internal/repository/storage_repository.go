@@ -1,13 +1,44 @@
 package repository
 
-import "gostorelog/internal/entity"
+import (
+	"context"
+	"time"
+
+	"gostorelog/internal/entity"
+)
+
+// ScanOptions limits how many records a scan returns
+type ScanOptions struct {
+	MaxCount int    // Maximum number of records, 0 for no limit
+	MaxBytes uint64 // Maximum total data bytes, 0 for no limit; the first record is always returned
+}
 
 // StorageRepository defines the interface for storage operations
 type StorageRepository interface {
 	// Append appends a record to the storage
 	Append(record *entity.Record) error
+	// AppendBatch atomically appends records that share a partition key
+	AppendBatch(records []*entity.Record) error
+	// AppendReplicated appends records copied from another node at their
+	// offsets, which skip only offsets the sender does not hold from since
+	// on; reset lets it drop every record to start at the first one
+	AppendReplicated(records []*entity.Record, since uint64, reset bool) (uint64, error)
 	// Read reads a record by offset
 	Read(partitionKey string, offset uint64) (*entity.Record, error)
+	// Scan streams records from an offset across segments within limits
+	Scan(partitionKey string, fromOffset uint64, opts ScanOptions, fn func(*entity.Record) error) error
+	// OffsetForTime returns the first offset appended at or after t
+	OffsetForTime(partitionKey string, t time.Time) (uint64, error)
+	// WaitForOffset blocks until a record exists at offset or ctx is done
+	WaitForOffset(ctx context.Context, partitionKey string, offset uint64) error
+	// ListPartitions summarizes every partition
+	ListPartitions() ([]entity.PartitionInfo, error)
+	// DescribePartition summarizes a partition and its segments
+	DescribePartition(partitionKey string) (*entity.PartitionInfo, error)
+	// TruncatePartition removes every record after afterOffset
+	TruncatePartition(partitionKey string, afterOffset uint64) error
+	// DeletePartition removes a partition and its files
+	DeletePartition(partitionKey string) error
 	// Close closes the repository
 	Close() error
 }
\ No newline at end of file
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"gostorelog/internal/entity"
+)
+
+// Time index layout (.timeindex), after a segment header:
+//
+//	([timestamp 8][offset 8])*
+//
+// An entry is written for every record whose append timestamp is newer than
+// any before it in the partition, so timestamps in the file only increase and
+// the first entry at or after a time names the first record at or after it.
+const timeIndexEntrySize = 16
+
+var timeIndexMagic = [4]byte{'G', 'S', 'L', 'T'}
+
+// timeIndexEntry maps a new maximum timestamp to the offset that set it
+type timeIndexEntry struct {
+	Timestamp int64 // Unix nanoseconds
+	Offset    uint64
+}
+
+// encodeTimeIndexEntries returns the time index entries for records appended
+// after a partition maximum of newest, and the new maximum
+func encodeTimeIndexEntries(records []*entity.Record, newest time.Time) ([]byte, time.Time) {
+	var entries bytes.Buffer
+	for _, record := range records {
+		if !record.Timestamp.After(newest) {
+			continue
+		}
+		newest = record.Timestamp
+		binary.Write(&entries, binary.BigEndian, newest.UnixNano())
+		binary.Write(&entries, binary.BigEndian, record.Offset)
+	}
+	return entries.Bytes(), newest
+}
+
+// readTimeIndexEntry reads the entry in the given slot of a time index file
+func readTimeIndexEntry(file *os.File, slot int64) (timeIndexEntry, error) {
+	buf := make([]byte, timeIndexEntrySize)
+	if _, err := file.ReadAt(buf, segmentHeaderSize+slot*timeIndexEntrySize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return timeIndexEntry{}, err
+	}
+	return timeIndexEntry{
+		Timestamp: int64(binary.BigEndian.Uint64(buf[:8])),
+		Offset:    binary.BigEndian.Uint64(buf[8:]),
+	}, nil
+}
+
+// timeIndexEntryCount returns the number of complete entries in a time index
+func timeIndexEntryCount(file *os.File) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size() - segmentHeaderSize
+	if size <= 0 {
+		return 0, nil
+	}
+	return size / timeIndexEntrySize, nil
+}
+
+// searchTimeIndex returns the offset of the first entry at or after t, or
+// false if every entry is older
+func searchTimeIndex(file *os.File, t time.Time) (uint64, bool, error) {
+	count, err := timeIndexEntryCount(file)
+	if err != nil {
+		return 0, false, err
+	}
+	var searchErr error
+	slot := sort.Search(int(count), func(i int) bool {
+		entry, err := readTimeIndexEntry(file, int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return entry.Timestamp >= t.UnixNano()
+	})
+	if searchErr != nil || int64(slot) == count {
+		return 0, false, searchErr
+	}
+	entry, err := readTimeIndexEntry(file, int64(slot))
+	if err != nil {
+		return 0, false, err
+	}
+	return entry.Offset, true, nil
+}
+
+// OffsetForTime returns the first offset whose record was appended at or
+// after t, or the partition's next offset if every record is older
+func (r *FileStorageRepository) OffsetForTime(partitionKey string, t time.Time) (uint64, error) {
+	state, err := r.lookupPartition(partitionKey)
+	if err != nil {
+		return 0, err
+	}
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	// MaxTimestamp never decreases across segments
+	segments := state.Segments
+	i := sort.Search(len(segments), func(i int) bool {
+		return !segments[i].MaxTimestamp.Before(t)
+	})
+	if i == len(segments) || segments[i].NextOffset == segments[i].BaseOffset {
+		return state.CurrentOffset, nil
+	}
+	seg := segments[i]
+	handle, err := r.handles.acquire(seg.TimeIndexPath)
+	if err != nil {
+		return 0, err
+	}
+	defer r.handles.release(handle)
+	offset, found, err := searchTimeIndex(handle.file, t)
+	if err != nil {
+		return 0, err
+	}
+	if !found || offset >= seg.NextOffset {
+		return seg.NextOffset, nil
+	}
+	if earliest := state.EarliestOffset(); offset < earliest {
+		return earliest, nil
+	}
+	return offset, nil
+}
+
+// recoverTimeIndex makes a segment's time index match its records, given the
+// partition maximum timestamp before the segment, and sets the segment's
+// MaxTimestamp. Entries past the segment's end are dropped and records after
+// the last entry are indexed, so a missing or stale time index is rebuilt.
+func recoverTimeIndex(seg *entity.Segment, newest time.Time, keys *keyring) error {
+	file, err := os.OpenFile(seg.TimeIndexPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, err := readSegmentHeader(seg.TimeIndexPath, timeIndexMagic, seg.BaseOffset)
+	if err != nil || header == nil || header.Version == 0 {
+		if err != nil {
+			log.Printf("Rebuilding time index of segment %s: %v", seg.StorePath, err)
+		}
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if err := writeSegmentHeader(file, timeIndexMagic, seg.BaseOffset, 0); err != nil {
+			return err
+		}
+	}
+
+	// Keep entries for offsets the segment still holds
+	count, err := timeIndexEntryCount(file)
+	if err != nil {
+		return err
+	}
+	from := seg.BaseOffset
+	for ; count > 0; count-- {
+		entry, err := readTimeIndexEntry(file, count-1)
+		if err != nil {
+			return err
+		}
+		if entry.Offset < seg.NextOffset {
+			if last := time.Unix(0, entry.Timestamp); last.After(newest) {
+				newest = last
+			}
+			from = entry.Offset + 1
+			break
+		}
+	}
+	end := segmentHeaderSize + count*timeIndexEntrySize
+	if err := file.Truncate(end); err != nil {
+		return err
+	}
+
+	// Index records written after the last entry
+	records, err := readRecordsFrom(seg, from, keys)
+	if err != nil {
+		return err
+	}
+	entries, newest := encodeTimeIndexEntries(records, newest)
+	if len(entries) > 0 {
+		if _, err := file.WriteAt(entries, end); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	seg.MaxTimestamp = newest
+	return nil
+}
+
+// readRecordsFrom reads the records of a segment from offset on
+func readRecordsFrom(seg *entity.Segment, from uint64, keys *keyring) ([]*entity.Record, error) {
+	if from >= seg.NextOffset {
+		return nil, nil
+	}
+	indexFile, err := os.Open(seg.IndexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer indexFile.Close()
+	storeFile, err := os.Open(seg.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	defer storeFile.Close()
+	count, err := indexEntryCount(indexFile, seg)
+	if err != nil {
+		return nil, err
+	}
+	var searchErr error
+	slot := int64(sort.Search(int(count), func(i int) bool {
+		entry, err := readIndexEntry(indexFile, seg, int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return entry.Offset >= from
+	}))
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	records := []*entity.Record{}
+	var batch batchCache
+	for ; slot < count; slot++ {
+		entry, err := readIndexEntry(indexFile, seg, slot)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Offset >= seg.NextOffset {
+			break
+		}
+		record, err := readRecordAt(storeFile, seg.StorePath, int64(entry.Position), entry.Offset, keys, &batch)
+		if err != nil {
+			return nil, err
+		}
+		record.Offset = entry.Offset
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -1,19 +1,47 @@
 package usecase
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
 	"gostorelog/internal/entity"
 	"gostorelog/internal/repository"
 )
 
 // Replicator defines the interface for data replication
 type Replicator interface {
-	Replicate(data interface{}, dataType entity.DataType, partitionKey string) error
+	Replicate(record *entity.Record) error
+	// IsLeader reports whether this node is the leader, which alone accepts writes
+	IsLeader() bool
+}
+
+// RecordInput describes one record of a batch to store. With Tombstone set
+// it deletes Key and carries no data.
+type RecordInput struct {
+	Data      interface{}       `json:"data"`
+	DataType  entity.DataType   `json:"data_type"`
+	Key       string            `json:"key"`
+	Headers   map[string][]byte `json:"headers"`
+	Tombstone bool              `json:"tombstone"`
 }
 
 // StorageUsecase defines the business logic for storage operations
 type StorageUsecase interface {
 	StoreRecord(data interface{}, dataType entity.DataType, partitionKey string) error
+	StoreRecordWithKey(data interface{}, dataType entity.DataType, partitionKey string, key string, headers map[string][]byte) error
+	StoreTombstone(partitionKey string, key string, headers map[string][]byte) error
+	StoreRecords(partitionKey string, inputs []RecordInput) (firstOffset uint64, lastOffset uint64, err error)
+	ReplicateRecords(partitionKey string, records []*entity.Record, since uint64, reset bool) (nextOffset uint64, err error)
 	RetrieveRecord(partitionKey string, offset uint64) (*entity.Record, error)
+	RetrieveRange(partitionKey string, fromOffset uint64, maxCount int, maxBytes uint64) ([]*entity.Record, error)
+	OffsetForTime(partitionKey string, t time.Time) (uint64, error)
+	WaitForOffset(ctx context.Context, partitionKey string, offset uint64) error
+	ListPartitions() ([]entity.PartitionInfo, error)
+	DescribePartition(partitionKey string) (*entity.PartitionInfo, error)
+	TruncatePartition(partitionKey string, afterOffset uint64) error
+	DeletePartition(partitionKey string) error
 	SetReplicator(replicator Replicator)
 }
 
@@ -37,22 +65,196 @@ func (u *StorageUsecaseImpl) SetReplicator(replicator Replicator) {
 
 // StoreRecord stores a record
 func (u *StorageUsecaseImpl) StoreRecord(data interface{}, dataType entity.DataType, partitionKey string) error {
-	record, err := entity.NewRecord(data, dataType, partitionKey)
+	return u.StoreRecordWithKey(data, dataType, partitionKey, "", nil)
+}
+
+// StoreRecordWithKey stores a record with an optional key and headers
+func (u *StorageUsecaseImpl) StoreRecordWithKey(data interface{}, dataType entity.DataType, partitionKey string, key string, headers map[string][]byte) error {
+	return u.storeInput(partitionKey, RecordInput{Data: data, DataType: dataType, Key: key, Headers: headers})
+}
+
+// StoreTombstone stores a tombstone that deletes key once the partition is
+// compacted
+func (u *StorageUsecaseImpl) StoreTombstone(partitionKey string, key string, headers map[string][]byte) error {
+	return u.storeInput(partitionKey, RecordInput{Key: key, Headers: headers, Tombstone: true})
+}
+
+// storeInput stores the record an input describes
+func (u *StorageUsecaseImpl) storeInput(partitionKey string, input RecordInput) error {
+	record, err := newKeyedRecord(input, partitionKey)
 	if err != nil {
 		return err
 	}
+	if err := u.checkLeader(); err != nil {
+		return err
+	}
 	err = u.repo.Append(record)
 	if err != nil {
 		return err
 	}
 	// Replicate to followers if replicator is set
 	if u.Replicator != nil {
-		u.Replicator.Replicate(data, dataType, partitionKey)
+		u.Replicator.Replicate(record)
+	}
+	return nil
+}
+
+// checkLeader rejects writes on a node that replicates but is not the leader
+func (u *StorageUsecaseImpl) checkLeader() error {
+	if u.Replicator != nil && !u.Replicator.IsLeader() {
+		return fmt.Errorf("%w: writes must be sent to the cluster leader", entity.ErrNotLeader)
 	}
 	return nil
 }
 
+// newKeyedRecord builds the record an input describes, with its key and
+// headers. Only an input marked as a tombstone deletes its key; nil data is
+// rejected otherwise, so a missing data field never deletes a key.
+func newKeyedRecord(input RecordInput, partitionKey string) (*entity.Record, error) {
+	var record *entity.Record
+	var err error
+	switch {
+	case input.Tombstone && input.Data != nil:
+		err = fmt.Errorf("%w: a tombstone carries no data", entity.ErrInvalidInput)
+	case input.Tombstone:
+		record, err = entity.NewTombstone(input.Key, partitionKey)
+	case input.Data == nil:
+		err = fmt.Errorf("%w: data is required, set tombstone to delete a key", entity.ErrInvalidInput)
+	default:
+		var data interface{}
+		if data, err = decodeBytesData(input.Data, input.DataType); err == nil {
+			record, err = entity.NewRecord(data, input.DataType, partitionKey)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	record.Key = input.Key
+	record.Headers = input.Headers
+	return record, nil
+}
+
+// decodeBytesData decodes DataTypeBytes data given as a base64 string, the
+// way JSON carries []byte. Other data is returned unchanged.
+func decodeBytesData(data interface{}, dataType entity.DataType) (interface{}, error) {
+	encoded, isString := data.(string)
+	if dataType != entity.DataTypeBytes || !isString {
+		return data, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bytes data must be base64: %v", entity.ErrInvalidInput, err)
+	}
+	return decoded, nil
+}
+
+// StoreRecords atomically stores a batch of records in one partition and
+// returns the offset range assigned to them
+func (u *StorageUsecaseImpl) StoreRecords(partitionKey string, inputs []RecordInput) (uint64, uint64, error) {
+	if len(inputs) == 0 {
+		return 0, 0, fmt.Errorf("%w: empty batch", entity.ErrInvalidInput)
+	}
+	records := make([]*entity.Record, len(inputs))
+	for i, input := range inputs {
+		record, err := newKeyedRecord(input, partitionKey)
+		if err != nil {
+			return 0, 0, fmt.Errorf("record %d: %w", i, err)
+		}
+		records[i] = record
+	}
+	if err := u.checkLeader(); err != nil {
+		return 0, 0, err
+	}
+	if err := u.repo.AppendBatch(records); err != nil {
+		return 0, 0, err
+	}
+	// Replicate to followers if replicator is set
+	if u.Replicator != nil {
+		for _, record := range records {
+			u.Replicator.Replicate(record)
+		}
+	}
+	return records[0].Offset, records[len(records)-1].Offset, nil
+}
+
+// ReplicateRecords appends records copied from the leader at the offsets
+// they carry and returns the partition's next offset. The leader holds no
+// other records from offset since on, so offsets the batch skips there were
+// compacted away. With reset, a batch that starts past the next offset
+// replaces the partition's records. They are not replicated further.
+func (u *StorageUsecaseImpl) ReplicateRecords(partitionKey string, records []*entity.Record, since uint64, reset bool) (uint64, error) {
+	if len(records) == 0 {
+		return 0, fmt.Errorf("%w: empty batch", entity.ErrInvalidInput)
+	}
+	for i, record := range records {
+		if record == nil || record.DataType < entity.DataTypeJSON || record.DataType > entity.DataTypeString {
+			return 0, fmt.Errorf("%w: record %d is missing or has an unsupported data type", entity.ErrInvalidInput, i)
+		}
+		record.PartitionKey = partitionKey
+	}
+	return u.repo.AppendReplicated(records, since, reset)
+}
+
 // RetrieveRecord retrieves a record by offset
 func (u *StorageUsecaseImpl) RetrieveRecord(partitionKey string, offset uint64) (*entity.Record, error) {
 	return u.repo.Read(partitionKey, offset)
+}
+
+// RetrieveRange retrieves consecutive records starting at fromOffset, bounded
+// by maxCount records and maxBytes of data (0 means no limit)
+func (u *StorageUsecaseImpl) RetrieveRange(partitionKey string, fromOffset uint64, maxCount int, maxBytes uint64) ([]*entity.Record, error) {
+	records := []*entity.Record{}
+	opts := repository.ScanOptions{MaxCount: maxCount, MaxBytes: maxBytes}
+	err := u.repo.Scan(partitionKey, fromOffset, opts, func(record *entity.Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// OffsetForTime returns the first offset appended at or after t, or the next
+// offset to be written if every record is older
+func (u *StorageUsecaseImpl) OffsetForTime(partitionKey string, t time.Time) (uint64, error) {
+	return u.repo.OffsetForTime(partitionKey, t)
+}
+
+// WaitForOffset blocks until a record exists at offset or ctx is done
+func (u *StorageUsecaseImpl) WaitForOffset(ctx context.Context, partitionKey string, offset uint64) error {
+	return u.repo.WaitForOffset(ctx, partitionKey, offset)
+}
+
+var errPartitionKeyRequired = fmt.Errorf("%w: partition key is required", entity.ErrInvalidInput)
+
+// ListPartitions summarizes every partition
+func (u *StorageUsecaseImpl) ListPartitions() ([]entity.PartitionInfo, error) {
+	return u.repo.ListPartitions()
+}
+
+// DescribePartition summarizes a partition and its segments
+func (u *StorageUsecaseImpl) DescribePartition(partitionKey string) (*entity.PartitionInfo, error) {
+	if partitionKey == "" {
+		return nil, errPartitionKeyRequired
+	}
+	return u.repo.DescribePartition(partitionKey)
+}
+
+// TruncatePartition removes every record after afterOffset. Followers are
+// not truncated.
+func (u *StorageUsecaseImpl) TruncatePartition(partitionKey string, afterOffset uint64) error {
+	if partitionKey == "" {
+		return errPartitionKeyRequired
+	}
+	return u.repo.TruncatePartition(partitionKey, afterOffset)
+}
+
+// DeletePartition removes a partition and its files. Followers keep their
+// copy.
+func (u *StorageUsecaseImpl) DeletePartition(partitionKey string) error {
+	if partitionKey == "" {
+		return errPartitionKeyRequired
+	}
+	return u.repo.DeletePartition(partitionKey)
 }
\ No newline at end of file
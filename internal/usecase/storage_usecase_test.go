@@ -1,8 +1,10 @@
 package usecase
 
 import (
+	"errors"
 	"os"
 	"testing"
+	"time"
 
 	"gostorelog/internal/entity"
 	"gostorelog/internal/repository"
@@ -45,6 +47,115 @@ func TestStorageUsecase_StoreAndRetrieve(t *testing.T) {
 	t.Logf("TestStorageUsecase_StoreAndRetrieve passed: store and retrieve work correctly")
 }
 
+func TestStorageUsecase_StoreTombstone(t *testing.T) {
+	dir := t.TempDir()
+
+	repo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	uc := NewStorageUsecase(repo)
+
+	if err := uc.StoreTombstone("test-partition", "user-1", nil); err != nil {
+		t.Fatalf("Expected tombstone to be stored, got %v", err)
+	}
+	record, err := uc.RetrieveRecord("test-partition", 0)
+	if err != nil || !record.IsTombstone() || record.Key != "user-1" {
+		t.Fatalf("Expected tombstone for user-1, got %+v (%v)", record, err)
+	}
+	// Nil data is rejected rather than taken for a tombstone
+	if err := uc.StoreRecordWithKey(nil, entity.DataTypeJSON, "test-partition", "user-1", nil); !errors.Is(err, entity.ErrInvalidInput) {
+		t.Errorf("Expected nil data with a key to be rejected, got %v", err)
+	}
+	if err := uc.StoreRecordWithKey(nil, entity.DataTypeString, "test-partition", "", nil); err == nil {
+		t.Errorf("Expected nil string data without a key to be rejected")
+	}
+	// Empty data with a key is an ordinary record
+	if err := uc.StoreRecordWithKey("", entity.DataTypeString, "test-partition", "user-2", nil); err != nil {
+		t.Fatalf("Expected empty string data to be stored, got %v", err)
+	}
+	if record, err := uc.RetrieveRecord("test-partition", 1); err != nil || record.IsTombstone() || record.Key != "user-2" {
+		t.Errorf("Expected an ordinary record for user-2, got %+v (%v)", record, err)
+	}
+	// Batches mark tombstones explicitly too, and a tombstone takes no data
+	if _, last, err := uc.StoreRecords("test-partition", []RecordInput{{Key: "user-2", Tombstone: true}}); err != nil || last != 2 {
+		t.Fatalf("Expected a tombstone at offset 2, got %d (%v)", last, err)
+	}
+	if record, err := uc.RetrieveRecord("test-partition", 2); err != nil || !record.IsTombstone() {
+		t.Errorf("Expected tombstone for user-2, got %+v (%v)", record, err)
+	}
+	if _, _, err := uc.StoreRecords("test-partition", []RecordInput{{Data: "x", DataType: entity.DataTypeString, Key: "user-3", Tombstone: true}}); !errors.Is(err, entity.ErrInvalidInput) {
+		t.Errorf("Expected a tombstone with data to be rejected, got %v", err)
+	}
+	t.Logf("TestStorageUsecase_StoreTombstone passed: tombstones stored only when marked, nil data rejected")
+}
+
+func TestStorageUsecase_StoreBase64Bytes(t *testing.T) {
+	dir := t.TempDir()
+
+	repo := repository.NewFileStorageRepository(&entity.Config{DataDir: dir, MaxFileSize: 1024})
+	defer repo.Close()
+	uc := NewStorageUsecase(repo)
+
+	// JSON carries []byte as base64 strings
+	if err := uc.StoreRecord("AP8Q", entity.DataTypeBytes, "test-partition"); err != nil {
+		t.Fatalf("Expected base64 bytes to be stored, got %v", err)
+	}
+	if err := uc.StoreRecord([]byte{1, 2}, entity.DataTypeBytes, "test-partition"); err != nil {
+		t.Fatalf("Expected raw bytes to be stored, got %v", err)
+	}
+	if err := uc.StoreRecord("not base64!", entity.DataTypeBytes, "test-partition"); err == nil {
+		t.Errorf("Expected invalid base64 to be rejected")
+	}
+	record, err := uc.RetrieveRecord("test-partition", 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(record.Data) != "\x00\xff\x10" {
+		t.Errorf("Expected decoded bytes, got %v", record.Data)
+	}
+	t.Logf("TestStorageUsecase_StoreBase64Bytes passed: base64 bytes decoded before storing")
+}
+
+func TestStorageUsecase_StoreRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &entity.Config{DataDir: dir, MaxFileSize: 1024}
+	repo := repository.NewFileStorageRepository(config)
+	uc := NewStorageUsecase(repo)
+
+	inputs := []RecordInput{
+		{Data: "first", DataType: entity.DataTypeString},
+		{Data: map[string]int{"id": 2}, DataType: entity.DataTypeJSON, Key: "id-2"},
+		{Data: []byte("third"), DataType: entity.DataTypeBytes},
+	}
+	firstOffset, lastOffset, err := uc.StoreRecords("test-partition", inputs)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if firstOffset != 0 || lastOffset != 2 {
+		t.Errorf("Expected offsets 0-2, got %d-%d", firstOffset, lastOffset)
+	}
+
+	// An invalid record fails the whole batch
+	_, _, err = uc.StoreRecords("test-partition", []RecordInput{
+		{Data: "ok", DataType: entity.DataTypeString},
+		{Data: 42, DataType: entity.DataTypeString},
+	})
+	if err == nil {
+		t.Fatalf("Expected error for invalid record in batch")
+	}
+	if _, err := uc.RetrieveRecord("test-partition", 3); err == nil {
+		t.Errorf("Expected no record written for rejected batch")
+	}
+
+	record, err := uc.RetrieveRecord("test-partition", 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if record.Key != "id-2" {
+		t.Errorf("Expected key 'id-2', got %q", record.Key)
+	}
+	t.Logf("TestStorageUsecase_StoreRecords passed: batch stored with offsets %d-%d", firstOffset, lastOffset)
+}
+
 func TestStorageUsecase_Replication(t *testing.T) {
 	// This test simulates replication between leader and follower
 	// For simplicity, use two usecases with different repos, and mock replicator
@@ -98,6 +209,26 @@ func TestStorageUsecase_Replication(t *testing.T) {
 	t.Logf("TestStorageUsecase_Replication passed: data stored on leader")
 }
 
+func TestStorageUsecase_NotLeader(t *testing.T) {
+	repo := repository.NewFileStorageRepository(&entity.Config{DataDir: t.TempDir(), MaxFileSize: 1024})
+	defer repo.Close()
+	uc := NewStorageUsecase(repo)
+	uc.SetReplicator(&mockReplicator{uc: uc, follower: true})
+
+	if err := uc.StoreRecord("x", entity.DataTypeString, "test-partition"); !errors.Is(err, entity.ErrNotLeader) {
+		t.Errorf("Expected a follower to reject StoreRecord, got %v", err)
+	}
+	if _, _, err := uc.StoreRecords("test-partition", []RecordInput{{Data: "x", DataType: entity.DataTypeString}}); !errors.Is(err, entity.ErrNotLeader) {
+		t.Errorf("Expected a follower to reject StoreRecords, got %v", err)
+	}
+	// Records copied from the leader are still accepted
+	record := &entity.Record{Data: []byte("x"), DataType: entity.DataTypeString, Timestamp: time.Now()}
+	if next, err := uc.ReplicateRecords("test-partition", []*entity.Record{record}, 0, false); err != nil || next != 1 {
+		t.Errorf("Expected a follower to accept replicated records, got %d (%v)", next, err)
+	}
+	t.Logf("TestStorageUsecase_NotLeader passed: followers reject writes but accept replication")
+}
+
 func TestStorageUsecase_GapDetection(t *testing.T) {
 	t.Logf("Scenario: Leader detects gaps with followers and stores gap information")
 	t.Logf("Input: Leader has data up to offset 10, follower has up to offset 5")
@@ -183,10 +314,19 @@ func TestStorageUsecase_ReplicationWithLag(t *testing.T) {
 
 // mockReplicator implements Replicator for testing
 type mockReplicator struct {
-	uc StorageUsecase
+	uc       StorageUsecase
+	follower bool
+}
+
+func (m *mockReplicator) IsLeader() bool {
+	return !m.follower
 }
 
-func (m *mockReplicator) Replicate(data interface{}, dataType entity.DataType, partitionKey string) error {
+func (m *mockReplicator) Replicate(record *entity.Record) error {
 	// Simulate sending to follower
-	return m.uc.StoreRecord(data, dataType, partitionKey)
+	data, err := record.GetData()
+	if err != nil {
+		return err
+	}
+	return m.uc.StoreRecordWithKey(data, record.DataType, record.PartitionKey, record.Key, record.Headers)
 }
\ No newline at end of file
@@ -1,11 +1,19 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"gostorelog/internal/entity"
 )
@@ -20,13 +28,77 @@ func NewClient(baseURL string) *Client {
 	return &Client{baseURL: baseURL}
 }
 
+// Errors the server reports, for use with errors.Is
+var (
+	ErrInvalidInput  = entity.ErrInvalidInput
+	ErrNotFound      = entity.ErrNotFound
+	ErrOutOfRange    = entity.ErrOutOfRange
+	ErrCorrupted     = entity.ErrCorrupted
+	ErrUnavailable   = entity.ErrUnavailable
+	ErrNotLeader     = entity.ErrNotLeader
+	ErrReadOnly      = entity.ErrReadOnly
+	ErrQuotaExceeded = entity.ErrQuotaExceeded
+	ErrConflict      = entity.ErrConflict
+)
+
+// APIError is an error response from the server. errors.Is matches it
+// against the sentinel its code names, such as ErrNotFound.
+type APIError struct {
+	StatusCode int
+	Code       string // Error kind, see entity.ErrorCode
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return entity.ErrorForCode(e.Code)
+}
+
+// responseError reads the error response in resp
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return parseError(resp.StatusCode, body)
+}
+
+// parseError decodes an error response body. A body that is not a JSON
+// error, such as one from a proxy, becomes the message.
+func parseError(statusCode int, body []byte) *APIError {
+	var decoded struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil || decoded.Error == "" {
+		return &APIError{StatusCode: statusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return &APIError{StatusCode: statusCode, Code: decoded.Code, Message: decoded.Error}
+}
+
+// queryKey escapes a partition key for a query string
+func queryKey(partitionKey string) string {
+	return url.QueryEscape(partitionKey)
+}
+
 // Publish publishes a record
 func (c *Client) Publish(data interface{}, dataType int, partitionKey string) error {
+	return c.PublishWithKey(data, dataType, partitionKey, "", nil)
+}
+
+// PublishWithKey publishes a record with an optional key and headers
+func (c *Client) PublishWithKey(data interface{}, dataType int, partitionKey string, key string, headers map[string][]byte) error {
 	reqBody := map[string]interface{}{
 		"data":          data,
 		"data_type":     dataType,
 		"partition_key": partitionKey,
 	}
+	if key != "" {
+		reqBody["key"] = key
+	}
+	if len(headers) > 0 {
+		reqBody["headers"] = headers
+	}
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
 		return err
@@ -37,27 +109,475 @@ func (c *Client) Publish(data interface{}, dataType int, partitionKey string) er
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("publish failed: %s", string(body))
+		return fmt.Errorf("publish failed: %w", responseError(resp))
 	}
 	return nil
 }
 
+// PublishTombstone publishes a tombstone that deletes key from a compacted
+// partition
+func (c *Client) PublishTombstone(partitionKey string, key string) error {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"partition_key": partitionKey,
+		"key":           key,
+		"tombstone":     true,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(c.baseURL+"/publish", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publish failed: %w", responseError(resp))
+	}
+	return nil
+}
+
+// BatchRecord is one record of a batch publish. With Tombstone set it
+// deletes Key and carries no data.
+type BatchRecord struct {
+	Data      interface{}       `json:"data"`
+	DataType  int               `json:"data_type"`
+	Key       string            `json:"key,omitempty"`
+	Headers   map[string][]byte `json:"headers,omitempty"`
+	Tombstone bool              `json:"tombstone,omitempty"`
+}
+
+// PublishBatch atomically publishes records to a partition and returns the
+// offset range assigned to them
+func (c *Client) PublishBatch(partitionKey string, records []BatchRecord) (uint64, uint64, error) {
+	reqBody := map[string]interface{}{
+		"partition_key": partitionKey,
+		"records":       records,
+	}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := http.Post(c.baseURL+"/publish/batch", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("publish batch failed: %w", responseError(resp))
+	}
+	var result struct {
+		FirstOffset uint64 `json:"first_offset"`
+		LastOffset  uint64 `json:"last_offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, 0, err
+	}
+	return result.FirstOffset, result.LastOffset, nil
+}
+
+// PublishRaw publishes data as the raw request body, so bytes need no
+// encoding. dataType selects how the server stores it; key may be empty.
+func (c *Client) PublishRaw(partitionKey string, dataType int, key string, data []byte) error {
+	query := url.Values{}
+	query.Set("partition", partitionKey)
+	query.Set("data_type", strconv.Itoa(dataType))
+	if key != "" {
+		query.Set("key", key)
+	}
+	resp, err := http.Post(c.baseURL+"/publish/raw?"+query.Encode(), "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publish raw failed: %w", responseError(resp))
+	}
+	return nil
+}
+
+// ReadRaw reads a record's data as sent, without JSON encoding. The record
+// carries its offset, data type, key and timestamp but not its headers.
+func (c *Client) ReadRaw(partitionKey string, offset uint64) (*entity.Record, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/read/raw?partition=%s&offset=%d", c.baseURL, queryKey(partitionKey), offset))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("read raw failed: %w", parseError(resp.StatusCode, body))
+	}
+	record := &entity.Record{Data: body, PartitionKey: partitionKey, Offset: offset}
+	dataType, err := strconv.Atoi(resp.Header.Get("X-Record-Data-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("read raw: invalid data type header: %v", err)
+	}
+	record.DataType = entity.DataType(dataType)
+	if key, err := url.PathUnescape(resp.Header.Get("X-Record-Key")); err == nil {
+		record.Key = key
+	}
+	if value := resp.Header.Get("X-Record-Timestamp"); value != "" {
+		if record.Timestamp, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return nil, fmt.Errorf("read raw: invalid timestamp header: %v", err)
+		}
+	}
+	return record, nil
+}
+
 // Read reads a record by partition and offset
 func (c *Client) Read(partitionKey string, offset uint64) (*entity.Record, error) {
-	url := fmt.Sprintf("%s/read?partition=%s&offset=%d", c.baseURL, partitionKey, offset)
+	url := fmt.Sprintf("%s/read?partition=%s&offset=%d", c.baseURL, queryKey(partitionKey), offset)
 	resp, err := http.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("read failed: %s", string(body))
+		return nil, fmt.Errorf("read failed: %w", responseError(resp))
 	}
 	var record entity.Record
 	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
 		return nil, err
 	}
 	return &record, nil
+}
+
+// OffsetForTime returns the first offset of a partition appended at or after
+// t, or the next offset to be written if every record is older
+func (c *Client) OffsetForTime(partitionKey string, t time.Time) (uint64, error) {
+	url := fmt.Sprintf("%s/offset?partition=%s&time=%s", c.baseURL, queryKey(partitionKey), t.UTC().Format(time.RFC3339Nano))
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("offset for time failed: %w", responseError(resp))
+	}
+	var result struct {
+		Offset uint64 `json:"offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Offset, nil
+}
+
+// ReadRange reads up to maxCount records (and roughly maxBytes of data)
+// starting at fromOffset. Zero limits use the server defaults. It returns the
+// records and the offset to continue from.
+func (c *Client) ReadRange(partitionKey string, fromOffset uint64, maxCount int, maxBytes uint64) ([]*entity.Record, uint64, error) {
+	url := fmt.Sprintf("%s/read/range?partition=%s&offset=%d", c.baseURL, queryKey(partitionKey), fromOffset)
+	if maxCount > 0 {
+		url += fmt.Sprintf("&max_count=%d", maxCount)
+	}
+	if maxBytes > 0 {
+		url += fmt.Sprintf("&max_bytes=%d", maxBytes)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("read range failed: %w", responseError(resp))
+	}
+	var result struct {
+		Records    []*entity.Record `json:"records"`
+		NextOffset uint64           `json:"next_offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	return result.Records, result.NextOffset, nil
+}
+
+// ReadWait reads a record, waiting up to wait for it to be written. It
+// returns a nil record without error if the offset is not written in time.
+func (c *Client) ReadWait(partitionKey string, offset uint64, wait time.Duration) (*entity.Record, error) {
+	url := fmt.Sprintf("%s/read?partition=%s&offset=%d&wait=%s", c.baseURL, queryKey(partitionKey), offset, wait)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("read failed: %w", responseError(resp))
+	}
+	var record entity.Record
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+const (
+	// subscribeRetryDelay is how long Subscribe waits before reconnecting
+	subscribeRetryDelay = time.Second
+	// maxEventSize bounds a single streamed record event
+	maxEventSize = 64 * 1024 * 1024
+)
+
+// Subscription is a stream of records opened by Subscribe
+type Subscription struct {
+	records chan *entity.Record
+	mu      sync.Mutex
+	err     error
+}
+
+// Records returns the channel records are delivered on. It is closed when
+// the subscription ends.
+func (s *Subscription) Records() <-chan *entity.Record {
+	return s.records
+}
+
+// Err returns the error that ended the subscription, or nil while it runs
+// and after its context is done
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// fail ends the subscription with err
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// Subscribe streams records of a partition from fromOffset onwards, including
+// records appended later. The connection is re-established from the next
+// offset if it drops or the server fails; an error the request itself
+// causes, such as an unknown partition or an offset removed by retention,
+// ends the subscription and is returned by Err. The records channel is
+// closed once the subscription ends or ctx is done.
+func (c *Client) Subscribe(ctx context.Context, partitionKey string, fromOffset uint64) (*Subscription, error) {
+	resp, err := c.openSubscription(ctx, partitionKey, fromOffset)
+	if err != nil {
+		return nil, err
+	}
+	sub := &Subscription{records: make(chan *entity.Record)}
+	go func() {
+		defer close(sub.records)
+		next := fromOffset
+		for {
+			next, err = c.readEvents(ctx, resp, sub.records, next)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && !retryable(err) {
+				sub.fail(err)
+				return
+			}
+			// Reconnect from the next offset after a short pause
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(subscribeRetryDelay):
+				}
+				resp, err = c.openSubscription(ctx, partitionKey, next)
+				if err == nil {
+					break
+				}
+				if !retryable(err) {
+					sub.fail(err)
+					return
+				}
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// retryable reports whether a request that failed with err may succeed
+// when repeated: after transport errors and server failures, but not after
+// errors in the request such as an unknown partition or an offset out of range
+func retryable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	if apiErr.StatusCode != 0 {
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	// Error events carry a code but no status
+	return !errors.Is(err, entity.ErrInvalidInput) && !errors.Is(err, entity.ErrNotFound) && !errors.Is(err, entity.ErrOutOfRange)
+}
+
+// openSubscription opens the event stream for a partition
+func (c *Client) openSubscription(ctx context.Context, partitionKey string, fromOffset uint64) (*http.Response, error) {
+	url := fmt.Sprintf("%s/subscribe?partition=%s&offset=%d", c.baseURL, queryKey(partitionKey), fromOffset)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := responseError(resp)
+		resp.Body.Close()
+		return nil, fmt.Errorf("subscribe failed: %w", err)
+	}
+	return resp, nil
+}
+
+// readEvents delivers record events from an open stream until it ends and
+// returns the offset to resume from, along with the error the server sent
+// or the stream failed with
+func (c *Client) readEvents(ctx context.Context, resp *http.Response, records chan<- *entity.Record, next uint64) (uint64, error) {
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	var event string
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			switch event {
+			case "record":
+				var record entity.Record
+				if err := json.Unmarshal(data.Bytes(), &record); err == nil {
+					select {
+					case records <- &record:
+						next = record.Offset + 1
+					case <-ctx.Done():
+						return next, nil
+					}
+				}
+			case "error":
+				return next, fmt.Errorf("subscribe failed: %w", parseError(0, data.Bytes()))
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data.WriteString(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return next, scanner.Err()
+}
+
+// Status reports the server's node ID, role and partition offsets
+func (c *Client) Status() (*entity.NodeStatus, error) {
+	resp, err := http.Get(c.baseURL + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status failed: %w", responseError(resp))
+	}
+	var status entity.NodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Gaps returns how far followers are behind the leader, optionally
+// filtered by node and partition
+func (c *Client) Gaps(node string, partition string) ([]entity.Gap, error) {
+	query := url.Values{}
+	if node != "" {
+		query.Set("node", node)
+	}
+	if partition != "" {
+		query.Set("partition", partition)
+	}
+	resp, err := http.Get(c.baseURL + "/gaps?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gaps failed: %w", responseError(resp))
+	}
+	var result struct {
+		Gaps []entity.Gap `json:"gaps"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Gaps, nil
+}
+
+// ListPartitions summarizes every partition on the server
+func (c *Client) ListPartitions() ([]entity.PartitionInfo, error) {
+	resp, err := http.Get(c.baseURL + "/admin/partitions")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list partitions failed: %w", responseError(resp))
+	}
+	var result struct {
+		Partitions []entity.PartitionInfo `json:"partitions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Partitions, nil
+}
+
+// DescribePartition summarizes a partition and its segments
+func (c *Client) DescribePartition(partitionKey string) (*entity.PartitionInfo, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/admin/partitions/describe?partition=%s", c.baseURL, queryKey(partitionKey)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("describe partition failed: %w", responseError(resp))
+	}
+	var info entity.PartitionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// TruncatePartition removes every record of a partition after afterOffset
+func (c *Client) TruncatePartition(partitionKey string, afterOffset uint64) error {
+	return c.postAdmin("/admin/partitions/truncate", map[string]interface{}{
+		"partition_key": partitionKey,
+		"after_offset":  afterOffset,
+	})
+}
+
+// DeletePartition removes a partition and its files
+func (c *Client) DeletePartition(partitionKey string) error {
+	return c.postAdmin("/admin/partitions/delete", map[string]interface{}{
+		"partition_key": partitionKey,
+	})
+}
+
+// postAdmin posts a JSON admin request and checks that it succeeded
+func (c *Client) postAdmin(path string, reqBody map[string]interface{}) error {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(c.baseURL+path, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %w", path, responseError(resp))
+	}
+	return nil
 }
\ No newline at end of file
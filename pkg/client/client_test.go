@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gostorelog/internal/entity"
+)
+
+func TestClient_ErrorSentinels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("partition") {
+		case "missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"partition not found","code":"not_found"}`)
+		case "full":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":"partition is over its quota","code":"quota_exceeded"}`)
+		default:
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			fmt.Fprint(w, `{"error":"offset 0 was removed","code":"out_of_range"}`)
+		}
+	}))
+	defer server.Close()
+	c := NewClient(server.URL)
+
+	_, err := c.Read("missing", 0)
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "partition not found" {
+		t.Errorf("Expected an APIError with status 404, got %#v", err)
+	}
+	if _, err := c.Read("orders", 0); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Expected an out of range error, got %v", err)
+	}
+	if _, err := c.Read("full", 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected a quota exceeded error, got %v", err)
+	}
+	t.Logf("TestClient_ErrorSentinels passed: error responses match the client's sentinels")
+}
+
+func TestClient_SubscribeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: record\nid: 7\ndata: {\"offset\":7,\"data\":\"aGk=\",\"data_type\":2}\n\n")
+		fmt.Fprint(w, "event: error\ndata: {\"error\":\"offset 8 was removed\",\"code\":\"out_of_range\"}\n\n")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := NewClient(server.URL).Subscribe(ctx, "orders", 7)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	received := 0
+	for record := range sub.Records() {
+		if record.Offset != 7 {
+			t.Errorf("Expected offset 7, got %d", record.Offset)
+		}
+		received++
+	}
+	if received != 1 {
+		t.Errorf("Expected 1 record before the error, got %d", received)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("Expected the subscription to end on the error event, not to retry")
+	}
+	if err := sub.Err(); !errors.Is(err, entity.ErrOutOfRange) {
+		t.Errorf("Expected an out of range error, got %v", err)
+	}
+
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection reset"), true},
+		{&APIError{StatusCode: http.StatusServiceUnavailable, Code: "unavailable"}, true},
+		{&APIError{StatusCode: http.StatusNotFound, Code: "not_found"}, false},
+		{&APIError{Code: "unavailable"}, true},
+		{fmt.Errorf("subscribe failed: %w", &APIError{Code: "invalid_input"}), false},
+	}
+	for _, c := range cases {
+		if retryable(c.err) != c.retryable {
+			t.Errorf("Expected retryable(%v) to be %v", c.err, c.retryable)
+		}
+	}
+	t.Logf("TestClient_SubscribeError passed: request errors end the subscription, server errors are retried")
+}